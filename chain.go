@@ -0,0 +1,277 @@
+package wal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The chain file holds the genesis the hash chain started from, in hex,
+// so VerifyChain can check the first record of a WAL that hasn't had
+// any segments pruned.
+const chainFileName = "chain"
+
+// ErrChainBroken is matched, using errors.Is, by the ChainError returned
+// by VerifyChain when a record doesn't match the hash chain.
+var ErrChainBroken = errors.New("hash chain is broken")
+
+type ChainError struct {
+	// The position of the first record that doesn't match the chain.
+	Position Position
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("hash chain is broken at segment %d offset %d",
+		e.Position.Segment, e.Position.Offset)
+}
+
+func (e *ChainError) Is(target error) bool {
+	return target == ErrChainBroken
+}
+
+// chainHash returns the link in the hash chain for the extended record
+// value, which has a chain field, following prev. The chain field of
+// value is hashed as zeros, as it holds the result.
+func chainHash(prev, value []byte) []byte {
+	off := chainOffset(value)
+
+	h := sha256.New()
+	h.Write(prev)
+	h.Write(value[:off])
+	h.Write(make([]byte, sha256.Size))
+	h.Write(value[off+sha256.Size:])
+
+	return h.Sum(nil)
+}
+
+// chainOffset returns where the chain field of the extended record value
+// starts, the last of its fields, just before its data.
+func chainOffset(value []byte) int {
+	_, data, _ := decodeExtended(value)
+
+	return len(value) - len(data) - sha256.Size
+}
+
+// writeEntry writes an entry of type typ with value to the current
+// segment. With HashChain set, the chain of an extended record is
+// filled in first, and becomes the last link once it's written.
+func (wal *WALWriter) writeEntry(typ byte, value []byte) error {
+	var link []byte
+
+	if wal.opts.HashChain && typ == extendedType && value[0]&extChain != 0 {
+		link = chainHash(wal.chain, value)
+		copy(value[chainOffset(value):], link)
+	}
+
+	_, err := wal.segment.writeType(typ, value)
+	if err != nil {
+		return err
+	}
+
+	if link != nil {
+		wal.chain = link
+	}
+
+	return nil
+}
+
+// genesis returns the value the hash chain starts from.
+func (wal *WALWriter) genesis() []byte {
+	if len(wal.opts.ChainGenesis) == 0 {
+		return make([]byte, sha256.Size)
+	}
+
+	return wal.opts.ChainGenesis
+}
+
+// startChain starts the hash chain over from the genesis, recording it
+// in the chain file.
+func (wal *WALWriter) startChain() error {
+	wal.chain = wal.genesis()
+
+	return replaceFile(filepath.Join(wal.root, chainFileName), []byte(hex.EncodeToString(wal.chain)+"\n"))
+}
+
+// loadChain sets the last link of the hash chain from the latest segment
+// holding a chained record, or starts the chain if none does.
+func (wal *WALWriter) loadChain() error {
+	for i := wal.index; i >= wal.first; i-- {
+		link, err := lastSegmentChain(wal.opts.OpenFile, wal.format.path(wal.root, i))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return err
+		}
+
+		if link != nil {
+			wal.chain = link
+			return nil
+		}
+	}
+
+	return wal.startChain()
+}
+
+// lastSegmentChain returns the chain of the last chained record in the
+// segment at path, or nil if none is chained.
+func lastSegmentChain(open OpenFileFunc, path string) ([]byte, error) {
+	seg, err := openSegmentReader(open, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer seg.Close()
+
+	var link []byte
+
+	for {
+		ent, err := seg.readNext()
+		if err != nil {
+			// A segment a crash left partly written holds nothing
+			// past the damage.
+			if err == io.EOF || err == io.ErrUnexpectedEOF || err == ErrCorruptCRC {
+				return link, nil
+			}
+
+			return nil, err
+		}
+
+		if ent.entryType != extendedType {
+			continue
+		}
+
+		ext, _, err := decodeExtended(ent.value)
+		if err == nil && ext.chain != nil {
+			link = append([]byte{}, ext.chain...)
+		}
+	}
+}
+
+// readChainGenesis returns the genesis in the chain file of the WAL at
+// root, and false if there's no chain file.
+func readChainGenesis(root string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, chainFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	genesis, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, false, err
+	}
+
+	return genesis, true, nil
+}
+
+// VerifyChain checks the records of the WAL at root, written with
+// HashChain set, against the hash chain, from the record at from to the
+// end of the log. It returns a ChainError with the position of the first
+// record that doesn't match, or that has no link when the record before
+// it did. The records before from aren't checked, but are read for the
+// link from starts from. If nothing comes before it, it starts from the
+// genesis the writer recorded, unless segments have been pruned, in
+// which case the first record on disk is trusted and checking starts
+// after it. A damaged entry is reported as a broken chain too.
+func VerifyChain(root string, from Position) error {
+	format, err := existingFormat(root, segmentFormat{})
+	if err != nil {
+		return err
+	}
+
+	first, last, err := rangeSegments(root, format)
+	if err != nil {
+		return err
+	}
+
+	var prev []byte
+
+	if first == 0 {
+		genesis, ok, err := readChainGenesis(root)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			prev = genesis
+		}
+	}
+
+	for i := first; i <= last; i++ {
+		seg, err := NewSegmentReader(format.path(root, i))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return err
+		}
+
+		prev, err = verifySegmentChain(seg, i, from, prev)
+		seg.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifySegmentChain checks the records of seg, segment i, against the
+// chain following prev, as VerifyChain does, returning the last link.
+func verifySegmentChain(seg *SegmentReader, i int, from Position, prev []byte) ([]byte, error) {
+	for {
+		pos := Position{i, seg.Pos(), seg.epoch}
+
+		ent, err := seg.readNext()
+		if err != nil {
+			switch err {
+			case io.EOF:
+				return prev, nil
+			case io.ErrUnexpectedEOF, ErrCorruptCRC:
+				return nil, &ChainError{Position: pos}
+			default:
+				return nil, err
+			}
+		}
+
+		checked := i > from.Segment || (i == from.Segment && pos.Offset >= from.Offset)
+
+		var link []byte
+
+		switch ent.entryType {
+		case dataType:
+		case extendedType:
+			ext, _, err := decodeExtended(ent.value)
+			if err != nil {
+				return nil, err
+			}
+
+			link = ext.chain
+		default:
+			continue
+		}
+
+		if checked && prev != nil && (link == nil || !bytes.Equal(chainHash(prev, ent.value), link)) {
+			return nil, &ChainError{Position: pos}
+		}
+
+		prev = nil
+		if link != nil {
+			prev = append([]byte{}, link...)
+		}
+	}
+}
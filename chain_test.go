@@ -0,0 +1,170 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestHashChain(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	opts := DefaultWriteOptions
+	opts.HashChain = true
+	opts.SegmentSize = segmentHeaderSize + 3*opts.RecordSize(len("data0"))
+
+	write := func(t *testing.T, opts WriteOptions, from, to int) []Position {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		var positions []Position
+
+		for i := from; i < to; i++ {
+			pos, err := wal.WriteSeq(uint64(i), []byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+
+			positions = append(positions, pos)
+		}
+
+		return positions
+	}
+
+	n.It("verifies an untouched chain across segments and reopens", func() {
+		positions := write(t, opts, 0, 5)
+		positions = append(positions, write(t, opts, 5, 8)...)
+
+		require.True(t, positions[len(positions)-1].Segment > 0)
+
+		require.NoError(t, VerifyChain(path, Position{}))
+		require.NoError(t, VerifyChain(path, positions[4]))
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for i := 0; i < 8; i++ {
+			require.True(t, r.Next())
+			assert.Equal(t, fmt.Sprintf("data%d", i), string(r.Value()))
+		}
+	})
+
+	n.It("reports the first record changed", func() {
+		positions := write(t, opts, 0, 8)
+
+		// Rewrite data4 as data9, fixing up its CRC as a tamperer
+		// would.
+		format, err := existingFormat(path, segmentFormat{})
+		require.NoError(t, err)
+
+		seg := format.path(path, positions[4].Segment)
+
+		data, err := ioutil.ReadFile(seg)
+		require.NoError(t, err)
+
+		off := positions[4].Offset
+		ent, size, err := readEntryAt(bytes.NewReader(data), off, int64(len(data)))
+		require.NoError(t, err)
+
+		value := append([]byte{}, ent.value...)
+		value[len(value)-1] = '9'
+
+		tampered := append(append(append([]byte{}, data[:off]...),
+			encodeEntry(extendedType, value)...), data[off+size:]...)
+
+		err = ioutil.WriteFile(seg, tampered, 0644)
+		require.NoError(t, err)
+
+		err = VerifyChain(path, Position{})
+		require.True(t, errors.Is(err, ErrChainBroken))
+
+		var ce *ChainError
+		require.True(t, errors.As(err, &ce))
+		assert.Equal(t, positions[4].Segment, ce.Position.Segment)
+		assert.Equal(t, positions[4].Offset, ce.Position.Offset)
+
+		// Checking only after the change misses it.
+		require.NoError(t, VerifyChain(path, positions[5]))
+	})
+
+	n.It("starts the chain from the configured genesis", func() {
+		opts := opts
+		opts.ChainGenesis = []byte("genesis")
+
+		write(t, opts, 0, 2)
+
+		require.NoError(t, VerifyChain(path, Position{}))
+
+		err := ioutil.WriteFile(filepath.Join(path, chainFileName), []byte("00\n"), 0644)
+		require.NoError(t, err)
+
+		err = VerifyChain(path, Position{})
+		assert.True(t, errors.Is(err, ErrChainBroken))
+	})
+
+	n.It("filters chained records by key", func() {
+		opts := DefaultWriteOptions
+		opts.HashChain = true
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		var want []string
+
+		// Enough records that some chains would read as a short key
+		// if the chain were mistaken for one.
+		for i := 0; i < 20; i++ {
+			_, err = wal.WriteKeyed([]byte("other"), []byte("data"))
+			require.NoError(t, err)
+
+			val := fmt.Sprintf("data%d", i)
+
+			_, err = wal.WriteKeyed([]byte("wanted"), []byte(val))
+			require.NoError(t, err)
+
+			want = append(want, val)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var got []string
+
+		for val := range r.FilterKey(func(key []byte) bool { return string(key) == "wanted" }) {
+			got = append(got, string(val))
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, want, got)
+
+		require.NoError(t, VerifyChain(path, Position{}))
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,111 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+// ErrCheckpointNotFound is returned by LastCheckpoint when the WAL holds
+// no checkpoint.
+var ErrCheckpointNotFound = errors.New("checkpoint not found")
+
+// WriteCheckpoint writes a checkpoint saying that everything up to upTo
+// is covered by the snapshot snapshotID, which is kept somewhere else,
+// returning the checkpoint's position. Like a tag, a checkpoint isn't a
+// record, so Next passes over it, and it's pruned with its segment.
+// LastCheckpoint finds the latest, so that recovery can load the
+// snapshot and read on from upTo.
+func (wal *WALWriter) WriteCheckpoint(snapshotID []byte, upTo Position) (Position, error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
+
+	value := encodeCheckpoint(snapshotID, upTo)
+
+	pos, err := wal.writeValue(checkpointType, value, wal.makeRoom)
+	if err != nil || !wal.opts.Paranoid {
+		return pos, err
+	}
+
+	return pos, wal.checkEntry(pos, checkpointType, value)
+}
+
+// encodeCheckpoint returns the value of a checkpointType entry: the
+// length of snapshotID as a uvarint, snapshotID, then the segment,
+// offset and epoch of upTo as 8 big endian bytes each.
+func encodeCheckpoint(snapshotID []byte, upTo Position) []byte {
+	buf := appendUvarint(nil, uint64(len(snapshotID)))
+	buf = append(buf, snapshotID...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(upTo.Segment))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(upTo.Offset))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(upTo.Epoch))
+
+	return buf
+}
+
+// decodeCheckpoint splits the value of a checkpointType entry into the
+// snapshot and the position it covers. The snapshot refers to value.
+func decodeCheckpoint(value []byte) ([]byte, Position, error) {
+	n, sz := binary.Uvarint(value)
+	if sz <= 0 || uint64(len(value)-sz) != n+24 {
+		return nil, Position{}, ErrMalformedRecord
+	}
+
+	id := value[sz : sz+int(n)]
+	rest := value[sz+int(n):]
+
+	return id, Position{
+		Segment: int(binary.BigEndian.Uint64(rest[:8])),
+		Offset:  int64(binary.BigEndian.Uint64(rest[8:16])),
+		Epoch:   int64(binary.BigEndian.Uint64(rest[16:24])),
+	}, nil
+}
+
+// LastCheckpoint returns the snapshot and covered position of the latest
+// checkpoint written by WriteCheckpoint. Segments are scanned starting
+// from the last one, and earlier segments are only opened when the later
+// ones have no checkpoint. The reader isn't moved.
+// ErrCheckpointNotFound is returned if there's no checkpoint.
+func (r *WALReader) LastCheckpoint() ([]byte, Position, error) {
+	segments, err := sortedSegments(r.root, r.format)
+	if err != nil {
+		return nil, Position{}, err
+	}
+
+	for j := len(segments) - 1; j >= 0; j-- {
+		seg, err := r.openSegment(r.format.path(r.root, segments[j]))
+		if err != nil {
+			// Pruned since the segments were listed.
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, Position{}, err
+		}
+
+		var last []byte
+
+		for seg.nextOfType(checkpointType) {
+			last = append(last[:0], seg.Value()...)
+		}
+
+		err = seg.Error()
+		seg.Close()
+
+		if err != nil {
+			return nil, Position{}, err
+		}
+
+		if last != nil {
+			id, upTo, err := decodeCheckpoint(last)
+			if err != nil {
+				return nil, Position{}, err
+			}
+
+			return id, upTo, nil
+		}
+	}
+
+	return nil, Position{}, ErrCheckpointNotFound
+}
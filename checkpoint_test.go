@@ -0,0 +1,87 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestCheckpoint(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	opts := DefaultWriteOptions
+	opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+	opts.MaxSegments = 100
+
+	n.It("finds the latest checkpoint", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		_, _, err = r.LastCheckpoint()
+		assert.Equal(t, ErrCheckpointNotFound, err)
+
+		var positions []Position
+
+		for i := 0; i < 6; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+
+			pos := wal.LastPos()
+			positions = append(positions, pos)
+
+			if i == 1 || i == 3 {
+				_, err = wal.WriteCheckpoint([]byte(fmt.Sprintf("snap%d", i)), pos)
+				require.NoError(t, err)
+			}
+		}
+
+		id, upTo, err := r.LastCheckpoint()
+		require.NoError(t, err)
+
+		assert.Equal(t, "snap3", string(id))
+		assert.Equal(t, positions[3], upTo)
+
+		// Checkpoints aren't records.
+		for i := 0; i < 6; i++ {
+			require.True(t, r.Next())
+			assert.Equal(t, fmt.Sprintf("data%d", i), string(r.Value()))
+		}
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		// Recovery reads on from the record after the one covered.
+		err = r.Seek(upTo)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		require.True(t, r.Next())
+		assert.Equal(t, "data4", string(r.Value()))
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,301 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// compactFileName is the file a compacted segment is built in before
+// it's renamed over the original. It contains no digits so it's never
+// mistaken for a segment.
+const compactFileName = "compacting"
+
+// keyState is where the latest record for a key is, and whether it's a
+// tombstone, a record with no data.
+type keyState struct {
+	pos       Position
+	tombstone bool
+}
+
+// ErrCompactionForbidden is returned by CompactByKey when the WAL's
+// options rule out removing records: NoPrune, which keeps everything
+// written, or HashChain, whose chain wouldn't verify across the records
+// removed.
+var ErrCompactionForbidden = errors.New("compaction is forbidden by the WAL's options")
+
+// CompactByKey removes the keyed records, written by WriteKeyed, that a
+// later record for the same key supersedes, turning the log into one
+// holding the current value of each key. A key whose latest record is
+// a tombstone, one written with no data, has all of its records
+// removed, including the tombstone. Records without a key, tags and
+// checkpoints are all kept.
+//
+// A keyed record split by SplitLargeRecords has its key in its first
+// chunk, and only that chunk is removed: readers pass over the rest, as
+// they do chunks whose start was pruned.
+//
+// Only segments other than the one being written to are compacted,
+// and only those closed properly. Each is rebuilt in a separate file
+// and renamed over the original, so a crash leaves either the old
+// segment or the compacted one. The records kept move to new positions:
+// tags and keys remembered by the writer are updated to match, but
+// positions held elsewhere, such as by readers or in checkpoints,
+// aren't.
+//
+// A sealed WAL isn't compacted, and ErrSealed is returned. Nor is one
+// written with NoPrune or HashChain, and ErrCompactionForbidden is
+// returned.
+func (wal *WALWriter) CompactByKey() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.sealed {
+		return ErrSealed
+	}
+
+	if wal.opts.NoPrune || wal.opts.HashChain {
+		return ErrCompactionForbidden
+	}
+
+	latest, err := wal.latestKeys()
+	if err != nil {
+		return err
+	}
+
+	retagged, rekeyed, lostLast := false, false, false
+
+	for i := wal.first; i < wal.index; i++ {
+		moved, kept, err := wal.compactSegment(i, latest)
+		if err != nil {
+			if os.IsNotExist(err) || err == ErrUnclosedSegment {
+				continue
+			}
+
+			return err
+		}
+
+		if moved == nil {
+			continue
+		}
+
+		for tag, pos := range wal.cache.Tags {
+			if pos.Segment == i {
+				pos.Offset = moved[pos.Offset]
+				wal.cache.Tags[tag] = pos
+				retagged = true
+			}
+		}
+
+		for key, pos := range wal.keys {
+			if pos.Segment != i {
+				continue
+			}
+
+			if off, ok := moved[pos.Offset]; ok {
+				pos.Offset = off
+				wal.keys[key] = pos
+			} else {
+				delete(wal.keys, key)
+			}
+
+			rekeyed = true
+		}
+
+		if wal.lastPos.Segment == i {
+			if off, ok := moved[wal.lastPos.Offset]; ok {
+				wal.lastPos.Offset = off
+			} else {
+				lostLast = true
+			}
+		}
+
+		wal.counts[i] = kept
+	}
+
+	// The last record written was removed, leaving the last of those
+	// kept as the last record.
+	if lostLast {
+		wal.lastPos, err = lastPosition(wal.opts.OpenFile, wal.root, wal.format, wal.first, wal.index)
+		if err != nil && err != ErrNoSegments {
+			return err
+		}
+	}
+
+	if retagged {
+		err = wal.flushTagsFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	if rekeyed {
+		err = wal.compactKeysFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// latestKeys returns where the latest record for each key is, reading
+// every segment including the one being written to.
+func (wal *WALWriter) latestKeys() (map[string]keyState, error) {
+	latest := make(map[string]keyState)
+
+	for i := wal.first; i <= wal.index; i++ {
+		data, start, err := readSegmentFile(wal.opts.OpenFile, wal.format.path(wal.root, i))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		r := bytes.NewReader(data)
+
+		for off := start; ; {
+			// The end of the segment, or damage that ends it.
+			ent, size, err := readEntryAt(r, off, int64(len(data)))
+			if err != nil {
+				break
+			}
+
+			if ent.entryType == extendedType {
+				ext, value, err := decodeExtended(ent.value)
+				if err == nil && ext.key != nil {
+					latest[string(ext.key)] = keyState{
+						pos:       Position{i, off, 0},
+						tombstone: len(wal.readValue(value)) == 0,
+					}
+				}
+			}
+
+			off += size
+		}
+	}
+
+	return latest, nil
+}
+
+// readSegmentFile returns the contents of the segment at path, opened
+// with open, see openRead, and where its entries start, after its header.
+func readSegmentFile(open OpenFileFunc, path string) ([]byte, int64, error) {
+	f, err := openRead(open, path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hdr, _, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, headerError(path, err)
+	}
+
+	return data, hdr.size, nil
+}
+
+// compactSegment rewrites segment i without the keyed records that
+// aren't the latest for their key, or whose key's latest record is a
+// tombstone. It returns where each entry kept moved to, keyed by where
+// it was, and the number of records kept, or a nil map if nothing was
+// removed, in which case the segment is left alone.
+func (wal *WALWriter) compactSegment(i int, latest map[string]keyState) (map[int64]int64, int64, error) {
+	path := wal.format.path(wal.root, i)
+
+	data, start, err := readSegmentFile(wal.opts.OpenFile, path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r := bytes.NewReader(data)
+
+	tail, err := readTail(r, int64(len(data)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !tail.clean {
+		return nil, 0, ErrUnclosedSegment
+	}
+
+	var (
+		out     = append([]byte{}, data[:start]...)
+		moved   = make(map[int64]int64)
+		kept    int64
+		last    int64 = -1
+		dropped bool
+	)
+
+	for off := start; off < tail.end; {
+		ent, size, err := readEntryAt(r, off, tail.end)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		keep := true
+
+		switch ent.entryType {
+		case dataType:
+			kept++
+		case extendedType:
+			ext, _, err := decodeExtended(ent.value)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			if ext.key != nil {
+				st := latest[string(ext.key)]
+				keep = st.pos.Segment == i && st.pos.Offset == off && !st.tombstone
+			}
+
+			if keep {
+				kept++
+			}
+		}
+
+		if keep {
+			if startsRecord(ent.entryType, ent.value) {
+				last = int64(len(out))
+			}
+
+			moved[off] = int64(len(out))
+			out = append(out, data[off:off+size]...)
+		} else {
+			dropped = true
+		}
+
+		off += size
+	}
+
+	if !dropped {
+		return nil, 0, nil
+	}
+
+	out = append(out, encodeFooter(kept, last)...)
+	out = append(out, closingMagic...)
+
+	tmp := filepath.Join(wal.root, compactFileName)
+
+	err = writeReplacement(wal.opts.OpenFile, tmp, out)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return nil, 0, err
+	}
+
+	return moved, kept, nil
+}
@@ -0,0 +1,206 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestCompactByKey(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	opts := DefaultWriteOptions
+	opts.SegmentSize = segmentHeaderSize + 3*entrySize(len("data0")+3)
+	opts.MaxSegments = 100
+
+	n.It("keeps only the latest record for each key", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		writes := []struct{ key, data string }{
+			{"a", "a0"}, {"b", "b0"}, {"", "plain"}, {"a", "a1"},
+			{"c", "c0"}, {"b", ""}, {"a", "a2"}, {"c", "c1"},
+		}
+
+		var tombstone Position
+
+		for _, w := range writes {
+			if w.key == "" {
+				err = wal.Write([]byte(w.data))
+			} else {
+				var pos Position
+
+				pos, err = wal.WriteKeyed([]byte(w.key), []byte(w.data))
+
+				if w.data == "" {
+					tombstone = pos
+				}
+			}
+
+			require.NoError(t, err)
+
+			if w.data == "plain" {
+				err = wal.WriteTag([]byte("commit"))
+				require.NoError(t, err)
+			}
+		}
+
+		want := []string{"=plain", "a=a2", "c=c1"}
+
+		// Only a tombstone in a segment that's compacted is removed.
+		for wal.index <= tombstone.Segment {
+			err = wal.Write([]byte("last"))
+			require.NoError(t, err)
+
+			want = append(want, "=last")
+		}
+
+		err = wal.CompactByKey()
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var got []string
+
+		for r.Next() {
+			got = append(got, fmt.Sprintf("%s=%s", r.Key(), r.Value()))
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, want, got)
+
+		err = r.SeekTag([]byte("commit"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "a2", string(r.Value()))
+
+		err = r.SeekKey([]byte("a"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "a2", string(r.Value()))
+
+		err = r.SeekKey([]byte("b"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		for i := wal.first; i < wal.index; i++ {
+			cnt, err := countRecords(nil, wal.format.path(path, i))
+			require.NoError(t, err)
+
+			assert.Equal(t, wal.counts[i], cnt)
+		}
+	})
+
+	n.It("moves the last position back when the last record is removed", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("keep"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("a"), []byte("a0"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("a"), nil)
+		require.NoError(t, err)
+
+		err = wal.Rotate()
+		require.NoError(t, err)
+
+		err = wal.CompactByKey()
+		require.NoError(t, err)
+
+		assert.Equal(t, Position{0, segmentHeaderSize, wal.epoch}, wal.LastPos())
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.Seek(wal.LastPos())
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "keep", string(r.Value()))
+	})
+
+	n.It("refuses to compact a sealed WAL", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		_, err = wal.WriteKeyed([]byte("a"), []byte("a0"))
+		require.NoError(t, err)
+
+		err = wal.Seal()
+		require.NoError(t, err)
+
+		assert.Equal(t, ErrSealed, wal.CompactByKey())
+	})
+
+	n.It("refuses to compact a WAL that's never pruned or is hash chained", func() {
+		for _, set := range []func(*WriteOptions){
+			func(o *WriteOptions) { o.NoPrune = true },
+			func(o *WriteOptions) { o.HashChain = true },
+		} {
+			os.RemoveAll(path)
+
+			opts := opts
+			set(&opts)
+
+			wal, err := NewWithOptions(path, opts)
+			require.NoError(t, err)
+
+			for i := 0; i < 6; i++ {
+				_, err = wal.WriteKeyed([]byte("a"), []byte(fmt.Sprintf("a%d", i)))
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, ErrCompactionForbidden, wal.CompactByKey())
+
+			err = wal.Close()
+			require.NoError(t, err)
+
+			r, err := NewReader(path)
+			require.NoError(t, err)
+
+			cnt := 0
+			for r.Next() {
+				cnt++
+			}
+
+			r.Close()
+
+			assert.Equal(t, 6, cnt)
+		}
+	})
+
+	n.Meow()
+}
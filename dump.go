@@ -0,0 +1,70 @@
+package wal
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// DumpEntry describes a single entry of a segment, as written by
+// DumpSegment.
+type DumpEntry struct {
+	// The offset of the entry within the segment.
+	Pos int64 `json:"pos"`
+
+	// The length of the entry's value, and the CRC stored for it.
+	Len int    `json:"len"`
+	CRC uint32 `json:"crc"`
+
+	// The entry's type byte: "d" for a record, "t" for a tag, "x" for
+	// a record with extra fields such as a key, "c" for a checkpoint,
+	// "h" for the segment header, "f" for the footer, and "s" for
+	// markers such as the one written on close.
+	Type string `json:"type"`
+
+	// The entry's value exactly as stored, base64 encoded in JSON.
+	Value []byte `json:"value"`
+}
+
+// DumpSegment writes every entry of the segment at path to w as a line
+// of JSON, see DumpEntry. Entries of every type are included, undecoded,
+// so the output reflects exactly what's on disk. No writer is needed and
+// the segment is opened read only. If the segment ends with an incomplete
+// entry, as when it was being written to, a final {"truncated":true}
+// line is written instead of an error. A corrupt entry is returned as an
+// error after the entries before it are written.
+func DumpSegment(path string, w io.Writer) error {
+	fr, err := NewFrameReader(path)
+	if err != nil {
+		return err
+	}
+
+	defer fr.Close()
+
+	enc := json.NewEncoder(w)
+
+	for fr.Next() {
+		f := fr.Frame()
+		if !f.Valid {
+			return ErrCorruptCRC
+		}
+
+		err = enc.Encode(DumpEntry{
+			Pos:   f.Offset,
+			Len:   len(f.Payload),
+			CRC:   f.CRC,
+			Type:  string(f.Type),
+			Value: f.Payload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if fr.Truncated() {
+		return enc.Encode(struct {
+			Truncated bool `json:"truncated"`
+		}{true})
+	}
+
+	return fr.Error()
+}
@@ -0,0 +1,108 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestDump(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "seg")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	dump := func() []map[string]interface{} {
+		var buf bytes.Buffer
+
+		err := DumpSegment(path, &buf)
+		require.NoError(t, err)
+
+		var lines []map[string]interface{}
+
+		sc := bufio.NewScanner(&buf)
+		for sc.Scan() {
+			var line map[string]interface{}
+
+			err = json.Unmarshal(sc.Bytes(), &line)
+			require.NoError(t, err)
+
+			lines = append(lines, line)
+		}
+
+		return lines
+	}
+
+	n.It("dumps every entry of a segment", func() {
+		seg, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		_, err = seg.Write([]byte("data"))
+		require.NoError(t, err)
+
+		err = seg.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		require.NoError(t, seg.Close())
+
+		lines := dump()
+		require.Len(t, lines, 5)
+
+		assert.Equal(t, "h", lines[0]["type"])
+		assert.Equal(t, float64(0), lines[0]["pos"])
+
+		assert.Equal(t, "d", lines[1]["type"])
+		assert.Equal(t, float64(segmentHeaderSize), lines[1]["pos"])
+		assert.Equal(t, float64(4), lines[1]["len"])
+		assert.Equal(t, "ZGF0YQ==", lines[1]["value"])
+
+		assert.Equal(t, "t", lines[2]["type"])
+		assert.Equal(t, float64(segmentHeaderSize+entrySize(4)), lines[2]["pos"])
+
+		assert.Equal(t, "f", lines[3]["type"])
+		assert.Equal(t, float64(footerLen), lines[3]["len"])
+
+		assert.Equal(t, "s", lines[4]["type"])
+	})
+
+	n.It("reports a truncated final entry", func() {
+		seg, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		_, err = seg.Write([]byte("data"))
+		require.NoError(t, err)
+
+		_, err = seg.Write([]byte("partial"))
+		require.NoError(t, err)
+
+		size := seg.Size()
+		seg.f.Close()
+
+		err = os.Truncate(path, size-3)
+		require.NoError(t, err)
+
+		lines := dump()
+		require.Len(t, lines, 3)
+
+		assert.Equal(t, "d", lines[1]["type"])
+		assert.Equal(t, map[string]interface{}{"truncated": true}, lines[2])
+	})
+
+	n.Meow()
+}
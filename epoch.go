@@ -0,0 +1,132 @@
+package wal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The epoch file holds the number of times the WAL has been started over
+// by TruncateAll, in decimal. It's absent until the first time, which is
+// the same as epoch 0.
+const epochFileName = "epoch"
+
+// ErrLogReset is returned by a reader that finds the WAL has been started
+// over since it was opened or last Reset, such as by TruncateAll, so the
+// segments it would read next belong to a new log rather than continuing
+// the one it was reading. Reset starts reading the new log from the
+// beginning.
+var ErrLogReset = errors.New("log was reset")
+
+// readEpoch returns the epoch of the WAL in root.
+func readEpoch(root string) (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, epochFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	epoch, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return epoch, nil
+}
+
+// writeEpoch records epoch as the epoch of the WAL in root.
+func writeEpoch(root string, epoch int64) error {
+	return replaceFile(filepath.Join(root, epochFileName), []byte(strconv.FormatInt(epoch, 10)+"\n"))
+}
+
+// replaceFile replaces the file at path with one holding data, renaming
+// it into place and syncing it, so it's never seen partly written and
+// doesn't go back after a crash.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// checkReset returns ErrLogReset if the WAL has been started over since
+// the reader last looked: its epoch has changed, or the last segment is
+// now before the one the reader is reading.
+func (r *WALReader) checkReset(last int) error {
+	epoch, err := readEpoch(r.root)
+	if err != nil {
+		return err
+	}
+
+	if epoch != r.epoch || last < r.index {
+		return ErrLogReset
+	}
+
+	return nil
+}
+
+// ErrStalePosition is returned when seeking to or reading at a position
+// whose segment has been replaced by another with the same number since
+// the position was taken, such as by TruncateAll.
+var ErrStalePosition = errors.New("stale position")
+
+// segmentHeader returns the header of segment seg, read from the
+// writer's own file if it's the current segment.
+func (wal *WALWriter) segmentHeader(seg int) (segmentHeader, error) {
+	f := wal.segment.f
+
+	if seg != wal.index {
+		var err error
+
+		f, err = openRead(wal.opts.OpenFile, wal.format.path(wal.root, seg))
+		if err != nil {
+			return segmentHeader{}, err
+		}
+
+		defer f.Close()
+	}
+
+	hdr, _, err := readHeader(f)
+
+	return hdr, err
+}
+
+// checkEpoch returns ErrStalePosition if p doesn't have the epoch of its
+// segment.
+func (wal *WALWriter) checkEpoch(p Position) error {
+	hdr, err := wal.segmentHeader(p.Segment)
+	if err != nil {
+		return err
+	}
+
+	if p.Epoch != hdr.epoch {
+		return ErrStalePosition
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package wal
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrNotEmpty   = errors.New("directory is not empty")
+	ErrBadArchive = errors.New("archive contains something other than WAL files")
+)
+
+// Export writes the WAL in root to w as a tar archive, for Import to
+// restore. Segments are copied byte for byte under their own names,
+// along with the tags, keys, epoch, seq, seq index and chain files, so
+// every Position in the WAL refers to the same record once it's
+// imported, and a writer opened on it carries on where this one left
+// off. The durable watermark and the files marking a handoff, compaction
+// or merge in progress describe the writer running on the WAL rather
+// than its contents, so they're left out. A writer may be using
+// the WAL while it's exported: the current segment is copied as far as
+// it had been written when Export reached it, and segments pruned while
+// the export runs are left out.
+func Export(root string, w io.Writer) error {
+	format, err := existingFormat(root, segmentFormat{})
+	if err != nil {
+		return err
+	}
+
+	segments, err := sortedSegments(root, format)
+	if err != nil {
+		return err
+	}
+
+	names := []string{"tags", keysFileName, epochFileName, seqFileName, seqIndexFileName, chainFileName}
+
+	for _, idx := range segments {
+		names = append(names, format.name(idx))
+	}
+
+	tw := tar.NewWriter(w)
+
+	for _, name := range names {
+		err = exportFile(tw, filepath.Join(root, name), name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// exportFile adds the file at path to tw as name, if it still exists.
+func exportFile(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only as much as there was when the header was written, however
+	// much has been written since.
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+// Import restores a WAL written by Export into root, which must not
+// exist or be empty. The segments keep the indexes and contents they
+// had, so positions taken from the exported WAL, such as checkpoints,
+// resolve to the same records in the imported one. Segment modification
+// times are restored too, so SegmentTTL applies as it would have.
+func Import(root string, r io.Reader) error {
+	err := os.Mkdir(root, 0755)
+	if err != nil {
+		if !os.IsExist(err) {
+			return err
+		}
+
+		names, err := readDirNames(root)
+		if err != nil {
+			return err
+		}
+
+		if len(names) > 0 {
+			return ErrNotEmpty
+		}
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Only plain files directly in root are ever exported.
+		if hdr.Typeflag != tar.TypeReg || filepath.Base(hdr.Name) != hdr.Name ||
+			hdr.Name == "." || hdr.Name == ".." {
+			return ErrBadArchive
+		}
+
+		err = importFile(filepath.Join(root, hdr.Name), tr, hdr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// importFile writes the contents of the current file in tr to path.
+func importFile(path string, tr *tar.Reader, hdr *tar.Header) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, tr)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,194 @@
+package wal
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestExport(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+	restored := filepath.Join(dir, "restored")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+		os.RemoveAll(restored)
+	})
+
+	n.It("imports a WAL with the positions it was exported with", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 2
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		var (
+			pos Position
+			buf bytes.Buffer
+		)
+
+		for i := 0; i < 7; i++ {
+			p, _, err := wal.Append([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+
+			if i == 5 {
+				pos = p
+			}
+		}
+
+		// Pruning means the segments don't start from 0.
+		require.Equal(t, 2, wal.first)
+
+		err = Export(path, &buf)
+		require.NoError(t, err)
+
+		err = Import(restored, &buf)
+		require.NoError(t, err)
+
+		r, err := NewReader(restored)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.Seek(pos)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data5", string(r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data6", string(r.Value()))
+		assert.Equal(t, 3, r.Pos().Segment)
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		restart, err := NewWithOptions(restored, opts)
+		require.NoError(t, err)
+
+		defer restart.Close()
+
+		err = restart.Write([]byte("data7"))
+		require.NoError(t, err)
+	})
+
+	n.It("carries the epoch, sequences and hash chain over", func() {
+		opts := DefaultWriteOptions
+		opts.SeqIndex = true
+		opts.DedupBySeq = true
+		opts.HashChain = true
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		_, err = wal.WriteSeq(1, []byte("before"))
+		require.NoError(t, err)
+
+		err = wal.TruncateAll()
+		require.NoError(t, err)
+
+		pos, err := wal.WriteSeq(2, []byte("after"))
+		require.NoError(t, err)
+		require.Equal(t, int64(1), pos.Epoch)
+
+		err = wal.Rotate()
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+
+		err = Export(path, &buf)
+		require.NoError(t, err)
+
+		err = Import(restored, &buf)
+		require.NoError(t, err)
+
+		for _, name := range []string{epochFileName, seqFileName, seqIndexFileName, chainFileName} {
+			want, err := ioutil.ReadFile(filepath.Join(path, name))
+			require.NoError(t, err)
+
+			got, err := ioutil.ReadFile(filepath.Join(restored, name))
+			require.NoError(t, err, name)
+			assert.Equal(t, want, got, name)
+		}
+
+		r, err := NewReader(restored)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.Seek(pos)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "after", string(r.Value()))
+
+		err = VerifyChain(restored, Position{})
+		require.NoError(t, err)
+
+		restart, err := NewWithOptions(restored, opts)
+		require.NoError(t, err)
+
+		defer restart.Close()
+
+		_, err = restart.WriteSeq(3, []byte("restored"))
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(1), restart.LastPos().Epoch)
+	})
+
+	n.It("refuses to import into a directory that isn't empty", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		wal.Close()
+
+		var buf bytes.Buffer
+
+		err = Export(path, &buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, ErrNotEmpty, Import(path, &buf))
+	})
+
+	n.It("refuses archives with files outside the WAL", func() {
+		var buf bytes.Buffer
+
+		tw := tar.NewWriter(&buf)
+
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "../escape",
+			Mode:     0644,
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, tw.Close())
+
+		assert.Equal(t, ErrBadArchive, Import(restored, &buf))
+
+		_, err = os.Stat(filepath.Join(dir, "escape"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,40 @@
+package wal
+
+import (
+	"io"
+	"os"
+)
+
+// SegmentFile is what a segment is stored in. *os.File implements it.
+type SegmentFile interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// OpenFileFunc opens the segment file at name, like os.OpenFile, with
+// flag and perm meaning the same as they do there. It's given as the
+// OpenFile option to wrap the files segments are read and written
+// through, such as to count or fail operations on them, or to add
+// buffering. It isn't a storage backend: the segments must still be
+// files at the names given, as the WAL's directory is listed, and its
+// segments stat'd, renamed and removed, directly. Functions given a path
+// rather than options, such as NewFrameReader, Export and
+// ReplaceSegment, open files with the os package.
+type OpenFileFunc func(name string, flag int, perm os.FileMode) (SegmentFile, error)
+
+// DefaultOpenFile opens segment files with os.OpenFile.
+func DefaultOpenFile(name string, flag int, perm os.FileMode) (SegmentFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,148 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+// countingFile is a SegmentFile that counts the bytes written through
+// it, atomically so the count can be read while writes go on.
+type countingFile struct {
+	SegmentFile
+	written *int64
+}
+
+func (f countingFile) Write(b []byte) (int, error) {
+	n, err := f.SegmentFile.Write(b)
+	atomic.AddInt64(f.written, int64(n))
+	return n, err
+}
+
+func TestOpenFile(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	n.It("opens segments with the OpenFile option", func() {
+		var (
+			lock    sync.Mutex
+			opened  = map[string]int{}
+			written int64
+		)
+
+		open := func(name string, flag int, perm os.FileMode) (SegmentFile, error) {
+			f, err := DefaultOpenFile(name, flag, perm)
+			if err != nil {
+				return nil, err
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			opened[filepath.Base(name)]++
+
+			return countingFile{f, &written}, nil
+		}
+
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 100
+		opts.OpenFile = open
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		for i := 0; i < 4; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		data, err := wal.ReadAt(Position{0, segmentHeaderSize, 0})
+		require.NoError(t, err)
+		assert.Equal(t, "data0", string(data))
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		lock.Lock()
+		assert.Equal(t, 2, len(opened))
+		assert.True(t, atomic.LoadInt64(&written) > 0)
+		lock.Unlock()
+
+		r, err := NewReaderWithOptions(path, ReadOptions{OpenFile: open})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for i := 0; i < 4; i++ {
+			require.True(t, r.Next())
+			assert.Equal(t, fmt.Sprintf("data%d", i), string(r.Value()))
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		assert.Equal(t, 2, len(opened))
+
+		// Each segment was opened again by the reader.
+		for name, cnt := range opened {
+			assert.True(t, cnt > 1, name)
+		}
+	})
+
+	n.It("opens segments with the OpenFile option when merging and compacting", func() {
+		opened := map[string]int{}
+
+		open := func(name string, flag int, perm os.FileMode) (SegmentFile, error) {
+			opened[filepath.Base(name)]++
+			return DefaultOpenFile(name, flag, perm)
+		}
+
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0")+3)
+		opts.MaxSegments = 100
+		opts.OpenFile = open
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 6; i++ {
+			_, err = wal.WriteKeyed([]byte("k"), []byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, 2, wal.index)
+
+		err = wal.MergeSegments(0, 1)
+		require.NoError(t, err)
+
+		assert.NotZero(t, opened[mergeFileName])
+
+		err = wal.CompactByKey()
+		require.NoError(t, err)
+
+		assert.NotZero(t, opened[compactFileName])
+	})
+
+	n.Meow()
+}
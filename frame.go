@@ -0,0 +1,214 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Frame is a single entry of a segment, exactly as stored, as returned
+// by FrameReader.
+type Frame struct {
+	// Where the entry starts in the segment, and the number of bytes
+	// it takes, including its CRC, type and length.
+	Offset int64
+	Length int64
+
+	// The entry's type byte, see DumpEntry.Type.
+	Type byte
+
+	// The flags saying which fields an extended record ('x') has, or
+	// 0 for any other type.
+	Flags byte
+
+	// The entry's value as stored, undecoded.
+	Payload []byte
+
+	// The CRC stored for the entry, and whether the entry matches it.
+	CRC   uint32
+	Valid bool
+}
+
+// FrameReader walks every entry of a single segment, of every type,
+// including the header, footer and the markers written on close, for
+// tools that inspect segments themselves. Unlike SegmentReader, nothing
+// is decoded or skipped, and an entry that fails its CRC is returned
+// with Valid unset rather than ending the walk. DumpSegment is built on
+// it. It doesn't understand segments written with a Framer other than
+// the default.
+type FrameReader struct {
+	f *os.File
+	r *bufio.Reader
+
+	pos   int64
+	size  int64
+	frame Frame
+	buf   []byte
+
+	truncated bool
+	sealed    bool
+	err       error
+}
+
+// NewFrameReader opens the segment at path, read only, to walk its
+// entries from the start.
+func NewFrameReader(path string) (*FrameReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &FrameReader{f: f, r: bufio.NewReader(f), size: fi.Size()}, nil
+}
+
+// Next moves to the next entry, returning false at the end of the
+// segment, or if it ends with an incomplete entry, which Truncated
+// reports, or if reading fails, which Error reports. A segment still
+// being written to can be read further once more has been written.
+func (fr *FrameReader) Next() bool {
+	if fr.err != nil {
+		return false
+	}
+
+	var hdr [5]byte
+
+	n, err := io.ReadFull(fr.r, hdr[:])
+	if err != nil {
+		return fr.stop(err, n > 0)
+	}
+
+	cnt, err := binary.ReadUvarint(fr.r)
+	if err != nil {
+		return fr.stop(err, true)
+	}
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	l := int64(binary.PutUvarint(lenBuf[:], cnt))
+
+	if int64(cnt) < 0 || !fr.fits(5+l, int64(cnt)) {
+		return fr.stop(io.ErrUnexpectedEOF, true)
+	}
+
+	if uint64(cap(fr.buf)) < cnt {
+		fr.buf = make([]byte, cnt)
+	}
+
+	payload := fr.buf[:cnt]
+
+	_, err = io.ReadFull(fr.r, payload)
+	if err != nil {
+		return fr.stop(err, true)
+	}
+
+	crc := binary.BigEndian.Uint32(hdr[:4])
+
+	h := crc32.NewIEEE()
+	h.Write(lenBuf[:l])
+	h.Write(payload)
+
+	fr.frame = Frame{
+		Offset:  fr.pos,
+		Length:  5 + l + int64(cnt),
+		Type:    hdr[4],
+		Payload: payload,
+		CRC:     crc,
+		Valid:   h.Sum32() == crc,
+	}
+
+	if fr.frame.Type == extendedType && len(payload) > 0 {
+		fr.frame.Flags = payload[0]
+	}
+
+	if fr.frame.Valid && fr.frame.Type == statType && bytes.Equal(payload, sealPayload) {
+		fr.sealed = true
+	}
+
+	fr.pos += fr.frame.Length
+	fr.truncated = false
+
+	return true
+}
+
+// fits reports whether an entry with a value of cnt bytes after hdr
+// bytes of CRC, type and length lies within the file, to refuse a
+// damaged length larger than the file rather than trying to read it. The
+// size taken when the file was opened is used unless the entry runs past
+// it, and only then is the file stat'd again, in case it has grown since.
+func (fr *FrameReader) fits(hdr, cnt int64) bool {
+	if cnt <= fr.size-fr.pos-hdr {
+		return true
+	}
+
+	fi, err := fr.f.Stat()
+	if err != nil {
+		return false
+	}
+
+	fr.size = fi.Size()
+
+	return cnt <= fr.size-fr.pos-hdr
+}
+
+// stop ends a call to Next that read no entry because of err, which is
+// the end of the segment if nothing of an entry was read, and a
+// truncated entry if partial is set. The reader is moved back to the
+// start of the entry so it can be read again once it's complete.
+func (fr *FrameReader) stop(err error, partial bool) bool {
+	if err == io.EOF && partial {
+		err = io.ErrUnexpectedEOF
+	}
+
+	switch err {
+	case io.EOF:
+	case io.ErrUnexpectedEOF:
+		fr.truncated = true
+	default:
+		fr.err = err
+		return false
+	}
+
+	_, serr := fr.f.Seek(fr.pos, io.SeekStart)
+	if serr != nil {
+		fr.err = serr
+		return false
+	}
+
+	fr.r.Reset(fr.f)
+
+	return false
+}
+
+// Frame returns the current entry. Its Payload is only valid until Next
+// is called again.
+func (fr *FrameReader) Frame() Frame {
+	return fr.frame
+}
+
+// Truncated reports whether the last call to Next stopped because the
+// segment ends with an incomplete entry, see SegmentReader.Truncated.
+func (fr *FrameReader) Truncated() bool {
+	return fr.truncated
+}
+
+// Sealed reports whether the reader has passed the marker written by
+// WALWriter.Seal.
+func (fr *FrameReader) Sealed() bool {
+	return fr.sealed
+}
+
+func (fr *FrameReader) Error() error {
+	return fr.err
+}
+
+func (fr *FrameReader) Close() error {
+	return fr.f.Close()
+}
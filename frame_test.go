@@ -0,0 +1,173 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestFrameReader(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	frames := func(t *testing.T, seg string) ([]Frame, *FrameReader) {
+		fr, err := NewFrameReader(seg)
+		require.NoError(t, err)
+
+		var frames []Frame
+
+		for fr.Next() {
+			f := fr.Frame()
+			f.Payload = append([]byte{}, f.Payload...)
+			frames = append(frames, f)
+		}
+
+		require.NoError(t, fr.Error())
+
+		return frames, fr
+	}
+
+	types := func(frames []Frame) string {
+		var s []byte
+		for _, f := range frames {
+			s = append(s, f.Type)
+		}
+
+		return string(s)
+	}
+
+	n.It("walks every entry of a segment", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("tag"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("k"), []byte("keyed"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteCheckpoint([]byte("snap"), Position{})
+		require.NoError(t, err)
+
+		err = wal.Seal()
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		seg := wal.format.path(path, 0)
+
+		got, fr := frames(t, seg)
+		defer fr.Close()
+
+		assert.Equal(t, "hdtxcsfs", types(got))
+		assert.True(t, fr.Sealed())
+		assert.False(t, fr.Truncated())
+
+		var off int64
+
+		for _, f := range got {
+			assert.True(t, f.Valid)
+			assert.Equal(t, off, f.Offset)
+			assert.Equal(t, entrySize(len(f.Payload)), f.Length)
+
+			off += f.Length
+		}
+
+		assert.Equal(t, "data", string(got[1].Payload))
+		assert.Equal(t, extKey, got[3].Flags)
+
+		fi, err := os.Stat(seg)
+		require.NoError(t, err)
+
+		assert.Equal(t, fi.Size(), off)
+	})
+
+	n.It("reports damaged entries and a truncated tail", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		for _, data := range []string{"first", "second", "third"} {
+			err = wal.Write([]byte(data))
+			require.NoError(t, err)
+		}
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		seg := wal.format.path(path, 0)
+
+		got, fr := frames(t, seg)
+		fr.Close()
+
+		data, err := ioutil.ReadFile(seg)
+		require.NoError(t, err)
+
+		// Damage "second", and cut "third" short.
+		data[got[2].Offset+got[2].Length-1] ^= 0xff
+		data = data[:got[3].Offset+got[3].Length-1]
+
+		err = ioutil.WriteFile(seg, data, 0644)
+		require.NoError(t, err)
+
+		got, fr = frames(t, seg)
+		defer fr.Close()
+
+		require.Len(t, got, 3)
+		assert.True(t, got[1].Valid)
+		assert.False(t, got[2].Valid)
+		assert.True(t, fr.Truncated())
+		assert.False(t, fr.Sealed())
+	})
+
+	n.It("reads entries written after it was opened", func() {
+		seg, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		defer seg.Close()
+
+		_, err = seg.Write([]byte("first"))
+		require.NoError(t, err)
+
+		fr, err := NewFrameReader(path)
+		require.NoError(t, err)
+
+		defer fr.Close()
+
+		require.True(t, fr.Next())
+		assert.Equal(t, byte(headerType), fr.Frame().Type)
+
+		require.True(t, fr.Next())
+		assert.Equal(t, "first", string(fr.Frame().Payload))
+
+		assert.False(t, fr.Next())
+		assert.False(t, fr.Truncated())
+
+		_, err = seg.Write([]byte("second"))
+		require.NoError(t, err)
+
+		require.True(t, fr.Next())
+		assert.Equal(t, "second", string(fr.Frame().Payload))
+		require.NoError(t, fr.Error())
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,93 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// RecordFrame is the type of the frames that hold records. A Framer for a
+// format that only holds records, without tags or the other entries this
+// package writes, returns it for every frame it reads.
+const RecordFrame byte = dataType
+
+// Framer encodes and decodes the frames entries are stored in, so that
+// segments in another format can be read and written, such as the logs
+// of another system. Every frame has a type, which is opaque to the
+// framer beyond RecordFrame, and a value. Segments written with a framer
+// other than DefaultFramer have none of the header, footer or closing
+// marker segments otherwise have, only frames, and can only be read with
+// the same framer.
+type Framer interface {
+	// AppendFrame appends the frame holding value, an entry of type
+	// typ, to buf and returns the result.
+	AppendFrame(buf []byte, typ byte, value []byte) []byte
+
+	// ReadFrame reads the next frame from r, returning its type, its
+	// value and the number of bytes the whole frame took, which is
+	// used to find where each frame starts. The value may use buf if
+	// it's big enough. It returns io.EOF if no frame starts before the
+	// end of r, and io.ErrUnexpectedEOF if one starts but is cut short
+	// so it can be read again once the rest of it has been written.
+	ReadFrame(r *bufio.Reader, buf []byte) (typ byte, value []byte, size int64, err error)
+}
+
+// DefaultFramer is the framing used by segments unless told otherwise:
+// a 4 byte big endian CRC of the rest of the frame after the type, a
+// type byte, the length of the value as a uvarint and then the value.
+var DefaultFramer Framer = standardFramer{}
+
+type standardFramer struct{}
+
+func (standardFramer) AppendFrame(buf []byte, typ byte, value []byte) []byte {
+	return append(buf, encodeEntry(typ, value)...)
+}
+
+func (standardFramer) ReadFrame(r *bufio.Reader, buf []byte) (byte, []byte, int64, error) {
+	var hdr [5]byte
+
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	cnt, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return 0, nil, 0, err
+	}
+
+	if uint64(cap(buf)) < cnt {
+		buf = make([]byte, cnt)
+	}
+
+	value := buf[:cnt]
+
+	_, err = io.ReadFull(r, value)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return 0, nil, 0, err
+	}
+
+	cs := crc32.NewIEEE()
+
+	var lbuf [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(lbuf[:], cnt)
+
+	cs.Write(lbuf[:n])
+	cs.Write(value)
+
+	if cs.Sum32() != binary.BigEndian.Uint32(hdr[:4]) {
+		return 0, nil, 0, ErrCorruptCRC
+	}
+
+	return hdr[4], value, int64(5+n) + int64(cnt), nil
+}
@@ -0,0 +1,185 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestFramer(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+		os.Mkdir(path, 0755)
+	})
+
+	n.It("writes and reads segments in another framing", func() {
+		seg := filepath.Join(path, "0")
+
+		w, err := NewSegmentWriterWithFramer(seg, lengthFramer{})
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte("first"))
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte("second"))
+		require.NoError(t, err)
+
+		err = w.Close()
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(seg)
+		require.NoError(t, err)
+
+		assert.Equal(t, "\x00\x00\x00\x05first\x00\x00\x00\x06second", string(data))
+
+		r, err := NewSegmentReaderWithFramer(seg, lengthFramer{})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "first", string(r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "second", string(r.Value()))
+		assert.Equal(t, int64(len(data)), r.Pos())
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("reads a log of another system through a reader", func() {
+		for i := 0; i < 2; i++ {
+			var data []byte
+
+			for j := 0; j < 3; j++ {
+				data = lengthFramer{}.AppendFrame(data, RecordFrame, []byte(fmt.Sprintf("data%d%d", i, j)))
+			}
+
+			// A partly written last frame.
+			if i == 1 {
+				data = append(data, 0, 0, 0, 9, 'x')
+			}
+
+			err := ioutil.WriteFile(filepath.Join(path, fmt.Sprint(i)), data, 0644)
+			require.NoError(t, err)
+		}
+
+		r, err := NewReaderWithOptions(path, ReadOptions{Framer: lengthFramer{}})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for i := 0; i < 2; i++ {
+			for j := 0; j < 3; j++ {
+				require.True(t, r.Next())
+				assert.Equal(t, fmt.Sprintf("data%d%d", i, j), string(r.Value()))
+			}
+		}
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		err = r.Seek(Position{1, int64(4 + len("data10")), 0})
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data11", string(r.Value()))
+
+		err = r.SeekLast()
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data12", string(r.Value()))
+	})
+
+	n.It("reads segments written by this package with DefaultFramer", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data0"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data1"))
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		r, err := NewSegmentReaderWithFramer(filepath.Join(path, "0"), wrappedFramer{DefaultFramer})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data0", string(r.Value()))
+
+		err = r.SeekTag([]byte("commit"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data1", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.Meow()
+}
+
+// lengthFramer frames records as a 4 byte big endian length followed by
+// the record, with no types.
+type lengthFramer struct{}
+
+func (lengthFramer) AppendFrame(buf []byte, typ byte, value []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
+
+func (lengthFramer) ReadFrame(r *bufio.Reader, buf []byte) (byte, []byte, int64, error) {
+	var hdr [4]byte
+
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	value := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+
+	_, err = io.ReadFull(r, value)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return 0, nil, 0, err
+	}
+
+	return RecordFrame, value, int64(4 + len(value)), nil
+}
+
+// wrappedFramer hides that it's the framer it wraps.
+type wrappedFramer struct {
+	Framer
+}
@@ -1,6 +1,6 @@
 module github.com/tjxduck/wal
 
-go 1.12
+go 1.23
 
 require (
 	github.com/golang/snappy v0.0.1
@@ -8,3 +8,9 @@ require (
 	github.com/vektra/neko v0.0.0-20170502000624-99acbdf12420
 	gopkg.in/tomb.v2 v2.0.0-20161208151619-d5d1b5820637
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.0 // indirect
+)
@@ -0,0 +1,169 @@
+package wal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The handoff file is written by Release, recording where the released
+// writer left the log, and claimed by Acquire by renaming it to
+// handoffClaimedName, so only one process can take over from a release.
+const (
+	handoffFileName    = "handoff"
+	handoffClaimedName = "handoff.claimed"
+)
+
+var (
+	// ErrReleased is returned by a writer's writes once it has been
+	// released, see Release.
+	ErrReleased = errors.New("writer was released")
+
+	// ErrNoHandoff is returned by Acquire when no writer has released
+	// the WAL, or another process has already acquired it.
+	ErrNoHandoff = errors.New("wal was not released")
+
+	// ErrHandoffMismatch is returned by Acquire when the log no longer
+	// ends where the released writer left it, so something else has
+	// written to it since.
+	ErrHandoffMismatch = errors.New("wal changed since it was released")
+)
+
+type handoff struct {
+	Segment int   `json:"segment"`
+	Size    int64 `json:"size"`
+}
+
+// Release hands the WAL over to another writer, to be opened with
+// Acquire. The current segment is closed as Close would and synced, and
+// the handoff file recording where the log ends is written, after which
+// every write returns ErrReleased. The package has no lock keeping other
+// writers out, so the process taking over should only write with the
+// writer Acquire returns; Acquire refuses if the log was written to after
+// the release.
+func (wal *WALWriter) Release() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	defer wal.wake()
+
+	if wal.sealed {
+		return ErrSealed
+	}
+
+	err := wal.Err()
+	if err != nil {
+		return err
+	}
+
+	err = wal.segment.Close()
+	if err != nil {
+		return err
+	}
+
+	wal.fail(ErrReleased)
+	wal.released = true
+
+	f, err := openRead(wal.opts.OpenFile, wal.current)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	// Close doesn't sync the footer and closing marker.
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(handoff{Segment: wal.index, Size: fi.Size()})
+	if err != nil {
+		return err
+	}
+
+	return replaceFile(filepath.Join(wal.root, handoffFileName), data)
+}
+
+// Acquire opens a writer on the WAL at root, taking over from the writer
+// that released it with Release. ErrNoHandoff is returned if the WAL
+// hasn't been released since it was last acquired, and
+// ErrHandoffMismatch if the log doesn't end where the released writer
+// left it. Once acquired, the WAL must be released again before it's
+// acquired by anyone else.
+func Acquire(root string, opts WriteOptions) (*WALWriter, error) {
+	marker := filepath.Join(root, handoffFileName)
+	claimed := filepath.Join(root, handoffClaimedName)
+
+	err := os.Rename(marker, claimed)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoHandoff
+		}
+
+		return nil, err
+	}
+
+	wal, err := acquire(root, opts, claimed)
+	if err != nil {
+		// Let another attempt see the release.
+		os.Rename(claimed, marker)
+		return nil, err
+	}
+
+	err = os.Remove(claimed)
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	return wal, nil
+}
+
+// acquire checks the log matches the claimed handoff file before opening
+// a writer on it.
+func acquire(root string, opts WriteOptions, claimed string) (*WALWriter, error) {
+	data, err := ioutil.ReadFile(claimed)
+	if err != nil {
+		return nil, err
+	}
+
+	var h handoff
+
+	err = json.Unmarshal(data, &h)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := existingFormat(root, segmentFormat{})
+	if err != nil {
+		return nil, err
+	}
+
+	_, last, err := rangeSegments(root, format)
+	if err != nil {
+		return nil, err
+	}
+
+	if last != h.Segment {
+		return nil, ErrHandoffMismatch
+	}
+
+	fi, err := os.Stat(format.path(root, last))
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() != h.Size {
+		return nil, ErrHandoffMismatch
+	}
+
+	return NewWithOptions(root, opts)
+}
@@ -0,0 +1,92 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestHandoff(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	n.It("hands the WAL over to another writer", func() {
+		old, err := New(path)
+		require.NoError(t, err)
+
+		err = old.Write([]byte("from the old writer"))
+		require.NoError(t, err)
+
+		err = old.Release()
+		require.NoError(t, err)
+
+		err = old.Write([]byte("too late"))
+		assert.Equal(t, ErrReleased, err)
+
+		err = old.Close()
+		require.NoError(t, err)
+
+		wal, err := Acquire(path, DefaultWriteOptions)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("from the new writer"))
+		require.NoError(t, err)
+
+		_, err = Acquire(path, DefaultWriteOptions)
+		assert.Equal(t, ErrNoHandoff, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "from the old writer", string(r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "from the new writer", string(r.Value()))
+	})
+
+	n.It("refuses a WAL written to since it was released", func() {
+		old, err := New(path)
+		require.NoError(t, err)
+
+		err = old.Release()
+		require.NoError(t, err)
+
+		other, err := New(path)
+		require.NoError(t, err)
+
+		err = other.Write([]byte("split brain"))
+		require.NoError(t, err)
+
+		err = other.Close()
+		require.NoError(t, err)
+
+		_, err = Acquire(path, DefaultWriteOptions)
+		assert.Equal(t, ErrHandoffMismatch, err)
+
+		// The release is still there to be seen.
+		_, err = os.Stat(filepath.Join(path, handoffFileName))
+		assert.NoError(t, err)
+	})
+
+	n.Meow()
+}
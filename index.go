@@ -0,0 +1,148 @@
+package wal
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// IndexEntry is the location of a single record, as written by
+// ExportIndex.
+type IndexEntry struct {
+	Position
+
+	// The length of the record's value in bytes. For a record written
+	// with a key, this includes the key and its encoding.
+	Length int64
+}
+
+// maxIndexEntrySize is the most bytes used to encode an IndexEntry: the
+// segment, offset, epoch and length, each as a uvarint.
+const maxIndexEntrySize = 4 * binary.MaxVarintLen64
+
+// ExportIndex writes an IndexEntry for every record from the reader's
+// current position to the end of the log. Only the entry headers are
+// read, values are skipped over, so this is cheap even for large logs,
+// but an entry's CRC isn't checked. ExportCheckedIndex checks them.
+//
+// When ExportIndex returns, the reader is positioned after the last
+// record it exported, so calling it again later resumes the export with
+// any records written in the meantime.
+func (r *WALReader) ExportIndex(w io.Writer) error {
+	return r.exportIndex(w, false)
+}
+
+// ExportCheckedIndex is ExportIndex, but reads each value to check its
+// CRC, without keeping it, so an entry that fails the check stops the
+// export with ErrCorruptCRC rather than being exported. It reads the
+// whole log rather than only its headers.
+func (r *WALReader) ExportCheckedIndex(w io.Writer) error {
+	return r.exportIndex(w, true)
+}
+
+// exportIndex is ExportIndex, checking CRCs if check is set.
+func (r *WALReader) exportIndex(w io.Writer, check bool) error {
+	var buf [maxIndexEntrySize]byte
+
+	for {
+		if r.seg != nil {
+			start := r.seg.Pos()
+
+			next := r.seg.skipNext
+			if check {
+				next = r.seg.checkNext
+			}
+
+			ent, size, err := next()
+			if err == nil {
+				if ent.entryType != dataType && ent.entryType != extendedType {
+					continue
+				}
+
+				n := putIndexEntry(buf[:], IndexEntry{
+					Position: Position{Segment: r.index, Offset: start, Epoch: r.seg.epoch},
+					Length:   size,
+				})
+
+				_, err = w.Write(buf[:n])
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+
+		ok, err := r.openNext()
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return nil
+		}
+	}
+}
+
+// putIndexEntry encodes ent into buf, which must hold at least
+// maxIndexEntrySize bytes, and returns the number of bytes used.
+func putIndexEntry(buf []byte, ent IndexEntry) int {
+	n := binary.PutUvarint(buf, uint64(ent.Segment))
+	n += binary.PutUvarint(buf[n:], uint64(ent.Offset))
+	n += binary.PutUvarint(buf[n:], uint64(ent.Epoch))
+	n += binary.PutUvarint(buf[n:], uint64(ent.Length))
+
+	return n
+}
+
+// byteReader reads from r a byte at a time, so that decoding an entry
+// never consumes anything after it.
+type byteReader struct {
+	r io.Reader
+}
+
+func (br byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+
+	_, err := io.ReadFull(br.r, b[:])
+
+	return b[0], err
+}
+
+// ReadIndexEntry reads a single IndexEntry, as written by ExportIndex,
+// from r. It returns io.EOF when there are no more entries, and
+// io.ErrUnexpectedEOF if r ends part way through one. If r isn't an
+// io.ByteReader it's read a byte at a time, so wrap it in a bufio.Reader
+// to read many entries.
+func ReadIndexEntry(r io.Reader) (IndexEntry, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = byteReader{r}
+	}
+
+	var fields [4]uint64
+
+	for i := range fields {
+		v, err := binary.ReadUvarint(br)
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return IndexEntry{}, err
+		}
+
+		fields[i] = v
+	}
+
+	return IndexEntry{
+		Position: Position{
+			Segment: int(fields[0]),
+			Offset:  int64(fields[1]),
+			Epoch:   int64(fields[2]),
+		},
+		Length: int64(fields[3]),
+	}, nil
+}
@@ -0,0 +1,260 @@
+package wal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestIndex(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	n.It("exports the position and length of every record", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		values := []string{"first data", "second", "third data in the next segment"}
+
+		var positions []Position
+
+		for i, v := range values {
+			if i == 2 {
+				err = wal.rotateSegment()
+				require.NoError(t, err)
+			}
+
+			pos, err := wal.Pos()
+			require.NoError(t, err)
+
+			positions = append(positions, pos)
+
+			err = wal.Write([]byte(v))
+			require.NoError(t, err)
+
+			if i == 0 {
+				err = wal.WriteTag([]byte("commit"))
+				require.NoError(t, err)
+			}
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var buf bytes.Buffer
+
+		err = r.ExportIndex(&buf)
+		require.NoError(t, err)
+
+		for i, v := range values {
+			ent, err := ReadIndexEntry(&buf)
+			require.NoError(t, err)
+
+			assert.Equal(t, positions[i], ent.Position)
+			assert.Equal(t, int64(len(v)), ent.Length)
+
+			err = r.Seek(ent.Position)
+			require.NoError(t, err)
+
+			require.True(t, r.Next())
+			assert.Equal(t, v, string(r.Value()))
+		}
+
+		_, err = ReadIndexEntry(&buf)
+		assert.Equal(t, io.EOF, err)
+	})
+
+	n.It("resumes an export where it left off", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first data"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var buf bytes.Buffer
+
+		err = r.ExportIndex(&buf)
+		require.NoError(t, err)
+
+		ent, err := ReadIndexEntry(&buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(len("first data")), ent.Length)
+		assert.Equal(t, 0, buf.Len())
+
+		pos, err := wal.Pos()
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("more data"))
+		require.NoError(t, err)
+
+		buf.Reset()
+
+		err = r.ExportIndex(&buf)
+		require.NoError(t, err)
+
+		ent, err = ReadIndexEntry(&buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, pos, ent.Position)
+		assert.Equal(t, int64(len("more data")), ent.Length)
+
+		assert.Equal(t, 0, buf.Len())
+	})
+
+	n.It("exports positions that can be sought to once the log is truncated", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("old data"))
+		require.NoError(t, err)
+
+		err = wal.TruncateAll()
+		require.NoError(t, err)
+
+		pos, _, err := wal.Append([]byte("new data"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var buf bytes.Buffer
+
+		err = r.ExportIndex(&buf)
+		require.NoError(t, err)
+
+		ent, err := ReadIndexEntry(&buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, pos, ent.Position)
+
+		err = r.Seek(ent.Position)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "new data", string(r.Value()))
+	})
+
+	n.It("stops a checked export at a record whose CRC doesn't match", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("first data"))
+		require.NoError(t, err)
+
+		pos, err := wal.Pos()
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("second"))
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		seg := wal.format.path(path, 0)
+
+		data, err := ioutil.ReadFile(seg)
+		require.NoError(t, err)
+
+		// Damage the last byte of "second".
+		data[pos.Offset+entrySize(len("second"))-1] ^= 0xff
+
+		err = ioutil.WriteFile(seg, data, 0644)
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var buf bytes.Buffer
+
+		err = r.ExportCheckedIndex(&buf)
+		assert.Equal(t, ErrCorruptCRC, err)
+
+		ent, err := ReadIndexEntry(&buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(len("first data")), ent.Length)
+
+		_, err = ReadIndexEntry(&buf)
+		assert.Equal(t, io.EOF, err)
+
+		// Only reading the headers, the damage isn't noticed.
+		r2, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r2.Close()
+
+		err = r2.ExportIndex(&buf)
+		require.NoError(t, err)
+
+		for _, want := range []Position{{0, segmentHeaderSize, 0}, pos} {
+			ent, err := ReadIndexEntry(&buf)
+			require.NoError(t, err)
+
+			assert.Equal(t, want, ent.Position)
+		}
+	})
+
+	n.It("reads back entries with lengths of 4GiB or more", func() {
+		want := IndexEntry{
+			Position: Position{Segment: 70000, Offset: 5 << 30, Epoch: 3},
+			Length:   5<<30 + 1,
+		}
+
+		var buf [maxIndexEntrySize]byte
+
+		n := putIndexEntry(buf[:], want)
+
+		// Read without the buffer being an io.ByteReader.
+		r := io.MultiReader(bytes.NewReader(buf[:n]), bytes.NewReader(buf[:n]))
+
+		for i := 0; i < 2; i++ {
+			got, err := ReadIndexEntry(r)
+			require.NoError(t, err)
+
+			assert.Equal(t, want, got)
+		}
+
+		_, err := ReadIndexEntry(r)
+		assert.Equal(t, io.EOF, err)
+
+		_, err = ReadIndexEntry(bytes.NewReader(buf[:n-1]))
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	})
+
+	n.Meow()
+}
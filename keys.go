@@ -0,0 +1,296 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// The keys file holds a line of JSON for each keyed record written,
+// giving the position of the latest record for each key, with the key
+// base64 encoded as keys needn't be valid UTF-8. It's kept when
+// the writer is opened again, and rewritten with only the latest
+// position of each key once it has grown to twice the number of keys, so
+// it's bounded by the number of distinct keys rather than the number of
+// writes.
+const keysFileName = "keys"
+
+// keysCompactMin is the number of lines the keys file may reach before
+// it's considered for compaction.
+const keysCompactMin = 128
+
+type keyEntry struct {
+	Key      []byte   `json:"key"`
+	Position Position `json:"position"`
+}
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// WriteKeyed writes data as a record with key, returning its position.
+// Readers return keyed records from Next like any other, and SeekKey
+// finds the latest record for a key. The writer remembers the latest
+// position of every key it has written, so its memory use grows with the
+// number of distinct keys.
+func (wal *WALWriter) WriteKeyed(key, data []byte) (Position, error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
+
+	ext := extendedRecord{key: key}
+	if ext.key == nil {
+		ext.key = []byte{}
+	}
+
+	pos, err := wal.writeWith(data, ext, wal.makeRoom)
+	if err != nil {
+		return Position{}, err
+	}
+
+	return pos, wal.logKey(string(key), pos)
+}
+
+// logKey records pos as the latest position of key in the keys file.
+func (wal *WALWriter) logKey(key string, pos Position) error {
+	wal.keys[key] = pos
+	wal.keysLogged++
+
+	if wal.keysLogged >= keysCompactMin && wal.keysLogged >= 2*len(wal.keys) {
+		return wal.compactKeysFile()
+	}
+
+	return wal.keysEnc.Encode(keyEntry{[]byte(key), pos})
+}
+
+// openKeysFile loads the latest position of each key from the keys file
+// and opens it to append to, creating it if there isn't one.
+func (wal *WALWriter) openKeysFile() error {
+	path := filepath.Join(wal.root, keysFileName)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = wal.loadKeys(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	wal.keysFile = f
+	wal.keysEnc = json.NewEncoder(f)
+
+	return nil
+}
+
+// loadKeys reads the keys file f, leaving it ready for more lines to be
+// appended.
+func (wal *WALWriter) loadKeys(f *os.File) error {
+	// Later lines supersede earlier ones. A partly written last line
+	// is ignored.
+	sc := bufio.NewScanner(f)
+
+	for sc.Scan() {
+		var ent keyEntry
+
+		if json.Unmarshal(sc.Bytes(), &ent) != nil {
+			continue
+		}
+
+		wal.keys[string(ent.Key)] = ent.Position
+		wal.keysLogged++
+	}
+
+	err := sc.Err()
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+
+	_, err = f.ReadAt(last, fi.Size()-1)
+	if err != nil {
+		return err
+	}
+
+	// Lines appended after a partly written one mustn't run on from it.
+	if last[0] != '\n' {
+		_, err = f.Write([]byte{'\n'})
+	}
+
+	return err
+}
+
+// compactKeysFile rewrites the keys file with only the latest position
+// of each key, dropping keys whose segments have been pruned. The new
+// file is written beside it and renamed over it, so a crash leaves one
+// or the other.
+func (wal *WALWriter) compactKeysFile() error {
+	var (
+		buf    bytes.Buffer
+		logged int
+	)
+
+	enc := json.NewEncoder(&buf)
+
+	for key, pos := range wal.keys {
+		if pos.Segment < wal.first {
+			delete(wal.keys, key)
+			continue
+		}
+
+		err := enc.Encode(keyEntry{[]byte(key), pos})
+		if err != nil {
+			return err
+		}
+
+		logged++
+	}
+
+	path := filepath.Join(wal.root, keysFileName)
+
+	err := replaceFile(path, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	wal.keysFile.Close()
+
+	wal.keysFile = f
+	wal.keysEnc = json.NewEncoder(f)
+	wal.keysLogged = logged
+
+	return nil
+}
+
+// SeekKey positions the reader at the latest record written with key, so
+// that the next call to Next returns it. The position is taken from the
+// keys file kept by the writer when it's there and still correct,
+// otherwise the whole log is scanned. ErrKeyNotFound is returned if no
+// record has key, leaving the reader at the end of the log.
+func (r *WALReader) SeekKey(key []byte) error {
+	pos, ok, err := r.cachedKey(key)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		ok, err = r.seekCachedKey(pos, key)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			return nil
+		}
+	}
+
+	err = r.Reset()
+	if err != nil {
+		return err
+	}
+
+	var found *Position
+
+	for r.Next() {
+		if r.Key() != nil && bytes.Equal(r.Key(), key) {
+			start := r.start
+			found = &start
+		}
+	}
+
+	err = r.Error()
+	if err != nil {
+		return err
+	}
+
+	if found == nil {
+		return ErrKeyNotFound
+	}
+
+	return r.Seek(*found)
+}
+
+// cachedKey returns the position of key according to the keys file.
+func (r *WALReader) cachedKey(key []byte) (Position, bool, error) {
+	f, err := openFile(filepath.Join(r.root, keysFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Position{}, false, nil
+		}
+
+		return Position{}, false, err
+	}
+
+	defer f.Close()
+
+	var (
+		pos   Position
+		found bool
+	)
+
+	// Later lines supersede earlier ones. A partly written last line
+	// is ignored.
+	sc := bufio.NewScanner(f)
+
+	for sc.Scan() {
+		var ent keyEntry
+
+		if json.Unmarshal(sc.Bytes(), &ent) != nil {
+			continue
+		}
+
+		if bytes.Equal(ent.Key, key) {
+			pos = ent.Position
+			found = true
+		}
+	}
+
+	return pos, found, sc.Err()
+}
+
+// seekCachedKey checks that the record at pos has key, leaving the
+// reader positioned at it if so.
+func (r *WALReader) seekCachedKey(pos Position, key []byte) (bool, error) {
+	err := r.Seek(pos)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if !r.Next() || r.start.Segment != pos.Segment || r.start.Offset != pos.Offset {
+		return false, nil
+	}
+
+	if r.Key() == nil || !bytes.Equal(r.Key(), key) {
+		return false, nil
+	}
+
+	return true, r.Seek(pos)
+}
+
+// Key returns the key of the current record, or nil if it was written
+// without one.
+func (r *WALReader) Key() []byte {
+	if r.seg == nil {
+		return nil
+	}
+
+	return r.recordExt().key
+}
@@ -0,0 +1,307 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestKeys(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	n.It("returns keyed records from Next", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("plain"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("user-1"), []byte("keyed"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "plain", string(r.Value()))
+		assert.Nil(t, r.Key())
+
+		require.True(t, r.Next())
+		assert.Equal(t, "keyed", string(r.Value()))
+		assert.Equal(t, "user-1", string(r.Key()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("seeks to the latest record for a key", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		_, err = wal.WriteKeyed([]byte("a"), []byte("a1"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("b"), []byte("b1"))
+		require.NoError(t, err)
+
+		pos, err := wal.WriteKeyed([]byte("a"), []byte("a2"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("after"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekKey([]byte("a"))
+		require.NoError(t, err)
+
+		assert.Equal(t, pos, r.Pos())
+
+		require.True(t, r.Next())
+		assert.Equal(t, "a2", string(r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "after", string(r.Value()))
+
+		err = r.SeekKey([]byte("c"))
+		assert.Equal(t, ErrKeyNotFound, err)
+	})
+
+	n.It("splits keyed records like any other", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 64
+		opts.MaxSegments = 100
+		opts.SplitLargeRecords = true
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		a := bytes.Repeat([]byte("a"), 100)
+		b := bytes.Repeat([]byte("b"), 100)
+
+		posA, err := wal.WriteKeyed([]byte("a"), a)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("plain"))
+		require.NoError(t, err)
+
+		posB, err := wal.WriteKeyed([]byte("b"), b)
+		require.NoError(t, err)
+
+		require.True(t, wal.index >= 4, "records weren't split")
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, a, r.Value())
+		assert.Equal(t, "a", string(r.Key()))
+
+		require.True(t, r.Next())
+		assert.Nil(t, r.Key())
+
+		require.True(t, r.Next())
+		assert.Equal(t, b, r.Value())
+		assert.Equal(t, "b", string(r.Key()))
+
+		err = r.Reset()
+		require.NoError(t, err)
+
+		var got []Position
+
+		for value, pos := range r.FilterKey(func(key []byte) bool { return string(key) == "b" }) {
+			assert.Equal(t, b, value)
+			got = append(got, pos)
+		}
+
+		assert.Equal(t, []Position{posB}, got)
+
+		err = r.SeekKey([]byte("a"))
+		require.NoError(t, err)
+		assert.Equal(t, posA, r.Pos())
+
+		// Without the keys file the records are scanned for the key.
+		err = os.Remove(filepath.Join(path, keysFileName))
+		require.NoError(t, err)
+
+		err = r.SeekKey([]byte("b"))
+		require.NoError(t, err)
+		assert.Equal(t, posB, r.Pos())
+
+		require.True(t, r.Next())
+		assert.Equal(t, b, r.Value())
+	})
+
+	n.It("scans for keys written before the writer was opened", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("a"), []byte("a1"))
+		require.NoError(t, err)
+
+		require.NoError(t, wal.Close())
+
+		wal, err = New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekKey([]byte("a"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "a1", string(r.Value()))
+	})
+
+	n.It("keeps the keys file when the writer is opened again", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		pos, err := wal.WriteKeyed([]byte("a"), []byte("a1"))
+		require.NoError(t, err)
+
+		require.NoError(t, wal.Close())
+
+		// A line cut short by a crash.
+		f, err := os.OpenFile(filepath.Join(path, keysFileName), os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+
+		_, err = f.Write([]byte(`{"key":"b"`))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		wal, err = New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		assert.Equal(t, pos, wal.keys["a"])
+
+		pos, err = wal.WriteKeyed([]byte("c"), []byte("c1"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for key, want := range map[string]Position{"a": wal.keys["a"], "c": pos} {
+			got, ok, err := r.cachedKey([]byte(key))
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, want, got)
+		}
+	})
+
+	n.It("keeps binary keys intact in the keys file", func() {
+		key := []byte{0xff, 0x00, '"', 0x80}
+
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		pos, err := wal.WriteKeyed(key, []byte("data"))
+		require.NoError(t, err)
+
+		require.NoError(t, wal.Close())
+
+		wal, err = New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		assert.Equal(t, map[string]Position{string(key): pos}, wal.keys)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		got, ok, err := r.cachedKey(key)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, pos, got)
+	})
+
+	n.It("closes the keys file when the writer is closed", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("k"), []byte("data"))
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		_, err = wal.keysFile.Write([]byte("\n"))
+		assert.True(t, errors.Is(err, os.ErrClosed))
+	})
+
+	n.It("keeps the keys file bounded by the number of keys", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 10*keysCompactMin; i++ {
+			_, err = wal.WriteKeyed([]byte(fmt.Sprintf("key%d", i%10)), []byte("data"))
+			require.NoError(t, err)
+		}
+
+		assert.True(t, wal.keysLogged < keysCompactMin)
+
+		// Rewritten beside it and renamed into place.
+		_, err = os.Stat(filepath.Join(path, keysFileName+".tmp"))
+		assert.True(t, os.IsNotExist(err))
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekKey([]byte("key9"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "key9", string(r.Key()))
+		assert.False(t, r.Next())
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,634 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mergeFileName is the file a merged segment is built in before it's
+// renamed over the first of the segments merged. It contains no digits
+// so it's never mistaken for a segment.
+const mergeFileName = "merging"
+
+// mergeIntentFileName holds the segments being merged, as a mergeIntent,
+// from just before the merged segment is renamed into place until the
+// second segment is removed, so that a merge interrupted in between is
+// finished when a writer is next opened.
+const mergeIntentFileName = "merge-intent"
+
+type mergeIntent struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+// removeFile removes the segment left behind by a merge. It's a variable
+// so tests can interrupt a merge.
+var removeFile = os.Remove
+
+// replaceFileName is the file ReplaceSegment writes a replacement segment
+// to before renaming it into place.
+const replaceFileName = "replacing"
+
+// mergedPrefix starts the value of the statType entry written at the end
+// of a merged segment, which is followed by the index of the last
+// segment merged into it as 8 big endian bytes. It tells Gaps that the
+// segments missing after a merged segment weren't lost.
+var mergedPrefix = []byte("merged through segment ")
+
+var (
+	ErrNotAdjacent     = errors.New("segments to merge must be adjacent")
+	ErrActiveSegment   = errors.New("segment is being written to")
+	ErrUnclosedSegment = errors.New("segment was not closed properly")
+	ErrInvalidSegment  = errors.New("replacement is not a valid closed segment")
+	ErrEpochMismatch   = errors.New("replacement is from a different epoch")
+	ErrCorruptTags     = errors.New("tags file is damaged")
+)
+
+// MergeSegments merges segment b into segment a, which must come just
+// before it, leaving a single segment named a that holds the records of
+// both in order. Neither can be the segment being written to, and both
+// must have been closed properly. The records from b move to new
+// positions in a: tags and keys remembered by the writer are updated to
+// match, but positions held elsewhere, such as by readers, aren't.
+//
+// The merged segment is built in a separate file and renamed over a, so
+// a crash leaves either the original segments or the merged one. Segment
+// b is then removed, leaving a gap in the segment indexes which readers
+// skip and Gaps doesn't report. The merge is recorded in a file of its
+// own until b is gone: a crash just after the rename leaves b in place,
+// duplicating its records, until the next writer is opened and removes
+// it.
+func (wal *WALWriter) MergeSegments(a, b int) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if b != a+1 || a < wal.first {
+		return ErrNotAdjacent
+	}
+
+	if b >= wal.index {
+		return ErrActiveSegment
+	}
+
+	pathA := wal.format.path(wal.root, a)
+	pathB := wal.format.path(wal.root, b)
+
+	// Counted first, while the footers of both can still be read.
+	cntA, err := countRecords(wal.opts.OpenFile, pathA)
+	if err != nil {
+		return err
+	}
+
+	cntB, err := countRecords(wal.opts.OpenFile, pathB)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(wal.root, mergeFileName)
+
+	endA, startB, err := mergeFiles(wal.opts.OpenFile, tmp, pathA, pathB, b, cntA+cntB)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	intent, err := json.Marshal(mergeIntent{a, b})
+	if err != nil {
+		return err
+	}
+
+	intentPath := filepath.Join(wal.root, mergeIntentFileName)
+
+	err = replaceFile(intentPath, intent)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, pathA)
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(intentPath)
+		return err
+	}
+
+	err = removeFile(pathB)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(intentPath)
+	if err != nil {
+		return err
+	}
+
+	// The entries of b now follow those of a, without b's header.
+	moved := func(pos Position) Position {
+		return Position{a, pos.Offset - startB + endA, pos.Epoch}
+	}
+
+	retagged := false
+
+	for tag, pos := range wal.cache.Tags {
+		if pos.Segment == b {
+			wal.cache.Tags[tag] = moved(pos)
+			retagged = true
+		}
+	}
+
+	if retagged {
+		err = wal.flushTagsFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	rekeyed := false
+
+	for key, pos := range wal.keys {
+		if pos.Segment == b {
+			wal.keys[key] = moved(pos)
+			rekeyed = true
+		}
+	}
+
+	if rekeyed {
+		err = wal.compactKeysFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	if wal.lastPos.Segment == b {
+		wal.lastPos = moved(wal.lastPos)
+	}
+
+	wal.counts[a] = cntA + cntB
+	delete(wal.counts, b)
+
+	return nil
+}
+
+// finishMerge completes a merge of the WAL in root that was interrupted
+// after its merged segment was renamed into place, removing the second
+// segment merged if it's still there. A merge interrupted before then
+// left both segments as they were, and they're kept.
+func finishMerge(root string, format segmentFormat) error {
+	path := filepath.Join(root, mergeIntentFileName)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	var in mergeIntent
+
+	if json.Unmarshal(data, &in) == nil {
+		through, ok, err := mergedThrough(nil, format.path(root, in.A))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err == nil && ok && through >= in.B {
+			err = os.Remove(format.path(root, in.B))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return os.Remove(path)
+}
+
+// mergeFiles writes the entries of the segments at pathA and pathB to a
+// new segment at path, followed by the marker saying it holds segment
+// b, a footer and the closing marker. It returns where the entries of a
+// end, and where those of b started in b. Every file is opened with
+// open, see openRead.
+func mergeFiles(open OpenFileFunc, path, pathA, pathB string, b int, records int64) (int64, int64, error) {
+	endA, _, last, err := segmentBody(open, pathA, false)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	endB, startB, lastB, err := segmentBody(open, pathB, true)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if lastB >= 0 {
+		last = endA + lastB - startB
+	}
+
+	out, err := createFile(open, path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer out.Close()
+
+	err = copyRange(open, out, pathA, 0, endA)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = copyRange(open, out, pathB, startB, endB)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Anything already merged into b stays covered.
+	through, ok, err := mergedThrough(open, pathB)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !ok {
+		through = b
+	}
+
+	var idx [8]byte
+	binary.BigEndian.PutUint64(idx[:], uint64(through))
+
+	for _, ent := range [][]byte{
+		encodeEntry(statType, append(append([]byte{}, mergedPrefix...), idx[:]...)),
+		encodeFooter(records, last),
+		closingMagic,
+	} {
+		_, err = out.Write(ent)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	err = out.Sync()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return endA, startB, out.Close()
+}
+
+// segmentBody returns where the entries of the closed segment at path
+// end, before its footer and closing marker, and if skipHeader is set
+// where they start after its header, along with where the entry starting
+// its last record is, or -1 if no record starts in it.
+func segmentBody(open OpenFileFunc, path string, skipHeader bool) (int64, int64, int64, error) {
+	f, err := openRead(open, path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	tail, err := readTail(f, fi.Size())
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if !tail.clean {
+		return 0, 0, 0, ErrUnclosedSegment
+	}
+
+	var start int64
+
+	if skipHeader {
+		hdr, _, err := readHeader(f)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		start = hdr.size
+	}
+
+	last := tail.last
+	if !tail.hasLast {
+		last = scanLastRecord(f, tail.end)
+	}
+
+	return tail.end, start, last, nil
+}
+
+// copyRange appends the bytes of the file at path from start to end to w.
+func copyRange(open OpenFileFunc, w io.Writer, path string, start, end int64) error {
+	f, err := openRead(open, path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(w, io.NewSectionReader(f, start, end-start))
+	return err
+}
+
+// mergedThrough returns the index of the last segment merged into the
+// segment at path, or false if nothing was.
+func mergedThrough(open OpenFileFunc, path string) (int, bool, error) {
+	r, err := openSegmentReader(open, path, nil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer r.Close()
+
+	var (
+		through int
+		ok      bool
+	)
+
+	for {
+		ent, err := r.readNext()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return through, ok, nil
+			}
+
+			return 0, false, err
+		}
+
+		if ent.entryType == statType && len(ent.value) == len(mergedPrefix)+8 &&
+			bytes.HasPrefix(ent.value, mergedPrefix) {
+			through = int(binary.BigEndian.Uint64(ent.value[len(mergedPrefix):]))
+			ok = true
+		}
+	}
+}
+
+// ReplaceSegment replaces segment seg of the WAL in root with data, such
+// as a repaired copy of a damaged segment. data must be a whole segment
+// as this package writes it, closed properly, with every entry intact,
+// or ErrInvalidSegment is returned. It's written to a separate file and
+// renamed over the segment, and the directory is synced, so readers see
+// either the old segment or the new one, never a mix, and a crash leaves
+// one or the other. The last segment is refused with ErrActiveSegment,
+// as it's the one a writer would be writing to, and a replacement whose
+// header has a different epoch from the segment's is refused with
+// ErrEpochMismatch, as positions in the segment would no longer resolve.
+//
+// The package has no lock saying whether a writer has the WAL open, so
+// it's up to the caller to make sure nothing else changes or removes the
+// segment while it's replaced: a writer that rotates may prune it, and
+// MergeSegments, CompactByKey and TruncateAll rewrite or remove
+// segments, any of which would be undone or lost. The simplest way is to
+// close the writer first.
+//
+// Positions in the segment, such as those in the tags and keys files,
+// aren't updated, so if the replacement moves entries, seeks that use
+// them fall back to scanning.
+func ReplaceSegment(root string, seg int, data []byte) error {
+	format, err := existingFormat(root, segmentFormat{})
+	if err != nil {
+		return err
+	}
+
+	_, last, err := rangeSegments(root, format)
+	if err != nil {
+		return err
+	}
+
+	if seg >= last {
+		return ErrActiveSegment
+	}
+
+	path := format.path(root, seg)
+
+	// A header damaged past reading is one of the things a replacement
+	// may be repairing, so its epoch can't be checked.
+	old, err := fileHeader(path)
+	damaged := errors.Is(err, ErrCorruptHeader)
+
+	if err != nil && !damaged {
+		return err
+	}
+
+	tmp := filepath.Join(root, replaceFileName)
+
+	err = writeReplacement(nil, tmp, data)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	hdr, err := fileHeader(tmp)
+	if err == nil && !damaged && hdr.epoch != old.epoch {
+		err = ErrEpochMismatch
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(root)
+}
+
+// fileHeader returns the header of the segment at path.
+func fileHeader(path string) (segmentHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return segmentHeader{}, err
+	}
+
+	defer f.Close()
+
+	return checkVersion(f)
+}
+
+// syncDir syncs the directory at path, so that files renamed into it
+// stay renamed after a crash.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if err != nil {
+		d.Close()
+		return err
+	}
+
+	return d.Close()
+}
+
+// writeReplacement writes data to path, syncs it and checks that it's a
+// valid closed segment, opening it with open, see openRead.
+func writeReplacement(open OpenFileFunc, path string, data []byte) error {
+	f, err := createFile(open, path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	tail, err := readTail(f, int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	if !tail.clean {
+		return ErrInvalidSegment
+	}
+
+	r, err := openSegmentReader(open, path, nil)
+	if err != nil {
+		if errors.Is(err, ErrUnsupportedFormat) {
+			return ErrInvalidSegment
+		}
+
+		return err
+	}
+
+	defer r.Close()
+
+	// The closing marker reads as an entry too, so every byte must
+	// belong to an intact entry.
+	for {
+		_, err := r.readNext()
+		switch err {
+		case nil:
+			continue
+		case io.EOF:
+			return f.Close()
+		case io.ErrUnexpectedEOF, ErrCorruptCRC:
+			return ErrInvalidSegment
+		default:
+			return err
+		}
+	}
+}
+
+// ErrTagCollision is matched, using errors.Is, by the TagCollisionError
+// returned by MergeTags when both WALs have a tag with the same name.
+var ErrTagCollision = errors.New("tag exists in both WALs")
+
+type TagCollisionError struct {
+	// The tags found in both WALs, sorted.
+	Tags []string
+}
+
+func (e *TagCollisionError) Error() string {
+	return fmt.Sprintf("tags exist in both WALs: %s", strings.Join(e.Tags, ", "))
+}
+
+func (e *TagCollisionError) Is(target error) bool {
+	return target == ErrTagCollision
+}
+
+// MergeTags adds the tags in the tags file of the WAL at src to the tags
+// file of the WAL at dst, for when the segments of src have been moved
+// into dst with segOffset added to their numbers. The segment of each
+// tag's position is adjusted to match. If any tag is in both, nothing is
+// changed and a TagCollisionError naming them is returned. A tags file
+// that fails its checksum gives ErrCorruptTags rather than losing tags.
+// No writer should have dst open, as it keeps its own tags file.
+func MergeTags(dst, src string, segOffset int) error {
+	srcTags, err := readTagsFile(src)
+	if err != nil {
+		return err
+	}
+
+	dstTags, err := readTagsFile(dst)
+	if err != nil {
+		return err
+	}
+
+	var collisions []string
+
+	for tag, pos := range srcTags {
+		if _, ok := dstTags[tag]; ok {
+			collisions = append(collisions, tag)
+			continue
+		}
+
+		pos.Segment += segOffset
+		dstTags[tag] = pos
+	}
+
+	if len(collisions) > 0 {
+		sort.Strings(collisions)
+		return &TagCollisionError{Tags: collisions}
+	}
+
+	return writeTagsFile(dst, dstTags)
+}
+
+// readTagsFile returns the tags in the tags file of the WAL at root,
+// which has none if the file is missing or empty.
+func readTagsFile(root string) (map[string]Position, error) {
+	f, err := openFile(filepath.Join(root, "tags"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make(map[string]Position), nil
+		}
+
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var cache tagCache
+
+	err = json.NewDecoder(f).Decode(&cache)
+	if err == io.EOF {
+		return make(map[string]Position), nil
+	}
+
+	if err != nil || !cache.valid() {
+		return nil, ErrCorruptTags
+	}
+
+	if cache.Tags == nil {
+		cache.Tags = make(map[string]Position)
+	}
+
+	return cache.Tags, nil
+}
+
+// writeTagsFile replaces the tags file of the WAL at root with one
+// holding tags, renaming it into place so it's never seen partly written.
+func writeTagsFile(root string, tags map[string]Position) error {
+	crc, err := tagsCRC(tags)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&tagCache{Tags: tags, CRC: crc})
+	if err != nil {
+		return err
+	}
+
+	return replaceFile(filepath.Join(root, "tags"), append(data, '\n'))
+}
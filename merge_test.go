@@ -0,0 +1,380 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestMerge(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	opts := DefaultWriteOptions
+	opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+
+	n.It("merges two segments into the first", func() {
+		opts := opts
+		opts.SegmentSize = segmentHeaderSize + 3*entrySize(len("data0"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 3; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("k"), []byte("data3"))
+		require.NoError(t, err)
+
+		for i := 4; i < 6; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, 2, wal.index)
+
+		err = wal.MergeSegments(0, 1)
+		require.NoError(t, err)
+
+		_, err = os.Stat(wal.format.path(path, 1))
+		assert.True(t, os.IsNotExist(err))
+
+		cnt, err := countRecords(nil, wal.format.path(path, 0))
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(4), cnt)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for i := 0; i < 6; i++ {
+			require.True(t, r.Next())
+			assert.Equal(t, fmt.Sprintf("data%d", i), string(r.Value()))
+		}
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		gaps, err := r.Gaps()
+		require.NoError(t, err)
+
+		assert.Empty(t, gaps)
+
+		err = r.SeekTag([]byte("commit"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data3", string(r.Value()))
+
+		err = r.SeekKey([]byte("k"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data3", string(r.Value()))
+	})
+
+	n.It("finishes a merge interrupted before the second segment is removed", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		for i := 0; i < 6; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		crash := errors.New("crashed")
+
+		defer func(orig func(string) error) { removeFile = orig }(removeFile)
+
+		removeFile = func(string) error {
+			return crash
+		}
+
+		err = wal.MergeSegments(0, 1)
+		require.Equal(t, crash, err)
+
+		removeFile = os.Remove
+
+		_, err = os.Stat(wal.format.path(path, 1))
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		wal, err = NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		_, err = os.Stat(wal.format.path(path, 1))
+		assert.True(t, os.IsNotExist(err))
+
+		_, err = os.Stat(filepath.Join(path, mergeIntentFileName))
+		assert.True(t, os.IsNotExist(err))
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for i := 0; i < 6; i++ {
+			require.True(t, r.Next())
+			assert.Equal(t, fmt.Sprintf("data%d", i), string(r.Value()))
+		}
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("keeps both segments of a merge interrupted before the rename", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		for i := 0; i < 6; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		err = ioutil.WriteFile(filepath.Join(path, mergeIntentFileName), []byte(`{"a":0,"b":1}`), 0644)
+		require.NoError(t, err)
+
+		wal, err = NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		_, err = os.Stat(wal.format.path(path, 1))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for i := 0; i < 6; i++ {
+			require.True(t, r.Next())
+			assert.Equal(t, fmt.Sprintf("data%d", i), string(r.Value()))
+		}
+	})
+
+	n.It("refuses segments that aren't adjacent or are being written", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 6; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, ErrNotAdjacent, wal.MergeSegments(0, 2))
+		assert.Equal(t, ErrActiveSegment, wal.MergeSegments(1, 2))
+	})
+
+	n.It("still reports segments lost after a merged one as gaps", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 10; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, 4, wal.index)
+
+		err = wal.MergeSegments(1, 2)
+		require.NoError(t, err)
+
+		err = os.Remove(wal.format.path(path, 3))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		gaps, err := r.Gaps()
+		require.NoError(t, err)
+
+		assert.Equal(t, []int{3}, gaps)
+	})
+
+	n.It("replaces a segment with a valid closed segment", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 6; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		// A replacement for segment 1 made from segment 0.
+		repaired, err := ioutil.ReadFile(wal.format.path(path, 0))
+		require.NoError(t, err)
+
+		assert.Equal(t, ErrActiveSegment, ReplaceSegment(path, 2, repaired))
+
+		assert.Equal(t, ErrInvalidSegment, ReplaceSegment(path, 1, repaired[:len(repaired)-1]))
+
+		damaged := append([]byte{}, repaired...)
+		damaged[segmentHeaderSize+6] ^= 0xff
+
+		assert.Equal(t, ErrInvalidSegment, ReplaceSegment(path, 1, damaged))
+
+		_, err = os.Stat(filepath.Join(path, replaceFileName))
+		assert.True(t, os.IsNotExist(err))
+
+		err = ReplaceSegment(path, 1, repaired)
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var got []string
+
+		for r.Next() {
+			got = append(got, string(r.Value()))
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, []string{"data0", "data1", "data0", "data1", "data4", "data5"}, got)
+	})
+
+	n.It("replaces a segment only with one from the same epoch", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 2; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		err = wal.Rotate()
+		require.NoError(t, err)
+
+		previous, err := ioutil.ReadFile(wal.format.path(path, 0))
+		require.NoError(t, err)
+
+		err = wal.TruncateAll()
+		require.NoError(t, err)
+
+		for i := 0; i < 6; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		seg := wal.format.path(path, wal.first)
+
+		repaired, err := ioutil.ReadFile(seg)
+		require.NoError(t, err)
+
+		assert.Equal(t, ErrEpochMismatch, ReplaceSegment(path, wal.first, previous))
+
+		_, err = os.Stat(filepath.Join(path, replaceFileName))
+		assert.True(t, os.IsNotExist(err))
+
+		// Once the header is damaged there's no epoch to check.
+		damaged := append([]byte{}, repaired...)
+		damaged[4] ^= 0x10
+
+		err = ioutil.WriteFile(seg, damaged, 0644)
+		require.NoError(t, err)
+
+		err = ReplaceSegment(path, wal.first, repaired)
+		require.NoError(t, err)
+
+		got, err := ioutil.ReadFile(seg)
+		require.NoError(t, err)
+		assert.Equal(t, repaired, got)
+	})
+
+	n.It("merges the tags of another WAL", func() {
+		src := filepath.Join(dir, "src")
+		defer os.RemoveAll(src)
+
+		os.RemoveAll(src)
+
+		for _, root := range []string{path, src} {
+			wal, err := NewWithOptions(root, opts)
+			require.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+				require.NoError(t, err)
+			}
+
+			err = wal.WriteTag([]byte(filepath.Base(root)))
+			require.NoError(t, err)
+
+			err = wal.Close()
+			require.NoError(t, err)
+		}
+
+		srcTags, err := readTagsFile(src)
+		require.NoError(t, err)
+
+		err = MergeTags(path, src, 10)
+		require.NoError(t, err)
+
+		tags, err := readTagsFile(path)
+		require.NoError(t, err)
+
+		want := srcTags["src"]
+		want.Segment += 10
+
+		assert.Equal(t, want, tags["src"])
+		assert.Contains(t, tags, "wal")
+
+		err = MergeTags(path, src, 10)
+		require.True(t, errors.Is(err, ErrTagCollision))
+
+		var tce *TagCollisionError
+		require.True(t, errors.As(err, &tce))
+		assert.Equal(t, []string{"src"}, tce.Tags)
+
+		after, err := readTagsFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, tags, after)
+	})
+
+	n.Meow()
+}
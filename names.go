@@ -0,0 +1,179 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// segmentFormat describes how segment file names are derived from their
+// index: the index, zero padded to at least digits digits, between a
+// prefix and a suffix. The zero value is the original naming of segments
+// as bare numbers.
+type segmentFormat struct {
+	prefix string
+	suffix string
+	digits int
+}
+
+var ErrBadSegmentFormat = errors.New("segment prefix may not end with a digit, suffix may not contain digits, and neither may contain separators")
+
+func newSegmentFormat(opts WriteOptions) (segmentFormat, error) {
+	prefix, suffix := opts.SegmentPrefix, opts.SegmentSuffix
+
+	// The index is the digits at the end of the name, before the
+	// suffix, so they mustn't run on from the prefix.
+	if strings.ContainsAny(prefix+suffix, "/"+string(filepath.Separator)) ||
+		strings.ContainsAny(suffix, "0123456789") ||
+		(prefix != "" && isDigits(prefix[len(prefix)-1:])) {
+		return segmentFormat{}, ErrBadSegmentFormat
+	}
+
+	if opts.SegmentDigits < 0 {
+		return segmentFormat{}, ErrBadSegmentFormat
+	}
+
+	return segmentFormat{
+		prefix: opts.SegmentPrefix,
+		suffix: opts.SegmentSuffix,
+		digits: opts.SegmentDigits,
+	}, nil
+}
+
+func (f segmentFormat) name(i int) string {
+	return fmt.Sprintf("%s%0*d%s", f.prefix, f.digits, i, f.suffix)
+}
+
+func (f segmentFormat) path(root string, i int) string {
+	return filepath.Join(root, f.name(i))
+}
+
+// parse returns the index of the segment called name, or false if name
+// isn't a segment in this format.
+func (f segmentFormat) parse(name string) (int, bool) {
+	if !strings.HasPrefix(name, f.prefix) || !strings.HasSuffix(name, f.suffix) {
+		return 0, false
+	}
+
+	num := name[len(f.prefix) : len(name)-len(f.suffix)]
+	if !isDigits(num) {
+		return 0, false
+	}
+
+	i, err := strconv.Atoi(num)
+	if err != nil {
+		return 0, false
+	}
+
+	return i, true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splitSegmentName breaks name into a prefix, the index, which is the
+// last run of digits in name, and the non-digit suffix after it,
+// returning false if name has no digits.
+func splitSegmentName(name string) (prefix, num, suffix string, ok bool) {
+	end := strings.LastIndexAny(name, "0123456789") + 1
+	if end == 0 {
+		return "", "", "", false
+	}
+
+	start := end
+	for start > 0 && name[start-1] >= '0' && name[start-1] <= '9' {
+		start--
+	}
+
+	return name[:start], name[start:end], name[end:], true
+}
+
+// auxiliaryName reports whether name is one of the files kept beside
+// the segments that could be mistaken for one: a file being written to
+// be renamed into place, or a segment being rebuilt by a merge or a
+// compaction.
+func auxiliaryName(name string) bool {
+	switch name {
+	case mergeFileName, mergeIntentFileName, replaceFileName, compactFileName:
+		return true
+	}
+
+	return strings.HasSuffix(name, ".tmp")
+}
+
+// detectFormat works out which naming format the segments in names use.
+// The format matching the most names wins, with bare numbers preferred
+// on a tie. Files kept beside the segments are ignored. It returns false
+// if none of the names look like segments.
+func detectFormat(names []string) (segmentFormat, bool) {
+	type key struct{ prefix, suffix string }
+
+	var (
+		counts = make(map[key]int)
+		digits = make(map[key]int)
+	)
+
+	for _, name := range names {
+		if auxiliaryName(name) {
+			continue
+		}
+
+		prefix, num, suffix, ok := splitSegmentName(name)
+		if !ok {
+			continue
+		}
+
+		k := key{prefix, suffix}
+		counts[k]++
+
+		// Only a leading zero tells us the index was padded.
+		if len(num) > 1 && num[0] == '0' && len(num) > digits[k] {
+			digits[k] = len(num)
+		}
+	}
+
+	if len(counts) == 0 {
+		return segmentFormat{}, false
+	}
+
+	keys := make([]key, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+
+		if (a == key{}) || (b == key{}) {
+			return a == key{}
+		}
+
+		if a.prefix != b.prefix {
+			return a.prefix < b.prefix
+		}
+
+		return a.suffix < b.suffix
+	})
+
+	best := keys[0]
+
+	return segmentFormat{prefix: best.prefix, suffix: best.suffix, digits: digits[best]}, true
+}
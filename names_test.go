@@ -0,0 +1,183 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestNames(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	n.It("names and parses decorated segments", func() {
+		f := segmentFormat{prefix: "seg-", suffix: ".wal", digits: 7}
+
+		assert.Equal(t, "seg-0000012.wal", f.name(12))
+
+		i, ok := f.parse("seg-0000012.wal")
+		require.True(t, ok)
+		assert.Equal(t, 12, i)
+
+		_, ok = f.parse("12")
+		assert.False(t, ok)
+
+		_, ok = f.parse("seg-.wal")
+		assert.False(t, ok)
+
+		i, ok = segmentFormat{}.parse("12")
+		require.True(t, ok)
+		assert.Equal(t, 12, i)
+
+		_, ok = segmentFormat{}.parse("tags")
+		assert.False(t, ok)
+	})
+
+	n.It("detects the format segments are using", func() {
+		f, ok := detectFormat([]string{"tags", "seg-001.wal", "seg-002.wal", "other-1"})
+		require.True(t, ok)
+		assert.Equal(t, segmentFormat{prefix: "seg-", suffix: ".wal", digits: 3}, f)
+
+		f, ok = detectFormat([]string{"tags", "1", "seg-2.wal"})
+		require.True(t, ok)
+		assert.Equal(t, segmentFormat{}, f)
+
+		_, ok = detectFormat([]string{"tags"})
+		assert.False(t, ok)
+
+		f, ok = detectFormat([]string{"v2-seg-001.wal", "v2-seg-002.wal"})
+		require.True(t, ok)
+		assert.Equal(t, segmentFormat{prefix: "v2-seg-", suffix: ".wal", digits: 3}, f)
+	})
+
+	n.It("ignores files that aren't segments when detecting the format", func() {
+		names := []string{
+			"seg-001.wal", "seg-001.wal.tmp", "seg-002.wal.tmp", "durable.tmp",
+			compactFileName, mergeFileName, replaceFileName,
+		}
+
+		f, ok := detectFormat(names)
+		require.True(t, ok)
+		assert.Equal(t, segmentFormat{prefix: "seg-", suffix: ".wal", digits: 3}, f)
+
+		_, ok = detectFormat([]string{"1.tmp"})
+		assert.False(t, ok)
+	})
+
+	n.It("rejects a prefix ending with a digit", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentPrefix = "wal2"
+
+		_, err := NewWithOptions(path, opts)
+		assert.Equal(t, ErrBadSegmentFormat, err)
+
+		opts.SegmentPrefix = "wal2-"
+		opts.SegmentSuffix = ".v2"
+
+		_, err = NewWithOptions(path, opts)
+		assert.Equal(t, ErrBadSegmentFormat, err)
+	})
+
+	n.It("uses a prefix containing digits", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentPrefix = "wal2-"
+		opts.SegmentDigits = 3
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		require.NoError(t, wal.Close())
+
+		_, err = os.Stat(filepath.Join(path, "wal2-000"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data", string(r.Value()))
+	})
+
+	n.It("writes, rotates and prunes decorated segments", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 20
+		opts.MaxSegments = 2
+		opts.SegmentPrefix = "seg-"
+		opts.SegmentSuffix = ".wal"
+		opts.SegmentDigits = 7
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("first data"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("second data"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("third data"))
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(path, "seg-0000000.wal"))
+		assert.True(t, os.IsNotExist(err))
+
+		_, err = os.Stat(filepath.Join(path, "seg-0000002.wal"))
+		require.NoError(t, err)
+
+		// Reopening with the defaults keeps using the existing naming
+		wal, err = New(path)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, wal.index)
+
+		err = wal.Write([]byte("fourth data"))
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(path, "2"))
+		assert.True(t, os.IsNotExist(err))
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "second data", string(r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "third data", string(r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "fourth data", string(r.Value()))
+
+		assert.False(t, r.Next())
+	})
+
+	n.Meow()
+}
@@ -0,0 +1,90 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrInconsistent is wrapped by the errors returned when a check made by
+// the Paranoid option fails.
+var ErrInconsistent = errors.New("wal is inconsistent")
+
+// checkRecord checks that the record at pos reads back as data, which is
+// the record as given to the writer, before any Transform.
+func (wal *WALWriter) checkRecord(pos Position, data []byte) error {
+	got, err := wal.readAt(pos)
+	if err != nil {
+		return fmt.Errorf("%w: reading back record at %d:%d: %w",
+			ErrInconsistent, pos.Segment, pos.Offset, err)
+	}
+
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("%w: record at %d:%d read back as %d bytes, %d were written",
+			ErrInconsistent, pos.Segment, pos.Offset, len(got), len(data))
+	}
+
+	return wal.checkSize()
+}
+
+// checkEntry checks that the entry at pos, which isn't a record, reads
+// back with type typ and value.
+func (wal *WALWriter) checkEntry(pos Position, typ byte, value []byte) error {
+	ent, _, err := wal.readEntryAt(pos)
+	if err != nil {
+		return fmt.Errorf("%w: reading back entry at %d:%d: %w",
+			ErrInconsistent, pos.Segment, pos.Offset, err)
+	}
+
+	if ent.entryType != typ || !bytes.Equal(ent.value, value) {
+		return fmt.Errorf("%w: entry at %d:%d doesn't read back as written",
+			ErrInconsistent, pos.Segment, pos.Offset)
+	}
+
+	return wal.checkSize()
+}
+
+// checkSize checks that nothing has been written beyond the end of the
+// current segment as the writer knows it.
+func (wal *WALWriter) checkSize() error {
+	fi, err := wal.segment.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() != wal.segment.Size() {
+		return fmt.Errorf("%w: segment %d is %d bytes on disk, the writer has written %d",
+			ErrInconsistent, wal.index, fi.Size(), wal.segment.Size())
+	}
+
+	return nil
+}
+
+// checkSegments checks that the segments on disk run from the first
+// segment the writer keeps to the one it's writing to.
+func (wal *WALWriter) checkSegments() error {
+	first, last, err := rangeSegments(wal.root, wal.format)
+	if err != nil {
+		return err
+	}
+
+	if first != wal.first || last != wal.index {
+		return fmt.Errorf("%w: segments %d to %d are on disk, the writer has %d to %d",
+			ErrInconsistent, first, last, wal.first, wal.index)
+	}
+
+	_, err = os.Stat(wal.current)
+	if err != nil {
+		return fmt.Errorf("%w: current segment: %w", ErrInconsistent, err)
+	}
+
+	for i := range wal.counts {
+		if i < wal.first || i >= wal.index {
+			return fmt.Errorf("%w: records counted for segment %d, outside %d to %d",
+				ErrInconsistent, i, wal.first, wal.index-1)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestParanoid(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	opts := DefaultWriteOptions
+	opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+	opts.MaxSegments = 2
+	opts.Paranoid = true
+
+	n.It("passes its checks as records are written and pruned", func() {
+		opts := opts
+		opts.SplitLargeRecords = true
+		opts.Transform = versionStamp{}
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 10; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		_, _, err = wal.Append([]byte("a record that takes several segments"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("key"), []byte("a keyed record that takes several segments"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteSeq(1, []byte("a record with a sequence"))
+		require.NoError(t, err)
+
+		err = wal.WriteTTL([]byte("a record that expires"), time.Hour)
+		require.NoError(t, err)
+
+		_, err = wal.WriteCheckpoint([]byte("snapshot"), wal.LastPos())
+		require.NoError(t, err)
+	})
+
+	n.It("fails a record that doesn't read back as written", func() {
+		opts := opts
+		opts.Transform = lossyTransform{}
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("data0"))
+		assert.True(t, errors.Is(err, ErrInconsistent))
+
+		err = wal.WriteTTL([]byte("data1"), time.Hour)
+		assert.True(t, errors.Is(err, ErrInconsistent))
+
+		_, err = wal.WriteKeyed([]byte("key"), []byte("data2"))
+		assert.True(t, errors.Is(err, ErrInconsistent))
+
+		_, err = wal.WriteSeq(3, []byte("data3"))
+		assert.True(t, errors.Is(err, ErrInconsistent))
+	})
+
+	n.It("fails when segments go missing behind its back", func() {
+		opts := opts
+		opts.MaxSegments = 10
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 4; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		err = os.Remove(wal.format.path(path, 0))
+		require.NoError(t, err)
+
+		err = wal.Rotate()
+		assert.True(t, errors.Is(err, ErrInconsistent))
+	})
+
+	n.Meow()
+}
+
+// lossyTransform doesn't undo on read what it does on write.
+type lossyTransform struct{}
+
+func (lossyTransform) OnWrite(record []byte) []byte {
+	return append([]byte("v1:"), record...)
+}
+
+func (lossyTransform) OnRead(record []byte) []byte {
+	return record
+}
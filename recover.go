@@ -1,16 +1,26 @@
 package wal
 
 import (
+	"context"
+	"errors"
 	"io"
 )
 
+var ErrTagNotFound = errors.New("tag not found")
+
 func BeginRecovery(path string, tag []byte) (*WALReader, error) {
+	return BeginRecoveryContext(context.Background(), path, tag)
+}
+
+// BeginRecoveryContext is BeginRecovery, but gives up and returns
+// ctx.Err() if ctx is done while scanning the log for tag.
+func BeginRecoveryContext(ctx context.Context, path string, tag []byte) (*WALReader, error) {
 	r, err := NewReader(path)
 	if err != nil {
 		return nil, err
 	}
 
-	err = r.SeekTag(tag)
+	err = r.SeekTagContext(ctx, tag)
 	if err != nil {
 		if err != io.EOF {
 			r.Close()
@@ -26,3 +36,65 @@ func BeginRecovery(path string, tag []byte) (*WALReader, error) {
 
 	return r, nil
 }
+
+// OpenAtTag opens a new reader on the WAL at root, positioned just after
+// tag. Each call returns an independent reader, so consumers following
+// different tags don't share any state. If tag isn't in the WAL,
+// ErrTagNotFound is returned.
+func OpenAtTag(root string, tag []byte) (*WALReader, error) {
+	r, err := NewReader(root)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.SeekTag(tag)
+	if err != nil {
+		r.Close()
+
+		if err == io.EOF {
+			return nil, ErrTagNotFound
+		}
+
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// CallbackError wraps an error returned by the function given to Recover,
+// to tell it apart from an error reading the WAL.
+type CallbackError struct {
+	Err error
+}
+
+func (e *CallbackError) Error() string {
+	return "recovery callback: " + e.Err.Error()
+}
+
+func (e *CallbackError) Unwrap() error {
+	return e.Err
+}
+
+// Recover calls fn with each record in the WAL at path after tag, or
+// every record if tag isn't found, as BeginRecovery would return them,
+// and closes the reader once they're done. The slice passed to fn is
+// only valid until it returns. If fn returns an error, Recover stops and
+// returns it wrapped in a CallbackError; any other error is from reading
+// the WAL.
+func Recover(path string, tag []byte, fn func([]byte) error) error {
+	r, err := BeginRecovery(path, tag)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	for r.Next() {
+		err = fn(r.Value())
+		if err != nil {
+			return &CallbackError{err}
+		}
+	}
+
+	return r.Error()
+}
@@ -1,6 +1,8 @@
 package wal
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -25,7 +27,7 @@ func TestRecover(t *testing.T) {
 		os.RemoveAll(path)
 	})
 
-	n.Only("returns values after a tag", func() {
+	n.It("returns values after a tag", func() {
 		wal, err := New(path)
 		require.NoError(t, err)
 
@@ -96,5 +98,121 @@ func TestRecover(t *testing.T) {
 		assert.False(t, r.Next())
 	})
 
+	n.It("stops scanning for a tag when the context is done", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 10; i++ {
+			err = wal.Write([]byte("data"))
+			require.NoError(t, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err = BeginRecoveryContext(ctx, path, []byte("commit"))
+		assert.Equal(t, context.Canceled, err)
+
+		r, err := BeginRecoveryContext(context.Background(), path, []byte("commit"))
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data", string(r.Value()))
+	})
+
+	n.It("opens independent readers positioned after a tag", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first data"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("a"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("second data"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("b"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("third data"))
+		require.NoError(t, err)
+
+		ra, err := OpenAtTag(path, []byte("a"))
+		require.NoError(t, err)
+
+		defer ra.Close()
+
+		rb, err := OpenAtTag(path, []byte("b"))
+		require.NoError(t, err)
+
+		defer rb.Close()
+
+		require.True(t, rb.Next())
+		assert.Equal(t, "third data", string(rb.Value()))
+
+		require.True(t, ra.Next())
+		assert.Equal(t, "second data", string(ra.Value()))
+
+		_, err = OpenAtTag(path, []byte("missing"))
+		assert.Equal(t, ErrTagNotFound, err)
+	})
+
+	n.It("calls a function with each record after a tag", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for _, rec := range []string{"first data", "second data", "third data"} {
+			err = wal.Write([]byte(rec))
+			require.NoError(t, err)
+
+			if rec == "first data" {
+				err = wal.WriteTag([]byte("commit"))
+				require.NoError(t, err)
+			}
+		}
+
+		var got []string
+
+		err = Recover(path, []byte("commit"), func(rec []byte) error {
+			got = append(got, string(rec))
+			return nil
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"second data", "third data"}, got)
+
+		stop := errors.New("stop")
+
+		got = nil
+
+		err = Recover(path, []byte("commit"), func(rec []byte) error {
+			got = append(got, string(rec))
+			return stop
+		})
+
+		var cbErr *CallbackError
+
+		require.True(t, errors.As(err, &cbErr))
+		assert.Equal(t, stop, cbErr.Err)
+		assert.True(t, errors.Is(err, stop))
+		assert.Equal(t, []string{"second data"}, got)
+
+		err = Recover(filepath.Join(dir, "missing"), []byte("commit"), func([]byte) error {
+			return nil
+		})
+		require.Error(t, err)
+		assert.False(t, errors.As(err, &cbErr))
+	})
+
 	n.Meow()
 }
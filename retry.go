@@ -0,0 +1,91 @@
+package wal
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy says how writes and syncs of segments are retried after
+// an error that may be transient, such as on a networked filesystem.
+// The zero value doesn't retry.
+type RetryPolicy struct {
+	// The most times a write or sync is tried, including the first.
+	// 0 or 1 means it's never retried.
+	MaxAttempts int
+
+	// The wait before the first retry, doubled before each later one
+	// up to MaxBackoff, if that's set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// If set, decides which errors are retried in place of the
+	// default, which retries EINTR, EAGAIN and EIO. Errors that aren't
+	// retried, such as ENOSPC, are returned straight away.
+	Retryable func(err error) bool
+}
+
+// retryable reports whether err is worth retrying. A sync is never
+// retried after EIO, as the kernel may have dropped the pages that
+// failed to be written, letting a retried sync succeed without them.
+func (p *RetryPolicy) retryable(err error, sync bool) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+
+	if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+
+	return !sync && errors.Is(err, syscall.EIO)
+}
+
+// wait sleeps before retry number n, counting from 1.
+func (p *RetryPolicy) wait(n int) {
+	d := p.Backoff
+
+	for i := 1; i < n && d > 0; i++ {
+		d *= 2
+
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			d = p.MaxBackoff
+			break
+		}
+	}
+
+	time.Sleep(d)
+}
+
+// write writes all of b to the segment file, retrying what's left of it
+// after a retryable error.
+func (s *SegmentWriter) write(b []byte) error {
+	for attempt := 1; ; attempt++ {
+		n, err := writeFile(s.f, b)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= s.retry.MaxAttempts || !s.retry.retryable(err, false) {
+			return err
+		}
+
+		b = b[n:]
+		s.retry.wait(attempt)
+	}
+}
+
+// syncFile syncs the segment file, retrying after a retryable error.
+func (s *SegmentWriter) syncFile() error {
+	for attempt := 1; ; attempt++ {
+		err := s.f.Sync()
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= s.retry.MaxAttempts || !s.retry.retryable(err, true) {
+			return err
+		}
+
+		s.retry.wait(attempt)
+	}
+}
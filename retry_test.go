@@ -0,0 +1,126 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	opts := DefaultWriteOptions
+	opts.RetryPolicy = RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+
+	// failWrites makes the next count writes of record fail with err,
+	// after writing part of it, returning how many writes were tried.
+	failWrites := func(record string, count int, err error) *int {
+		var tries int
+
+		writeFile = func(f SegmentFile, b []byte) (int, error) {
+			if len(b) > 0 && strings.HasSuffix(record, string(b)) {
+				tries++
+
+				if tries <= count {
+					n, _ := f.Write(b[:2])
+					return n, err
+				}
+			}
+
+			return f.Write(b)
+		}
+
+		return &tries
+	}
+
+	n.It("retries writes after transient errors", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		tries := failWrites("second", 2, syscall.EAGAIN)
+		defer func() { writeFile = SegmentFile.Write }()
+
+		for _, data := range []string{"first", "second", "third"} {
+			err = wal.Write([]byte(data))
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 3, *tries)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for _, data := range []string{"first", "second", "third"} {
+			require.True(t, r.Next())
+			assert.Equal(t, data, string(r.Value()))
+		}
+	})
+
+	n.It("gives up once the attempts are used up", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		tries := failWrites("second", 3, syscall.EIO)
+		defer func() { writeFile = SegmentFile.Write }()
+
+		err = wal.Write([]byte("second"))
+		assert.True(t, errors.Is(err, syscall.EIO))
+
+		assert.Equal(t, 3, *tries)
+	})
+
+	n.It("returns errors that aren't transient straight away", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		tries := failWrites("second", 1, syscall.ENOSPC)
+		defer func() { writeFile = SegmentFile.Write }()
+
+		err = wal.Write([]byte("second"))
+		assert.True(t, errors.Is(err, ErrNoSpace))
+
+		assert.Equal(t, 1, *tries)
+	})
+
+	n.It("doubles the backoff up to the maximum", func() {
+		p := RetryPolicy{Backoff: time.Millisecond, MaxBackoff: 3 * time.Millisecond}
+
+		for i, want := range []time.Duration{1, 2, 3, 3} {
+			start := time.Now()
+			p.wait(i + 1)
+
+			assert.True(t, time.Since(start) >= want*time.Millisecond, fmt.Sprintf("retry %d", i+1))
+		}
+	})
+
+	n.Meow()
+}
@@ -3,12 +3,18 @@ package wal
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash"
 	"hash/crc32"
 	"io"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	tomb "gopkg.in/tomb.v2"
@@ -18,392 +24,2245 @@ import (
 )
 
 type SegmentWriter struct {
-	f     *os.File
+	f     SegmentFile
 	buf   []byte
 	sbuf  []byte
 	clean bool
 
-	size *int64
-
-	cs hash.Hash32
+	// Set until the first entry is written to a new segment.
+	empty   bool
+	created time.Time
 
-	t        tomb.Tomb
-	syncRate time.Duration
-	bgSync   bool
-}
+	// The epoch of the WAL when the segment was created, from its
+	// header.
+	epoch int64
 
-const bufferSize = 16 * 1024
+	size *int64
 
-func createSegment(f *os.File) (*SegmentWriter, error) {
-	buf := make([]byte, bufferSize)
-	sbuf := make([]byte, 32)
+	// The number of records in the segment. When an existing segment
+	// is reopened, the records already in it are only counted if the
+	// WAL sets this.
+	records int64
 
-	seg := &SegmentWriter{
-		f:    f,
-		buf:  buf,
-		sbuf: sbuf,
-		cs:   crc32.NewIEEE(),
-		size: new(int64),
-	}
+	// The offset of the entry starting the last record, or -1 if no
+	// record starts in the segment, kept for the footer.
+	lastStart int64
 
-	err := seg.calculateClean()
-	if err != nil {
-		return nil, err
-	}
+	cs hash.Hash32
 
-	*seg.size = seg.diskPos()
+	t      tomb.Tomb
+	bgSync bool
 
-	return seg, nil
-}
+	// Set once the background syncer has started, which then runs
+	// until the segment is closed. Changes of rate are sent to it.
+	syncing bool
+	rates   chan time.Duration
 
-func NewSegmentWriter(path string) (*SegmentWriter, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return nil, err
-	}
+	stats *syncStats
 
-	return createSegment(f)
-}
+	// Called with any error writing or syncing the file, including
+	// from the background syncer, which has no caller to return it to.
+	onError func(error)
 
-func (s *SegmentWriter) SetSyncRate(dur time.Duration) {
-	s.bgSync = true
-	s.syncRate = dur
-	s.t.Go(s.syncEvery)
-}
+	// Called after each sync that made anything durable, with the
+	// offset of the last record it made durable, or -1 if it made no
+	// new records durable, and the offset durable entries now end at.
+	onDurable func(last, end int64)
 
-func (s *SegmentWriter) syncEvery() error {
-	tick := time.NewTicker(s.syncRate)
-	defer tick.Stop()
+	// The offset of the last record written, accessed atomically, and
+	// of the last record and end reported to onDurable, guarded by
+	// syncLock.
+	lastRecord int64
+	durable    int64
+	durableEnd int64
+	syncLock   sync.Mutex
 
-	before := atomic.LoadInt64(s.size)
+	// Set if the segment is written with a framer other than the
+	// default.
+	framer Framer
 
-	for {
-		select {
-		case <-tick.C:
-			cur := atomic.LoadInt64(s.size)
+	// How failed writes and syncs are retried.
+	retry RetryPolicy
+}
 
-			if cur != before {
-				s.f.Sync()
-			}
+// syncStats counts the syncs made by segment writers. A WAL shares one
+// between all of its segments. Every field is accessed atomically so it
+// can be read without any lock.
+type syncStats struct {
+	syncRate  int64
+	writes    int64
+	pending   int64
+	syncs     int64
+	synced    int64
+	syncNanos int64
+	lastNanos int64
+}
 
-			before = cur
-		case <-s.t.Dying():
-			s.f.Sync()
-			return nil
-		}
-	}
+const bufferSize = 16 * 1024
 
-	return nil
-}
+// createSegment returns a writer for the segment open as f, writing a
+// header with epoch if it's empty. A segment that already has a header
+// keeps the epoch in it. The writer counts its syncs in stats, including
+// the write of the header, or in counters of its own if stats is nil.
+func createSegment(f SegmentFile, epoch int64, stats *syncStats) (*SegmentWriter, error) {
+	seg := newSegmentWriter(f)
 
-func (s *SegmentWriter) Close() error {
-	if s.bgSync {
-		s.t.Kill(nil)
-		s.t.Wait()
+	if stats != nil {
+		seg.stats = stats
 	}
 
-	_, err := s.f.Write(closingMagic)
+	// Appending to a segment in a format we don't know would leave it
+	// unreadable by anything.
+	hdr, err := checkVersion(f)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return s.f.Close()
-}
-
-func (s *SegmentWriter) Size() int64 {
-	return atomic.LoadInt64(s.size)
-}
+	seg.epoch = hdr.epoch
 
-func (s *SegmentWriter) calculateClean() error {
-	fi, err := s.f.Stat()
+	err = seg.calculateClean()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if fi.Size() == 0 {
-		return nil
-	}
+	*seg.size = seg.diskPos()
 
-	offset := int64(-len(closingMagic))
-	_, err = s.f.Seek(offset, os.SEEK_END)
-	if err != nil {
-		s.f.Seek(0, os.SEEK_SET)
-		return nil
-	}
+	if *seg.size == 0 {
+		seg.epoch = epoch
 
-	_, err = io.ReadFull(s.f, s.buf[:len(closingMagic)])
-	if err != nil {
-		// Leave it at the end because it's a short file without
-		// the magic so we want to keep writing here.
-		return nil
+		err = seg.writeHeader()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	s.clean = bytes.Equal(s.buf[:len(closingMagic)], closingMagic)
+	return seg, nil
+}
 
-	if s.clean {
-		// Ok, we're clean. Seek to just before the magic so we overwrite it
-		_, err := s.f.Seek(offset, os.SEEK_END)
-		return err
-	} else {
-		// Leave seeked to the end so we continue writing
+func newSegmentWriter(f SegmentFile) *SegmentWriter {
+	return &SegmentWriter{
+		f:     f,
+		buf:   make([]byte, bufferSize),
+		sbuf:  make([]byte, 32),
+		cs:    crc32.NewIEEE(),
+		size:  new(int64),
+		stats: new(syncStats),
+		rates: make(chan time.Duration),
+
+		lastRecord: -1,
+		lastStart:  -1,
+		durable:    -1,
 	}
+}
 
-	return nil
+// segmentHeader is stored in a headerType entry at the very start of
+// every segment. Segments written before headers existed have none.
+type segmentHeader struct {
+	version byte
+	created time.Time
+
+	// The epoch of the WAL when the segment was created, 0 before
+	// version 2.
+	epoch int64
+
+	// The number of bytes used by the header entry.
+	size int64
 }
 
 const (
-	statType = 's'
-	dataType = 'd'
-	tagType  = 't'
+	headerVersion = 2
+
+	// A version byte and the creation time in nanoseconds
+	headerLenV1 = 1 + 8
+
+	// Followed by the epoch since version 2
+	headerLen = headerLenV1 + 8
 )
 
-var closingMagic = []byte("\xE3\x14\x04\xC5s\x20this segment was closed properly")
+// segmentHeaderSize is the number of bytes used by the header entry of
+// segments written by this package. Older segments may have a shorter
+// header, see segmentHeader.size.
+var segmentHeaderSize = entrySize(headerLen)
 
-func (s *SegmentWriter) writeType(t byte, data []byte) (int, error) {
-	//out := snappy.Encode(s.buf, data)
+func (s *SegmentWriter) writeHeader() error {
+	s.created = time.Now()
 
-	n := binary.PutUvarint(s.sbuf[5:], uint64(len(data)))
+	var hdr [headerLen]byte
 
-	s.cs.Reset()
-	s.cs.Write(s.sbuf[5 : 5+n])
-	s.cs.Write(data)
+	hdr[0] = headerVersion
+	binary.BigEndian.PutUint64(hdr[1:], uint64(s.created.UnixNano()))
+	binary.BigEndian.PutUint64(hdr[headerLenV1:], uint64(s.epoch))
 
-	binary.BigEndian.PutUint32(s.sbuf[:4], s.cs.Sum32())
+	// The header isn't synced by itself, the first entry written
+	// after it is synced along with it.
+	bg := s.bgSync
+	s.bgSync = true
 
-	s.sbuf[4] = t
+	_, err := s.writeType(headerType, hdr[:])
 
-	_, err := s.f.Write(s.sbuf[:5+n])
-	if err != nil {
-		return 0, err
-	}
+	s.bgSync = bg
 
-	_, err = s.f.Write(data)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	if !s.bgSync {
-		err = s.f.Sync()
-		if err != nil {
-			return 0, err
-		}
-	}
+	s.empty = true
 
-	entry := int64(5 + n + len(data))
+	return nil
+}
 
-	atomic.AddInt64(s.size, entry)
+// ErrUnsupportedFormat is matched, using errors.Is, by the
+// UnsupportedFormatError returned when opening a segment written in a
+// newer format than this package understands.
+var ErrUnsupportedFormat = errors.New("unsupported segment format")
 
-	return len(data), nil
+type UnsupportedFormatError struct {
+	Version byte
 }
 
-func (s *SegmentWriter) Write(data []byte) (int, error) {
-	return s.writeType(dataType, data)
+func (e *UnsupportedFormatError) Error() string {
+	return fmt.Sprintf("unsupported segment format version %d", e.Version)
 }
 
-func (s *SegmentWriter) WriteTag(tag []byte) error {
-	_, err := s.writeType(tagType, tag)
-	return err
+func (e *UnsupportedFormatError) Is(target error) bool {
+	return target == ErrUnsupportedFormat
 }
 
-func (s *SegmentWriter) diskPos() int64 {
-	pos, err := s.f.Seek(0, os.SEEK_CUR)
-	if err != nil {
-		panic(err)
-	}
+// ErrCorruptHeader is matched, using errors.Is, by the
+// CorruptHeaderError returned when opening a segment whose header is
+// damaged, rather than reading the rest of it as if it had none.
+var ErrCorruptHeader = errors.New("segment header is corrupt")
 
-	return pos
+type CorruptHeaderError struct {
+	// The index of the segment, or -1 if its name isn't a segment's.
+	Segment int
+	Path    string
 }
 
-func (s *SegmentWriter) Pos() int64 {
-	return atomic.LoadInt64(s.size)
+func (e *CorruptHeaderError) Error() string {
+	return fmt.Sprintf("header of segment %d is corrupt: %s", e.Segment, e.Path)
 }
 
-func (s *SegmentWriter) Truncate(pos int64) error {
-	return s.f.Truncate(pos)
+func (e *CorruptHeaderError) Is(target error) bool {
+	return target == ErrCorruptHeader
 }
 
-func (s *SegmentWriter) Clean() bool {
-	return s.clean
-}
+// headerError returns err, as a CorruptHeaderError naming the segment at
+// path if it's ErrCorruptHeader.
+func headerError(path string, err error) error {
+	if err != ErrCorruptHeader {
+		return err
+	}
 
-type readByte interface {
-	ReadByte() (byte, error)
-	Read([]byte) (int, error)
-}
+	seg := -1
 
-type hashReader struct {
-	h hash.Hash32
-	r readByte
+	_, num, _, ok := splitSegmentName(filepath.Base(path))
+	if ok {
+		if i, err := strconv.Atoi(num); err == nil {
+			seg = i
+		}
+	}
 
-	counter int64
+	return &CorruptHeaderError{Segment: seg, Path: path}
 }
 
-func (hr *hashReader) ReadByte() (byte, error) {
-	b, err := hr.r.ReadByte()
+// checkVersion returns the header of the segment open as f, whose
+// version is 0 for segments written before headers existed, or an error
+// if it's a version this package can't read. A segment that starts with
+// neither a header nor an entry of a type written before headers
+// existed has a damaged header, and gives ErrCorruptHeader. As the
+// checksum doesn't cover an entry's type, so does one that starts with
+// an entry of another type holding exactly a header, which is taken to
+// be a header whose type was damaged.
+func checkVersion(f io.ReaderAt) (segmentHeader, error) {
+	hdr, ok, err := readHeader(f)
 	if err != nil {
-		return b, err
+		return segmentHeader{}, err
 	}
 
-	hr.counter++
+	if !ok {
+		buf := make([]byte, segmentHeaderSize)
 
-	hr.h.Write([]byte{b})
+		n, err := f.ReadAt(buf, 0)
+		if err != nil && err != io.EOF {
+			return segmentHeader{}, err
+		}
 
-	return b, nil
-}
+		if n >= 5 && !legacyType(buf[4]) {
+			return segmentHeader{}, ErrCorruptHeader
+		}
 
-func (hr *hashReader) Read(b []byte) (int, error) {
-	n, err := hr.r.Read(b)
-	if err != nil {
-		return n, err
+		h, err := parseHeader(buf[:n])
+		if err == nil && (h.version == 1 && h.size == entrySize(headerLenV1) ||
+			h.version >= 2 && h.size == entrySize(headerLen)) {
+			return segmentHeader{}, ErrCorruptHeader
+		}
 	}
 
-	hr.counter += int64(n)
-
-	hr.h.Write(b[:n])
+	if hdr.version > headerVersion {
+		return segmentHeader{}, &UnsupportedFormatError{Version: hdr.version}
+	}
 
-	return n, nil
+	return hdr, nil
 }
 
-type SegmentReader struct {
-	f    *os.File
-	r    *bufio.Reader
-	buf  []byte
-	buf2 []byte
+func decodeHeader(value []byte) (segmentHeader, error) {
+	if len(value) < headerLenV1 {
+		return segmentHeader{}, ErrCorruptHeader
+	}
+
+	hdr := segmentHeader{
+		version: value[0],
+		created: time.Unix(0, int64(binary.BigEndian.Uint64(value[1:9]))),
+	}
+
+	if hdr.version >= 2 {
+		if len(value) < headerLen {
+			return segmentHeader{}, ErrCorruptHeader
+		}
 
-	value    []byte
-	valueCRC uint32
+		hdr.epoch = int64(binary.BigEndian.Uint64(value[headerLenV1:headerLen]))
+	}
 
-	pos int64
-	err error
-	cs  hash.Hash32
-	hr  hashReader
+	return hdr, nil
 }
 
-func NewSegmentReader(path string) (*SegmentReader, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// readHeader returns the header of the segment open as f, and false if
+// the segment predates headers.
+func readHeader(f io.ReaderAt) (segmentHeader, bool, error) {
+	buf := make([]byte, segmentHeaderSize)
+
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return segmentHeader{}, false, err
 	}
 
-	r := bufio.NewReader(f)
-	buf := make([]byte, bufferSize)
-	buf2 := make([]byte, bufferSize)
-	sr := &SegmentReader{
-		f:    f,
-		r:    r,
-		buf:  buf,
-		buf2: buf2,
-		cs:   crc32.NewIEEE(),
+	if n < 6 || buf[4] != headerType {
+		return segmentHeader{}, false, nil
 	}
 
-	sr.hr.h = sr.cs
-	sr.hr.r = r
+	hdr, err := parseHeader(buf[:n])
+	if err != nil {
+		return segmentHeader{}, false, err
+	}
 
-	return sr, nil
+	return hdr, true, nil
 }
 
-func (r *SegmentReader) Close() error {
-	return r.f.Close()
-}
+// parseHeader returns the header held by the entry at the start of buf,
+// whatever its type, or ErrCorruptHeader if it doesn't hold one.
+func parseHeader(buf []byte) (segmentHeader, error) {
+	if len(buf) < 6 {
+		return segmentHeader{}, ErrCorruptHeader
+	}
 
-func (r *SegmentReader) Seek(pos int64) error {
-	_, err := r.f.Seek(pos, os.SEEK_SET)
-	if err != nil {
-		return err
+	cnt, l := binary.Uvarint(buf[5:])
+	if l <= 0 || cnt > uint64(len(buf)-5-l) {
+		return segmentHeader{}, ErrCorruptHeader
 	}
 
-	r.pos = pos
+	if crc32.ChecksumIEEE(buf[5:5+l+int(cnt)]) != binary.BigEndian.Uint32(buf[:4]) {
+		return segmentHeader{}, ErrCorruptHeader
+	}
 
-	r.r.Reset(r.f)
+	hdr, err := decodeHeader(buf[5+l : 5+l+int(cnt)])
+	if err != nil {
+		return segmentHeader{}, err
+	}
 
-	return nil
-}
+	hdr.size = int64(5 + l + int(cnt))
 
-func (s *SegmentReader) Pos() int64 {
-	return s.pos
+	return hdr, nil
 }
 
-func (r *SegmentReader) SeekTag(tag []byte) error {
-	for r.next(tagType) {
-		if bytes.Equal(r.Value(), tag) {
-			return nil
-		}
+// readEntryAt reads the entry starting at off in f, which holds size
+// bytes, returning it along with the number of bytes it takes up.
+// ErrNotRecordPosition is returned if there's no complete entry at off.
+func readEntryAt(f io.ReaderAt, off, size int64) (segmentEntry, int64, error) {
+	var (
+		e   segmentEntry
+		hdr [5 + binary.MaxVarintLen64]byte
+	)
+
+	n, err := f.ReadAt(hdr[:], off)
+	if err != nil && err != io.EOF {
+		return e, 0, err
 	}
-	return io.EOF
-}
 
-var ErrCorruptCRC = errors.New("corrupt data detected")
+	if n < 6 {
+		return e, 0, ErrNotRecordPosition
+	}
 
-type segmentEntry struct {
-	entryType byte
-	value     []byte
-	crc       uint32
-}
+	cnt, l := binary.Uvarint(hdr[5:n])
+	if l <= 0 || off+5+int64(l) > size || cnt > uint64(size-off-5-int64(l)) {
+		return e, 0, ErrNotRecordPosition
+	}
 
-func (r *SegmentReader) readNext() (e segmentEntry, err error) {
-	_, err = io.ReadFull(r.r, r.buf[:5])
+	buf := make([]byte, l+int(cnt))
+
+	_, err = f.ReadAt(buf, off+5)
 	if err != nil {
-		return
+		if err == io.EOF {
+			err = ErrNotRecordPosition
+		}
+
+		return e, 0, err
 	}
 
-	crc := binary.BigEndian.Uint32(r.buf[:4])
+	e.crc = binary.BigEndian.Uint32(hdr[:4])
+	e.entryType = hdr[4]
+	e.value = buf[l:]
 
-	e.entryType = r.buf[4]
+	if crc32.ChecksumIEEE(buf) != e.crc {
+		return e, 0, ErrCorruptCRC
+	}
 
-	r.cs.Reset()
+	return e, int64(5 + len(buf)), nil
+}
 
-	r.hr.counter = 0
+func NewSegmentWriter(path string) (*SegmentWriter, error) {
+	return openSegmentWriter(nil, path, 0, nil)
+}
 
-	cnt, err := binary.ReadUvarint(&r.hr)
+// openSegmentWriter is NewSegmentWriter, opening the file with open, or
+// os.OpenFile if it's nil, giving the segment epoch if it's created, and
+// counting syncs in stats, see createSegment.
+func openSegmentWriter(open OpenFileFunc, path string, epoch int64, stats *syncStats) (*SegmentWriter, error) {
+	if open == nil {
+		open = DefaultOpenFile
+	}
+
+	f, err := open(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	if int(cnt) > len(r.buf) {
-		r.buf = make([]byte, cnt*2)
+	seg, err := createSegment(f, epoch, stats)
+	if err != nil {
+		return nil, headerError(path, err)
 	}
 
-	comp := r.buf[:cnt]
+	return seg, nil
+}
 
-	_, err = io.ReadFull(&r.hr, comp)
+// NewSegmentWriterWithFramer opens the segment at path to be written with
+// framer, see Framer, creating it if it doesn't exist. With DefaultFramer
+// it's the same as NewSegmentWriter. With any other framer no header is
+// written and Close adds no footer or closing marker, so the segment
+// holds only frames, and writes are appended to whatever the file
+// already holds.
+func NewSegmentWriterWithFramer(path string, framer Framer) (*SegmentWriter, error) {
+	if framer == nil || framer == DefaultFramer {
+		return NewSegmentWriter(path)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	if r.cs.Sum32() != crc {
-		err = ErrCorruptCRC
-		return
+	end, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
 
-	r.pos += (5 + r.hr.counter)
-	e.crc = crc
-	e.value = comp
+	seg := newSegmentWriter(f)
+	seg.framer = framer
+	seg.empty = end == 0
 
-	return
-}
+	*seg.size = end
 
-func (r *SegmentReader) Next() bool {
-	return r.next(dataType)
+	return seg, nil
 }
 
-func (r *SegmentReader) next(typ byte) bool {
-top:
-	r.err = nil
-	ent, err := r.readNext()
-	if err != nil {
-		if err != io.EOF {
-			r.err = err
+// SetSyncRate makes the segment sync in the background every dur rather
+// than after every write. It may be called again to change the rate, and
+// a rate of 0 goes back to syncing every write, syncing anything still
+// pending first. It mustn't be called at the same time as a write.
+func (s *SegmentWriter) SetSyncRate(dur time.Duration) error {
+	atomic.StoreInt64(&s.stats.syncRate, int64(dur))
+
+	if dur == 0 {
+		if !s.bgSync {
+			return nil
 		}
 
-		return false
+		s.bgSync = false
+		s.setRate(0)
+
+		return s.sync()
 	}
 
-	if ent.entryType != typ {
+	s.bgSync = true
+
+	if s.syncing {
+		s.setRate(dur)
+		return nil
+	}
+
+	s.syncing = true
+	s.t.Go(func() error {
+		return s.syncEvery(dur)
+	})
+
+	return nil
+}
+
+// setRate passes a new rate to the background syncer, unless it's
+// stopped because the segment is closing.
+func (s *SegmentWriter) setRate(dur time.Duration) {
+	select {
+	case s.rates <- dur:
+	case <-s.t.Dying():
+	}
+}
+
+// syncEvery syncs every dur, or at the rates sent to it later, until
+// the segment is closed.
+func (s *SegmentWriter) syncEvery(dur time.Duration) error {
+	tick := time.NewTicker(dur)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if atomic.LoadInt64(&s.stats.pending) != 0 {
+				s.sync()
+			}
+		case dur = <-s.rates:
+			if dur == 0 {
+				tick.Stop()
+			} else {
+				tick.Reset(dur)
+			}
+		case <-s.t.Dying():
+			s.sync()
+			return nil
+		}
+	}
+}
+
+// sync syncs the file, counting the sync and the writes it made durable.
+func (s *SegmentWriter) sync() error {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	start := time.Now()
+
+	covered := atomic.LoadInt64(&s.stats.pending)
+	last := atomic.LoadInt64(&s.lastRecord)
+	end := atomic.LoadInt64(s.size)
+
+	err := s.syncFile()
+	if err != nil {
+		// What was written may not have reached the disk, so unlike a
+		// failed write this is always fatal.
+		if errors.Is(err, syscall.ENOSPC) {
+			err = fmt.Errorf("%w: %w", ErrNoSpace, err)
+		}
+
+		return s.fail(err)
+	}
+
+	if s.onDurable != nil && end > s.durableEnd {
+		if last > s.durable {
+			s.durable = last
+		} else {
+			last = -1
+		}
+
+		s.durableEnd = end
+		s.onDurable(last, end)
+	}
+
+	dur := int64(time.Since(start))
+
+	// Writes stay pending until they're counted as synced.
+	atomic.AddInt64(&s.stats.syncs, 1)
+	atomic.AddInt64(&s.stats.synced, covered)
+	atomic.AddInt64(&s.stats.pending, -covered)
+	atomic.AddInt64(&s.stats.syncNanos, dur)
+	atomic.StoreInt64(&s.stats.lastNanos, dur)
+
+	return nil
+}
+
+// writeFile writes b to f. It's a variable so tests can make writes fail.
+var writeFile = SegmentFile.Write
+
+// ErrNoSpace is matched, using errors.Is, by the error returned when a
+// write fails because the disk is full. The error also matches the
+// underlying error from the system.
+var ErrNoSpace = errors.New("no space left for segment")
+
+// writeFailed handles err from writing an entry, cutting off whatever
+// part of the entry made it to the file so that the segment still ends
+// with the last complete entry. Once that's done, running out of space
+// isn't fatal, as writes can succeed again when space is freed, but any
+// other error is.
+func (s *SegmentWriter) writeFailed(err error) error {
+	start := atomic.LoadInt64(s.size)
+
+	terr := s.f.Truncate(start)
+	if terr == nil {
+		_, terr = s.f.Seek(start, io.SeekStart)
+	}
+
+	if errors.Is(err, syscall.ENOSPC) {
+		err = fmt.Errorf("%w: %w", ErrNoSpace, err)
+
+		if terr == nil {
+			return err
+		}
+	}
+
+	return s.fail(err)
+}
+
+// fail reports err, an error writing or syncing the file, to onError and
+// returns it.
+func (s *SegmentWriter) fail(err error) error {
+	if s.onError != nil {
+		s.onError(err)
+	}
+
+	return err
+}
+
+func (s *SegmentWriter) Close() error {
+	if s.syncing {
+		s.t.Kill(nil)
+		s.t.Wait()
+	}
+
+	// Other framings have no footer or closing marker.
+	if s.framer == nil {
+		_, err := s.f.Write(encodeFooter(s.records, s.lastStart))
+		if err != nil {
+			return err
+		}
+
+		_, err = s.f.Write(closingMagic)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.f.Close()
+}
+
+// Records returns the number of records in the segment, which doesn't
+// include tags or any other entries.
+func (s *SegmentWriter) Records() int64 {
+	return s.records
+}
+
+// The footer is a footerType entry written just before the closing
+// marker, holding the number of records in the segment and the offset
+// of the entry starting the last record, or -1 if none does, as 8 big
+// endian bytes each, so they can be read without scanning the segment.
+// Footers written before the offset was added hold only the count.
+const (
+	footerLen  = 16
+	footerSize = 5 + 1 + footerLen
+
+	countFooterLen  = 8
+	countFooterSize = 5 + 1 + countFooterLen
+)
+
+// segmentFooter is what a footer holds.
+type segmentFooter struct {
+	records int64
+
+	// Where the entry starting the last record is, or -1 if no record
+	// starts in the segment. It's only known if hasLast is set.
+	last    int64
+	hasLast bool
+}
+
+func encodeFooter(records, last int64) []byte {
+	var val [footerLen]byte
+
+	binary.BigEndian.PutUint64(val[:], uint64(records))
+	binary.BigEndian.PutUint64(val[countFooterLen:], uint64(last))
+
+	return encodeEntry(footerType, val[:])
+}
+
+// decodeFooter returns what footer, the bytes before the closing marker
+// that are the size of either kind of footer, holds if it's a valid
+// footer.
+func decodeFooter(footer []byte) (segmentFooter, bool) {
+	if len(footer) < 6 || footer[4] != footerType || int(footer[5]) != len(footer)-6 {
+		return segmentFooter{}, false
+	}
+
+	if len(footer) != footerSize && len(footer) != countFooterSize {
+		return segmentFooter{}, false
+	}
+
+	if crc32.ChecksumIEEE(footer[5:]) != binary.BigEndian.Uint32(footer) {
+		return segmentFooter{}, false
+	}
+
+	ft := segmentFooter{
+		records: int64(binary.BigEndian.Uint64(footer[6:])),
+		last:    -1,
+	}
+
+	if len(footer) == footerSize {
+		ft.last = int64(binary.BigEndian.Uint64(footer[6+countFooterLen:]))
+		ft.hasLast = true
+	}
+
+	return ft, true
+}
+
+// readFooter returns the footer of the segment in f whose closing marker
+// starts at magic, and where the footer starts, or -1 if there's no valid
+// footer before the marker. Whether the footer is an entry of its own,
+// rather than the end of a record's value, isn't checked.
+func readFooter(f io.ReaderAt, magic int64) (segmentFooter, int64, error) {
+	for _, size := range []int64{footerSize, countFooterSize} {
+		if magic < size {
+			continue
+		}
+
+		buf := make([]byte, size)
+
+		_, err := f.ReadAt(buf, magic-size)
+		if err != nil {
+			return segmentFooter{}, -1, err
+		}
+
+		ft, ok := decodeFooter(buf)
+		if ok {
+			return ft, magic - size, nil
+		}
+	}
+
+	return segmentFooter{}, -1, nil
+}
+
+// startsRecord reports whether an entry of type t holding value starts a
+// record, rather than continuing one split over segments.
+func startsRecord(t byte, value []byte) bool {
+	switch t {
+	case dataType:
+		return true
+	case extendedType:
+		ext, _, err := decodeExtended(value)
+		return err == nil && (!ext.chunked || ext.chunk == 0)
+	}
+
+	return false
+}
+
+// scanLastRecord returns the offset of the entry starting the last
+// record among the entries of the segment in f that end by end, or -1 if
+// no record starts in it. Every entry's header is read, and the values of
+// extended entries, to find which chunks start a record.
+func scanLastRecord(f io.ReaderAt, end int64) int64 {
+	var (
+		r    = bufio.NewReader(io.NewSectionReader(f, 0, end))
+		pos  int64
+		last int64 = -1
+	)
+
+	for pos < end {
+		var hdr [5]byte
+
+		// An entry cut short by a crash ends the segment.
+		_, err := io.ReadFull(r, hdr[:])
+		if err != nil {
+			break
+		}
+
+		cnt, err := binary.ReadUvarint(r)
+		if err != nil || cnt > uint64(end-pos) {
+			break
+		}
+
+		starts := hdr[4] == dataType
+
+		if hdr[4] == extendedType {
+			value := make([]byte, cnt)
+
+			_, err = io.ReadFull(r, value)
+			if err != nil {
+				break
+			}
+
+			starts = startsRecord(hdr[4], value)
+		} else {
+			_, err = r.Discard(int(cnt))
+			if err != nil {
+				break
+			}
+		}
+
+		if starts {
+			last = pos
+		}
+
+		pos += 5 + int64(uvarintLen(cnt)) + int64(cnt)
+	}
+
+	return last
+}
+
+func (s *SegmentWriter) Size() int64 {
+	return atomic.LoadInt64(s.size)
+}
+
+func (s *SegmentWriter) calculateClean() error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() == 0 {
+		return nil
+	}
+
+	tail, err := readTail(s.f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	s.clean = tail.clean
+
+	end := fi.Size()
+
+	if s.clean {
+		// Ok, we're clean. Pick up the record count from the footer,
+		// and cut off the footer and magic so we continue writing
+		// where the entries end.
+		end = tail.end
+
+		if tail.footer {
+			s.records = tail.records
+		}
+
+		err = s.f.Truncate(end)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The footer says where the last record starts, unless it predates
+	// that or there's no footer to read.
+	if tail.hasLast {
+		s.lastStart = tail.last
+	} else {
+		s.lastStart = scanLastRecord(s.f, end)
+	}
+
+	// Continue writing at the end.
+	_, err = s.f.Seek(end, os.SEEK_SET)
+	return err
+}
+
+// segmentTail describes how a segment ends.
+type segmentTail struct {
+	// Set if the segment ends with the closing marker.
+	clean bool
+
+	// Where the entries end, before the footer and closing marker.
+	end int64
+
+	// Set if there's a footer, in which case it's what the footer
+	// holds.
+	footer bool
+	segmentFooter
+
+	// Set if the segment was closed by Seal.
+	sealed bool
+}
+
+// readTail returns how the segment in f, which is size bytes long, ends.
+// A record whose value happens to end with the bytes of the closing
+// marker, or of a footer and the marker, mustn't be mistaken for them, so
+// the entries are walked from the start of the segment, reading only
+// their headers, to check that the footer and marker really are entries
+// of their own. Segments written before footers existed end with the
+// marker alone.
+func readTail(f io.ReaderAt, size int64) (segmentTail, error) {
+	tail := segmentTail{end: size}
+
+	if size < int64(len(closingMagic)) {
+		return tail, nil
+	}
+
+	buf := make([]byte, len(closingMagic))
+
+	_, err := f.ReadAt(buf, size-int64(len(buf)))
+	if err != nil {
+		return tail, err
+	}
+
+	if !bytes.Equal(buf, closingMagic) {
+		return tail, nil
+	}
+
+	magic := size - int64(len(closingMagic))
+
+	// Where the footer starts, if there's a valid one before the marker.
+	footer, footerAt, err := readFooter(f, magic)
+	if err != nil {
+		return tail, err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, 0, magic))
+
+	var pos int64
+
+	for pos < magic {
+		if pos == footerAt {
+			tail.clean = true
+			tail.footer = true
+			tail.segmentFooter = footer
+			tail.end = footerAt
+
+			tail.sealed, err = sealedAt(f, tail.end)
+			return tail, err
+		}
+
+		var hdr [5]byte
+
+		_, err := io.ReadFull(r, hdr[:])
+		if err != nil {
+			return tail, nil
+		}
+
+		cnt, err := binary.ReadUvarint(r)
+		if err != nil || cnt > uint64(magic-pos) {
+			return tail, nil
+		}
+
+		_, err = r.Discard(int(cnt))
+		if err != nil {
+			return tail, nil
+		}
+
+		pos += 5 + int64(uvarintLen(cnt)) + int64(cnt)
+	}
+
+	if pos != magic {
+		return tail, nil
+	}
+
+	tail.clean = true
+	tail.end = magic
+
+	return tail, nil
+}
+
+// sealedAt reports whether the entries in f that end at end finish with
+// the marker written by Seal.
+func sealedAt(f io.ReaderAt, end int64) (bool, error) {
+	if end < int64(len(sealMarker)) {
+		return false, nil
+	}
+
+	seal := make([]byte, len(sealMarker))
+
+	_, err := f.ReadAt(seal, end-int64(len(sealMarker)))
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(seal, sealMarker), nil
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+
+	return binary.PutUvarint(buf[:], v)
+}
+
+const (
+	statType   = 's'
+	dataType   = 'd'
+	tagType    = 't'
+	headerType = 'h'
+	footerType = 'f'
+
+	// A record with extra fields, see extendedRecord. It's read as a
+	// dataType entry.
+	extendedType = 'x'
+
+	// A checkpoint, see WALWriter.WriteCheckpoint.
+	checkpointType = 'c'
+
+	// Passed to next to read entries of every type.
+	anyType = 0
+)
+
+// legacyType reports whether t is the type of an entry written before
+// segments had a header.
+func legacyType(t byte) bool {
+	return t == statType || t == dataType || t == tagType
+}
+
+// knownType reports whether t is the type of an entry this package
+// writes.
+func knownType(t byte) bool {
+	switch t {
+	case statType, dataType, tagType, headerType, footerType, extendedType, checkpointType:
+		return true
+	}
+
+	return false
+}
+
+var closingMagic = []byte("\xE3\x14\x04\xC5s\x20this segment was closed properly")
+
+// sealPayload is the value of the statType entry written by Seal, just
+// before the closing marker of the last segment of a sealed WAL.
+var sealPayload = []byte("this log is sealed, nothing more will be written")
+
+// sealMarker is the sealing entry as it appears on disk.
+var sealMarker = encodeEntry(statType, sealPayload)
+
+// encodeEntry returns the on disk form of an entry, as written by
+// writeType.
+func encodeEntry(t byte, data []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(buf[:], uint64(len(data)))
+
+	cs := crc32.NewIEEE()
+	cs.Write(buf[:n])
+	cs.Write(data)
+
+	entry := make([]byte, 5, 5+n+len(data))
+	binary.BigEndian.PutUint32(entry, cs.Sum32())
+	entry[4] = t
+
+	entry = append(entry, buf[:n]...)
+
+	return append(entry, data...)
+}
+
+// extendedRecord is the value of an extendedType entry: a flags byte
+// saying which optional fields are present, each present field in the
+// order of its flag, and then the record's data. A key is a uvarint
+// length followed by the key. A hash is the SHA-256 hash of the data. A
+// chunk is the uvarint number of the chunk within a record split by
+// SplitLargeRecords, counting from 0, and the more flag, which has no
+// field, says the next chunk follows. An expiry is the time the record
+// expires, written by WriteTTL, in nanoseconds since the Unix epoch as 8
+// big endian bytes. A sequence, written by WriteSeq, is a uvarint. A
+// chain is the record's SHA-256 link in the hash chain.
+type extendedRecord struct {
+	key  []byte
+	hash []byte
+
+	chunked bool
+	chunk   uint64
+	more    bool
+
+	expires int64
+
+	sequenced bool
+	seq       uint64
+
+	// The record's link in the hash chain, see WriteOptions.HashChain.
+	chain []byte
+}
+
+const (
+	extKey byte = 1 << iota
+	extHash
+	extChunk
+	extMore
+	extExpires
+	extSeq
+	extChain
+
+	extKnown = extKey | extHash | extChunk | extMore | extExpires | extSeq | extChain
+)
+
+// empty reports whether the record has no fields, so its data can be
+// written as a plain dataType entry.
+func (e *extendedRecord) empty() bool {
+	return e.key == nil && e.hash == nil && !e.chunked && e.expires == 0 && !e.sequenced &&
+		e.chain == nil
+}
+
+var (
+	ErrUnknownFields   = errors.New("record has fields this version doesn't know")
+	ErrMalformedRecord = errors.New("malformed record")
+	ErrHashMismatch    = errors.New("record doesn't match its content hash")
+)
+
+// contentHash returns the hash stored for data when records are written
+// with their hashes.
+func contentHash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// encode appends the encoding of the record, with data, to buf.
+func (e *extendedRecord) encode(buf, data []byte) []byte {
+	var flags byte
+
+	if e.key != nil {
+		flags |= extKey
+	}
+
+	if e.hash != nil {
+		flags |= extHash
+	}
+
+	if e.chunked {
+		flags |= extChunk
+	}
+
+	if e.more {
+		flags |= extMore
+	}
+
+	if e.expires != 0 {
+		flags |= extExpires
+	}
+
+	if e.sequenced {
+		flags |= extSeq
+	}
+
+	if e.chain != nil {
+		flags |= extChain
+	}
+
+	buf = append(buf, flags)
+
+	if e.key != nil {
+		buf = appendUvarint(buf, uint64(len(e.key)))
+		buf = append(buf, e.key...)
+	}
+
+	buf = append(buf, e.hash...)
+
+	if e.chunked {
+		buf = appendUvarint(buf, e.chunk)
+	}
+
+	if e.expires != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.expires))
+	}
+
+	if e.sequenced {
+		buf = appendUvarint(buf, e.seq)
+	}
+
+	buf = append(buf, e.chain...)
+
+	return append(buf, data...)
+}
+
+// decodeExtended splits the value of an extendedType entry into its
+// fields and its data. Both refer to value.
+func decodeExtended(value []byte) (extendedRecord, []byte, error) {
+	var e extendedRecord
+
+	if len(value) < 1 {
+		return e, nil, ErrMalformedRecord
+	}
+
+	flags := value[0]
+	value = value[1:]
+
+	if flags&^extKnown != 0 {
+		return e, nil, ErrUnknownFields
+	}
+
+	if flags&extKey != 0 {
+		n, sz := binary.Uvarint(value)
+		if sz <= 0 || uint64(len(value)-sz) < n {
+			return e, nil, ErrMalformedRecord
+		}
+
+		e.key = value[sz : sz+int(n)]
+		value = value[sz+int(n):]
+	}
+
+	if flags&extHash != 0 {
+		if len(value) < sha256.Size {
+			return e, nil, ErrMalformedRecord
+		}
+
+		e.hash = value[:sha256.Size]
+		value = value[sha256.Size:]
+	}
+
+	if flags&extChunk != 0 {
+		n, sz := binary.Uvarint(value)
+		if sz <= 0 {
+			return e, nil, ErrMalformedRecord
+		}
+
+		e.chunked = true
+		e.chunk = n
+		value = value[sz:]
+	}
+
+	e.more = flags&extMore != 0
+
+	if flags&extExpires != 0 {
+		if len(value) < 8 {
+			return e, nil, ErrMalformedRecord
+		}
+
+		e.expires = int64(binary.BigEndian.Uint64(value))
+		value = value[8:]
+	}
+
+	if flags&extSeq != 0 {
+		n, sz := binary.Uvarint(value)
+		if sz <= 0 {
+			return e, nil, ErrMalformedRecord
+		}
+
+		e.sequenced = true
+		e.seq = n
+		value = value[sz:]
+	}
+
+	if flags&extChain != 0 {
+		if len(value) < sha256.Size {
+			return e, nil, ErrMalformedRecord
+		}
+
+		e.chain = value[:sha256.Size]
+		value = value[sha256.Size:]
+	}
+
+	return e, value, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(tmp[:], v)
+
+	return append(buf, tmp[:n]...)
+}
+
+// entrySize returns the number of bytes used on disk by an entry
+// with a value of size bytes: a 4 byte CRC, the type, the uvarint
+// encoded length, and the value itself.
+func entrySize(size int) int64 {
+	var buf [binary.MaxVarintLen64]byte
+
+	return int64(5 + binary.PutUvarint(buf[:], uint64(size)) + size)
+}
+
+// writeType appends an entry to the segment. Each entry is a 4 byte
+// CRC, a type byte, the length of data as a uvarint and then data. The
+// CRC covers the length and data. Every integer in a segment, here and
+// in the header, is either big endian or a uvarint so segments can be
+// read on a host of any byte order. Being a uvarint, the length can hold
+// any 64 bit size, so there's no limit on the size of a record beyond
+// what fits in memory, and offsets within a segment are 64 bit too.
+func (s *SegmentWriter) writeType(t byte, data []byte) (int, error) {
+	//out := snappy.Encode(s.buf, data)
+
+	var (
+		entry int64
+		err   error
+	)
+
+	if s.framer != nil {
+		s.buf = s.framer.AppendFrame(s.buf[:0], t, data)
+		entry = int64(len(s.buf))
+
+		err = s.write(s.buf)
+	} else {
+		n := binary.PutUvarint(s.sbuf[5:], uint64(len(data)))
+
+		s.cs.Reset()
+		s.cs.Write(s.sbuf[5 : 5+n])
+		s.cs.Write(data)
+
+		binary.BigEndian.PutUint32(s.sbuf[:4], s.cs.Sum32())
+
+		s.sbuf[4] = t
+
+		entry = int64(5 + n + len(data))
+
+		err = s.write(s.sbuf[:5+n])
+		if err == nil {
+			err = s.write(data)
+		}
+	}
+
+	if err != nil {
+		return 0, s.writeFailed(err)
+	}
+
+	atomic.AddInt64(&s.stats.writes, 1)
+	atomic.AddInt64(&s.stats.pending, 1)
+
+	if t == dataType || t == extendedType {
+		s.records++
+		atomic.StoreInt64(&s.lastRecord, atomic.LoadInt64(s.size))
+
+		if startsRecord(t, data) {
+			s.lastStart = atomic.LoadInt64(s.size)
+		}
+	}
+
+	atomic.AddInt64(s.size, entry)
+
+	s.empty = false
+
+	if !s.bgSync {
+		err = s.sync()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+func (s *SegmentWriter) Write(data []byte) (int, error) {
+	return s.writeType(dataType, data)
+}
+
+func (s *SegmentWriter) WriteTag(tag []byte) error {
+	_, err := s.writeType(tagType, tag)
+	return err
+}
+
+// Seal writes the marker that says nothing more will ever be written to
+// the WAL and closes the segment.
+func (s *SegmentWriter) Seal() error {
+	_, err := s.writeType(statType, sealPayload)
+	if err != nil {
+		return err
+	}
+
+	return s.Close()
+}
+
+// segmentSealed reports whether the segment at path was closed by Seal.
+func segmentSealed(open OpenFileFunc, path string) (bool, error) {
+	f, err := openRead(open, path)
+	if err != nil {
+		return false, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	tail, err := readTail(f, fi.Size())
+	if err != nil {
+		return false, err
+	}
+
+	return tail.sealed, nil
+}
+
+func (s *SegmentWriter) diskPos() int64 {
+	pos, err := s.f.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		panic(err)
+	}
+
+	return pos
+}
+
+func (s *SegmentWriter) Pos() int64 {
+	return atomic.LoadInt64(s.size)
+}
+
+func (s *SegmentWriter) Truncate(pos int64) error {
+	return s.f.Truncate(pos)
+}
+
+func (s *SegmentWriter) Clean() bool {
+	return s.clean
+}
+
+// Empty reports whether nothing but the header has been written to the
+// segment.
+func (s *SegmentWriter) Empty() bool {
+	return s.empty
+}
+
+type readByte interface {
+	ReadByte() (byte, error)
+	Read([]byte) (int, error)
+}
+
+type hashReader struct {
+	h hash.Hash32
+	r readByte
+
+	counter int64
+}
+
+func (hr *hashReader) ReadByte() (byte, error) {
+	b, err := hr.r.ReadByte()
+	if err != nil {
+		return b, err
+	}
+
+	hr.counter++
+
+	hr.h.Write([]byte{b})
+
+	return b, nil
+}
+
+func (hr *hashReader) Read(b []byte) (int, error) {
+	n, err := hr.r.Read(b)
+	if err != nil {
+		return n, err
+	}
+
+	hr.counter += int64(n)
+
+	hr.h.Write(b[:n])
+
+	return n, nil
+}
+
+type SegmentReader struct {
+	f    SegmentFile
+	r    *bufio.Reader
+	buf  []byte
+	buf2 []byte
+
+	value     []byte
+	valueCRC  uint32
+	valueType byte
+
+	pos   int64
+	err   error
+	cs    hash.Hash32
+	hr    hashReader
+	clean bool
+
+	truncated bool
+	sealed    bool
+
+	// The extra fields of the current record, if it has any.
+	ext extendedRecord
+
+	// The offsets the current entry starts and ends at.
+	valueStart int64
+	valueEnd   int64
+
+	// The format version from the segment's header, 0 if it has none.
+	// Versions 0 to 2 share the same entry framing.
+	version byte
+
+	// The epoch from the segment's header, 0 if it has none.
+	epoch int64
+
+	// Set if the segment is read with a framer other than the default.
+	framer Framer
+
+	// How segments are opened, see openRead.
+	open OpenFileFunc
+}
+
+// openFile opens files for reading. It's a variable so tests can
+// observe how often files are opened.
+var openFile = os.Open
+
+// openRead opens the file at path for reading with open, or openFile if
+// it's nil.
+func openRead(open OpenFileFunc, path string) (SegmentFile, error) {
+	if open != nil {
+		return open(path, os.O_RDONLY, 0)
+	}
+
+	f, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// createFile creates the file at path with open, or os.Create if open
+// is nil, truncating it if it already exists.
+func createFile(open OpenFileFunc, path string) (SegmentFile, error) {
+	if open == nil {
+		open = DefaultOpenFile
+	}
+
+	return open(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func NewSegmentReader(path string) (*SegmentReader, error) {
+	return openSegmentReader(nil, path, nil)
+}
+
+// openSegmentReader is NewSegmentReaderWithFramer, opening the segment
+// with open, see openRead.
+func openSegmentReader(open OpenFileFunc, path string, framer Framer) (*SegmentReader, error) {
+	if framer != nil && framer != DefaultFramer {
+		return openFramedReader(open, path, framer)
+	}
+
+	f, err := openRead(open, path)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr, err := checkVersion(f)
+	if err != nil {
+		f.Close()
+		return nil, headerError(path, err)
+	}
+
+	r := bufio.NewReader(f)
+	buf := make([]byte, bufferSize)
+	buf2 := make([]byte, bufferSize)
+	sr := &SegmentReader{
+		f:    f,
+		r:    r,
+		buf:  buf,
+		buf2: buf2,
+		cs:   crc32.NewIEEE(),
+
+		version: hdr.version,
+		epoch:   hdr.epoch,
+		open:    open,
+	}
+
+	sr.hr.h = sr.cs
+	sr.hr.r = r
+
+	return sr, nil
+}
+
+// NewSegmentReaderWithFramer opens the segment at path to be read with
+// framer, see Framer. With DefaultFramer it's the same as NewSegmentReader.
+// CRC returns 0 for entries read with any other framer.
+func NewSegmentReaderWithFramer(path string, framer Framer) (*SegmentReader, error) {
+	return openSegmentReader(nil, path, framer)
+}
+
+// openFramedReader opens the segment at path to be read with framer,
+// which isn't DefaultFramer.
+func openFramedReader(open OpenFileFunc, path string, framer Framer) (*SegmentReader, error) {
+	f, err := openRead(open, path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	sr := &SegmentReader{
+		f:    f,
+		r:    r,
+		buf:  make([]byte, bufferSize),
+		buf2: make([]byte, bufferSize),
+		cs:   crc32.NewIEEE(),
+
+		framer: framer,
+		open:   open,
+	}
+
+	sr.hr.h = sr.cs
+	sr.hr.r = r
+
+	return sr, nil
+}
+
+func (r *SegmentReader) Close() error {
+	return r.f.Close()
+}
+
+// Reset closes the segment being read and points the reader at the start
+// of the segment at path instead, reusing its buffers, as if it had been
+// opened with NewSegmentReader, or NewSegmentReaderWithFramer with the
+// framer it was opened with. If the new segment can't be opened the
+// reader is left reading the old one.
+func (r *SegmentReader) Reset(path string) error {
+	f, err := openRead(r.open, path)
+	if err != nil {
+		return err
+	}
+
+	var hdr segmentHeader
+
+	if r.framer == nil {
+		hdr, err = checkVersion(f)
+		if err != nil {
+			f.Close()
+			return headerError(path, err)
+		}
+	}
+
+	r.f.Close()
+
+	r.f = f
+	r.r.Reset(f)
+
+	r.value = nil
+	r.valueCRC = 0
+	r.valueType = 0
+	r.pos = 0
+	r.err = nil
+	r.clean = false
+	r.truncated = false
+	r.sealed = false
+	r.ext = extendedRecord{}
+	r.valueStart = 0
+	r.valueEnd = 0
+	r.version = hdr.version
+	r.epoch = hdr.epoch
+
+	return nil
+}
+
+func (r *SegmentReader) Seek(pos int64) error {
+	_, err := r.f.Seek(pos, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+
+	r.pos = pos
+
+	r.r.Reset(r.f)
+
+	return nil
+}
+
+// Clean reports whether the segment ends with the marker written when
+// it's closed properly. A segment that isn't clean is either still being
+// written to or was not closed because of a crash.
+func (r *SegmentReader) Clean() (bool, error) {
+	if r.clean {
+		return true, nil
+	}
+
+	fi, err := r.f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	tail, err := readTail(r.f, fi.Size())
+	if err != nil {
+		return false, err
+	}
+
+	// Once closed, a segment stays that way unless a writer reopens
+	// it, so only a clean result is remembered.
+	r.clean = tail.clean
+
+	return r.clean, nil
+}
+
+// Records returns the number of records in the segment as recorded in
+// its footer, which is written when the segment is closed. If the
+// segment wasn't closed properly, or was written before footers
+// existed, false is returned and the records have to be counted.
+func (r *SegmentReader) Records() (int64, bool, error) {
+	fi, err := r.f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+
+	tail, err := readTail(r.f, fi.Size())
+	if err != nil {
+		return 0, false, err
+	}
+
+	return tail.records, tail.footer, nil
+}
+
+// Version returns the format version the segment was written with. It's
+// 0 for segments written before segments had a header.
+func (r *SegmentReader) Version() int {
+	return int(r.version)
+}
+
+func (s *SegmentReader) Pos() int64 {
+	return s.pos
+}
+
+func (r *SegmentReader) SeekTag(tag []byte) error {
+	for r.next(tagType) {
+		if bytes.Equal(r.Value(), tag) {
+			return nil
+		}
+	}
+	return io.EOF
+}
+
+// seekEnd moves the reader past every complete entry in the segment.
+// It stops in front of the footer and closing magic because a writer
+// that reopens the segment overwrites them with new entries.
+func (r *SegmentReader) seekEnd() error {
+	footer := int64(-1)
+
+	for {
+		start := r.pos
+
+		ent, err := r.readNext()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return r.Seek(start)
+			}
+
+			return err
+		}
+
+		if ent.entryType == statType && bytes.Equal(ent.value, closingMagic[6:]) {
+			if footer != -1 {
+				return r.Seek(footer)
+			}
+
+			return r.Seek(start)
+		}
+
+		footer = -1
+		if ent.entryType == footerType {
+			footer = start
+		}
+	}
+}
+
+var ErrCorruptCRC = errors.New("corrupt data detected")
+
+type segmentEntry struct {
+	entryType byte
+	value     []byte
+	crc       uint32
+}
+
+func (r *SegmentReader) readNext() (e segmentEntry, err error) {
+	if r.framer != nil {
+		return r.readFrame()
+	}
+
+	_, err = io.ReadFull(r.r, r.buf[:5])
+	if err != nil {
+		return
+	}
+
+	crc := binary.BigEndian.Uint32(r.buf[:4])
+
+	e.entryType = r.buf[4]
+
+	r.cs.Reset()
+
+	r.hr.counter = 0
+
+	// Past this point the entry has started, so running out of data
+	// means it's incomplete rather than that there's nothing more.
+
+	cnt, err := binary.ReadUvarint(&r.hr)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	if int(cnt) > len(r.buf) {
+		r.buf = make([]byte, cnt*2)
+	}
+
+	comp := r.buf[:cnt]
+
+	_, err = io.ReadFull(&r.hr, comp)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	if r.cs.Sum32() != crc {
+		err = ErrCorruptCRC
+		return
+	}
+
+	r.pos += (5 + r.hr.counter)
+	e.crc = crc
+	e.value = comp
+
+	return
+}
+
+// readFrame reads the next entry using the segment's framer.
+func (r *SegmentReader) readFrame() (e segmentEntry, err error) {
+	typ, value, size, err := r.framer.ReadFrame(r.r, r.buf)
+	if err != nil {
+		return
+	}
+
+	r.pos += size
+	e.entryType = typ
+	e.value = value
+
+	return
+}
+
+// skipNext reads the header of the next entry and skips over its value
+// without copying it, returning the entry (with no value) and the length
+// of its value. Because the value is never read the CRC is not checked.
+func (r *SegmentReader) skipNext() (e segmentEntry, size int64, err error) {
+	start := r.pos
+
+	defer func() {
+		if err != nil {
+			// Drop anything buffered from a partial entry so that
+			// the entry can be read again once it's complete.
+			r.Seek(start)
+		}
+	}()
+
+	// Only the framer knows how to find the end of its frames.
+	if r.framer != nil {
+		e, err = r.readFrame()
+		size = int64(len(e.value))
+		e.value = nil
+		return
+	}
+
+	_, err = io.ReadFull(r.r, r.buf[:5])
+	if err != nil {
+		return
+	}
+
+	e.crc = binary.BigEndian.Uint32(r.buf[:4])
+	e.entryType = r.buf[4]
+
+	cnt, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	n, err := r.r.Discard(int(cnt))
+	if err != nil {
+		if err == io.EOF && n < int(cnt) {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	r.pos += 5 + int64(binary.PutUvarint(r.buf, cnt)) + int64(cnt)
+	size = int64(cnt)
+
+	return
+}
+
+// checkNext is like skipNext, but reads the value through the CRC to
+// check it without keeping it, returning ErrCorruptCRC if it doesn't
+// match, the same as readNext.
+func (r *SegmentReader) checkNext() (e segmentEntry, size int64, err error) {
+	start := r.pos
+
+	defer func() {
+		if err != nil {
+			r.Seek(start)
+		}
+	}()
+
+	// The framer checks its own frames as it reads them.
+	if r.framer != nil {
+		e, err = r.readFrame()
+		size = int64(len(e.value))
+		e.value = nil
+		return
+	}
+
+	_, err = io.ReadFull(r.r, r.buf[:5])
+	if err != nil {
+		return
+	}
+
+	e.crc = binary.BigEndian.Uint32(r.buf[:4])
+	e.entryType = r.buf[4]
+
+	r.cs.Reset()
+
+	r.hr.counter = 0
+
+	cnt, err := binary.ReadUvarint(&r.hr)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	_, err = io.CopyN(io.Discard, &r.hr, int64(cnt))
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	if r.cs.Sum32() != e.crc {
+		err = ErrCorruptCRC
+		return
+	}
+
+	r.pos += 5 + r.hr.counter
+	size = int64(cnt)
+
+	return
+}
+
+func (r *SegmentReader) Next() bool {
+	return r.next(dataType)
+}
+
+// nextOfType moves to the next entry of type typ like next, but moves
+// past entries of other types using only their headers, seeking over
+// values that aren't already buffered instead of reading them. Their
+// CRCs aren't checked, and entries of other types are returned as is,
+// without the handling next gives extendedType.
+func (r *SegmentReader) nextOfType(typ byte) bool {
+	if r.framer != nil {
+		return r.next(typ)
+	}
+
+	for {
+		hdr, _ := r.r.Peek(5 + binary.MaxVarintLen64)
+		if len(hdr) < 6 || hdr[4] == typ {
+			// Let next deal with the end of the segment as usual.
+			return r.next(typ)
+		}
+
+		cnt, l := binary.Uvarint(hdr[5:])
+		if l <= 0 {
+			return r.next(typ)
+		}
+
+		size := 5 + int64(l) + int64(cnt)
+
+		if size <= int64(r.r.Buffered()) {
+			r.r.Discard(int(size))
+			r.pos += size
+			continue
+		}
+
+		err := r.Seek(r.pos + size)
+		if err != nil {
+			r.err = err
+			return false
+		}
+	}
+}
+
+// skipKeys moves the reader past the records ahead of it whose keys, read
+// from the start of their entries, don't satisfy pred, and the records
+// without a key, without reading the rest of them. It stops in front of
+// the first entry that isn't a record, or whose key can't be read from
+// what's buffered, leaving it to next.
+func (r *SegmentReader) skipKeys(pred func([]byte) bool) {
+	if r.framer != nil {
+		return
+	}
+
+	for {
+		hdr, _ := r.r.Peek(5 + binary.MaxVarintLen64)
+		if len(hdr) < 6 {
+			return
+		}
+
+		cnt, l := binary.Uvarint(hdr[5:])
+		if l <= 0 {
+			return
+		}
+
+		switch hdr[4] {
+		case dataType:
+		case extendedType:
+			if !r.skipKey(5+l, cnt, pred) {
+				return
+			}
+		default:
+			return
+		}
+
+		size := 5 + int64(l) + int64(cnt)
+
+		if size <= int64(r.r.Buffered()) {
+			r.r.Discard(int(size))
+			r.pos += size
+			continue
+		}
+
+		if r.Seek(r.pos+size) != nil {
+			return
+		}
+	}
+}
+
+// skipKey reports whether the extendedType entry ahead of the reader,
+// whose value of cnt bytes starts off bytes in, has no key or a key that
+// doesn't satisfy pred. A chunk without a key may belong to a record
+// whose first chunk has one, so it's left to next.
+func (r *SegmentReader) skipKey(off int, cnt uint64, pred func([]byte) bool) bool {
+	buf, _ := r.r.Peek(off + 1 + binary.MaxVarintLen64)
+	if len(buf) < off+1 || buf[off]&^extKnown != 0 {
+		return false
+	}
+
+	if buf[off]&extKey == 0 {
+		return buf[off]&extChunk == 0
+	}
+
+	n, sz := binary.Uvarint(buf[off+1:])
+	if sz <= 0 || uint64(1+sz)+n > cnt {
+		return false
+	}
+
+	end := off + 1 + sz + int(n)
+
+	buf, _ = r.r.Peek(end)
+	if len(buf) < end {
+		return false
+	}
+
+	return !pred(buf[off+1+sz : end])
+}
+
+// recordSizer works out the sizes of records from the entries holding
+// them, putting the chunks of a record split by SplitLargeRecords back
+// together the way WALReader does, across segments too.
+type recordSizer struct {
+	size int
+	next uint64
+	open bool
+}
+
+// add counts an entry holding n bytes of a record's data, with the
+// fields ext, returning the size of the record once it's complete. As
+// WALReader skips them, chunks without the start of their record give
+// nothing.
+func (s *recordSizer) add(ext extendedRecord, n int) (int, bool) {
+	switch {
+	case !ext.chunked:
+		s.open = false
+		return n, true
+	case ext.chunk == 0:
+		s.size, s.next, s.open = 0, 0, true
+	case !s.open || ext.chunk != s.next:
+		s.open = false
+		return 0, false
+	}
+
+	s.size += n
+	s.next++
+
+	if ext.more {
+		return 0, false
+	}
+
+	s.open = false
+
+	return s.size, true
+}
+
+// recordSizes calls yield with the size of the data of each record in
+// the segment from the reader's position on, reading only the headers of
+// entries, and the fields of records that have them, and seeking over
+// data that isn't already buffered. sizes carries a split record over
+// from the segment before. It stops at an incomplete entry at the end,
+// or once yield returns false, which it reports by returning false.
+func (r *SegmentReader) recordSizes(sizes *recordSizer, yield func(int) bool) (bool, error) {
+	// Only the framer knows how to find the end of its frames.
+	if r.framer != nil {
+		for {
+			ent, err := r.readNext()
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return true, nil
+				}
+
+				return false, err
+			}
+
+			var ext extendedRecord
+
+			data := ent.value
+
+			switch ent.entryType {
+			case dataType:
+			case extendedType:
+				ext, data, err = decodeExtended(ent.value)
+				if err != nil {
+					return false, err
+				}
+			default:
+				continue
+			}
+
+			size, ok := sizes.add(ext, len(data))
+			if ok && !yield(size) {
+				return false, nil
+			}
+		}
+	}
+
+	fi, err := r.f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		hdr, _ := r.r.Peek(5 + binary.MaxVarintLen64)
+		if len(hdr) < 6 {
+			return true, nil
+		}
+
+		cnt, l := binary.Uvarint(hdr[5:])
+		if l <= 0 {
+			return true, nil
+		}
+
+		size := 5 + int64(l) + int64(cnt)
+		if r.pos+size > fi.Size() {
+			return true, nil
+		}
+
+		if hdr[4] == dataType || hdr[4] == extendedType {
+			var (
+				ext    extendedRecord
+				fields int
+			)
+
+			if hdr[4] == extendedType {
+				ext, fields, err = r.peekFields(5+l, int(cnt))
+				if err != nil {
+					return false, err
+				}
+			}
+
+			n, ok := sizes.add(ext, int(cnt)-fields)
+			if ok && !yield(n) {
+				return false, nil
+			}
+		}
+
+		if size <= int64(r.r.Buffered()) {
+			r.r.Discard(int(size))
+			r.pos += size
+			continue
+		}
+
+		err := r.Seek(r.pos + size)
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// peekFields returns the fields of the extendedType entry at the
+// reader's position, whose value of cnt bytes starts skip bytes in, and
+// the number of bytes they take, without moving the reader. No more of
+// the record's data is read than fits in the reader's buffer, unless the
+// fields themselves don't, as with a long key.
+func (r *SegmentReader) peekFields(skip, cnt int) (extendedRecord, int, error) {
+	k := cnt
+	if k > r.r.Size()-skip {
+		k = r.r.Size() - skip
+	}
+
+	buf, err := r.r.Peek(skip + k)
+	if err != nil {
+		return extendedRecord{}, 0, err
+	}
+
+	ext, data, err := decodeExtended(buf[skip:])
+	if err == ErrMalformedRecord && k < cnt {
+		value := make([]byte, cnt)
+
+		_, err = r.f.ReadAt(value, r.pos+int64(skip))
+		if err != nil {
+			return extendedRecord{}, 0, err
+		}
+
+		ext, data, err = decodeExtended(value)
+		k = cnt
+	}
+
+	if err != nil {
+		return extendedRecord{}, 0, err
+	}
+
+	return ext, k - len(data), nil
+}
+
+func (r *SegmentReader) next(typ byte) bool {
+top:
+	r.err = nil
+	start := r.pos
+	ent, err := r.readNext()
+	if err != nil {
+		switch err {
+		case io.EOF:
+		case io.ErrUnexpectedEOF:
+			// The last entry is incomplete, either because it's still
+			// being written or it was torn by a crash. Treat it as not
+			// there yet, rewinding so it's read again in full once the
+			// rest of it arrives.
+			r.truncated = true
+			r.Seek(start)
+		default:
+			r.err = err
+		}
+
+		return false
+	}
+
+	r.truncated = false
+
+	if ent.entryType == statType && bytes.Equal(ent.value, sealPayload) {
+		r.sealed = true
+	}
+
+	r.ext = extendedRecord{}
+
+	if ent.entryType == extendedType {
+		ext, data, err := decodeExtended(ent.value)
+		if err != nil {
+			r.err = err
+			return false
+		}
+
+		if ext.hash != nil && !bytes.Equal(contentHash(data), ext.hash) {
+			r.err = ErrHashMismatch
+			return false
+		}
+
+		r.ext = ext
+		ent.entryType = dataType
+		ent.value = data
+	}
+
+	if typ != anyType && ent.entryType != typ {
 		goto top
 	}
 
 	r.value = ent.value
 	r.valueCRC = ent.crc
+	r.valueType = ent.entryType
+	r.valueStart = start
+	r.valueEnd = r.pos
 
 	return true
 }
@@ -412,6 +2271,55 @@ func (r *SegmentReader) Error() error {
 	return r.err
 }
 
+// Truncated reports whether the last call to Next stopped because the
+// final entry in the segment is incomplete, rather than because the
+// segment ended cleanly after a complete entry. This is expected at the
+// end of a segment that was being written when the writer crashed, and
+// is distinct from corruption, which is reported by Error.
+func (r *SegmentReader) Truncated() bool {
+	return r.truncated
+}
+
+// Sealed reports whether the reader has reached the marker written by
+// WALWriter.Seal, after which the WAL will never have more entries.
+func (r *SegmentReader) Sealed() bool {
+	return r.sealed
+}
+
+// Key returns the key of the current record, or nil if it was written
+// without one.
+func (r *SegmentReader) Key() []byte {
+	return r.ext.key
+}
+
+// ContentHash returns the SHA-256 hash stored with the current record,
+// or nil if it was written without one. Next has already checked that
+// the record matches it.
+func (r *SegmentReader) ContentHash() []byte {
+	return r.ext.hash
+}
+
+// Expires returns the time the current record expires, as written by
+// WALWriter.WriteTTL, or the zero time if it doesn't.
+func (r *SegmentReader) Expires() time.Time {
+	if r.ext.expires == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, r.ext.expires)
+}
+
+// Seq returns the sequence of the current record, as written by
+// WALWriter.WriteSeq, and false if it was written without one.
+func (r *SegmentReader) Seq() (uint64, bool) {
+	return r.ext.seq, r.ext.sequenced
+}
+
+// expired reports whether the current record has expired.
+func (r *SegmentReader) expired(now time.Time) bool {
+	return r.ext.expires != 0 && now.UnixNano() >= r.ext.expires
+}
+
 func (r *SegmentReader) Value() []byte {
 	return r.value
 }
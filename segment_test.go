@@ -1,10 +1,16 @@
 package wal
 
 import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -217,5 +223,634 @@ func TestSegment(t *testing.T) {
 		assert.NotEqual(t, 0, r.CRC())
 	})
 
+	n.It("knows if the segment being read was closed properly", func() {
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		_, err = segment.Write([]byte("test data"))
+		require.NoError(t, err)
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		clean, err := r.Clean()
+		require.NoError(t, err)
+		assert.False(t, clean)
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		clean, err = r.Clean()
+		require.NoError(t, err)
+		assert.True(t, clean)
+	})
+
+	n.It("isn't fooled by a record ending with a footer and closing marker", func() {
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		data := append([]byte("test data"), encodeFooter(3, segmentHeaderSize)...)
+		data = append(data, closingMagic...)
+
+		_, err = segment.Write(data)
+		require.NoError(t, err)
+
+		// Abandon the writer without closing the segment properly.
+		segment.f.Close()
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		clean, err := r.Clean()
+		require.NoError(t, err)
+		assert.False(t, clean)
+
+		r.Close()
+
+		segment, err = NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		_, err = segment.Write([]byte("more data"))
+		require.NoError(t, err)
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		r, err = NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, data, r.Value())
+
+		require.True(t, r.Next())
+		assert.Equal(t, "more data", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("starts new segments with a header", func() {
+		before := time.Now()
+
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		assert.Equal(t, segmentHeaderSize, segment.Pos())
+		assert.True(t, segment.Empty())
+
+		_, err = segment.Write([]byte("test data"))
+		require.NoError(t, err)
+
+		assert.False(t, segment.Empty())
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		f, err := os.Open(path)
+		require.NoError(t, err)
+
+		defer f.Close()
+
+		hdr, ok, err := readHeader(f)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		assert.Equal(t, byte(headerVersion), hdr.version)
+		assert.False(t, hdr.created.Before(before.Truncate(time.Second)))
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "test data", string(r.Value()))
+	})
+
+	n.It("reads segments written without a header", func() {
+		writeLegacySegment(t, path, "old data")
+
+		f, err := os.Open(path)
+		require.NoError(t, err)
+
+		defer f.Close()
+
+		_, ok, err := readHeader(f)
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "old data", string(r.Value()))
+	})
+
+	n.It("refuses segments written in a newer format", func() {
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		// Rewrite the header as if it came from the future
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+
+		value := data[6:segmentHeaderSize]
+		value[0] = headerVersion + 1
+
+		binary.BigEndian.PutUint32(data[:4], crc32.ChecksumIEEE(data[5:segmentHeaderSize]))
+
+		err = ioutil.WriteFile(path, data, 0644)
+		require.NoError(t, err)
+
+		_, err = NewSegmentReader(path)
+		require.True(t, errors.Is(err, ErrUnsupportedFormat))
+
+		var ufe *UnsupportedFormatError
+		require.True(t, errors.As(err, &ufe))
+		assert.Equal(t, byte(headerVersion+1), ufe.Version)
+
+		_, err = NewSegmentWriter(path)
+		assert.True(t, errors.Is(err, ErrUnsupportedFormat))
+	})
+
+	n.It("reports the format version of a segment", func() {
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		assert.Equal(t, headerVersion, r.Version())
+
+		r.Close()
+
+		writeLegacySegment(t, path, "old data")
+
+		r, err = NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		assert.Equal(t, 0, r.Version())
+	})
+
+	n.It("reads and writes the golden segment format", func() {
+		// The files in testdata pin the on disk format: every integer
+		// is big endian or a uvarint, whatever the host byte order.
+		// golden.seg predates footers, golden-footer.seg is the same
+		// segment closed with a footer holding only the record count,
+		// and golden-last.seg is it as written now, with an epoch in
+		// its header and a footer that also says where the last record
+		// starts.
+		for name, version := range map[string]byte{"golden.seg": 1, "golden-footer.seg": 1, "golden-last.seg": 2} {
+			f, err := os.Open(filepath.Join("testdata", name))
+			require.NoError(t, err)
+
+			hdr, ok, err := readHeader(f)
+			f.Close()
+
+			require.NoError(t, err)
+			require.True(t, ok)
+
+			assert.Equal(t, version, hdr.version, name)
+			assert.Equal(t, int64(1500000000123456789), hdr.created.UnixNano(), name)
+
+			r, err := NewSegmentReader(filepath.Join("testdata", name))
+			require.NoError(t, err)
+
+			require.True(t, r.Next(), name)
+			assert.Equal(t, "golden data", string(r.Value()), name)
+
+			err = r.SeekTag([]byte("commit"))
+			require.NoError(t, err, name)
+
+			require.True(t, r.Next(), name)
+			assert.Equal(t, strings.Repeat("x", 200), string(r.Value()), name)
+
+			assert.False(t, r.Next(), name)
+			require.NoError(t, r.Error(), name)
+
+			r.Close()
+		}
+
+		golden, err := ioutil.ReadFile(filepath.Join("testdata", "golden-last.seg"))
+		require.NoError(t, err)
+
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		_, err = segment.Write([]byte("golden data"))
+		require.NoError(t, err)
+
+		err = segment.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		_, err = segment.Write([]byte(strings.Repeat("x", 200)))
+		require.NoError(t, err)
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		written, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+
+		// The header holds the creation time, so only compare after it.
+		assert.Equal(t, golden[segmentHeaderSize:], written[segmentHeaderSize:])
+	})
+
+	n.It("treats an incomplete final entry as the end of the segment", func() {
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		_, err = segment.Write([]byte("test data"))
+		require.NoError(t, err)
+
+		pos := segment.Pos()
+
+		_, err = segment.Write([]byte("torn data"))
+		require.NoError(t, err)
+
+		end := segment.Pos()
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		full, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+
+		for _, cut := range []int64{pos + 3, pos + 6, end - 1} {
+			err = ioutil.WriteFile(path, full[:cut], 0644)
+			require.NoError(t, err)
+
+			r, err := NewSegmentReader(path)
+			require.NoError(t, err)
+
+			require.True(t, r.Next())
+			assert.Equal(t, "test data", string(r.Value()))
+			assert.False(t, r.Truncated())
+
+			assert.False(t, r.Next())
+			require.NoError(t, r.Error())
+			assert.True(t, r.Truncated())
+			assert.Equal(t, pos, r.Pos())
+
+			// Once the rest of the entry shows up, it can be read
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			require.NoError(t, err)
+
+			_, err = f.Write(full[cut:end])
+			require.NoError(t, err)
+
+			f.Close()
+
+			require.True(t, r.Next())
+			assert.Equal(t, "torn data", string(r.Value()))
+			assert.False(t, r.Truncated())
+
+			r.Close()
+		}
+	})
+
+	n.It("records the number of records in a footer when closed", func() {
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		_, err = segment.Write([]byte("one"))
+		require.NoError(t, err)
+
+		err = segment.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		_, err = segment.Write([]byte("two"))
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(2), segment.Records())
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		_, ok, err := r.Records()
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		r.Close()
+
+		require.NoError(t, segment.Close())
+
+		r, err = NewSegmentReader(path)
+		require.NoError(t, err)
+
+		cnt, ok, err := r.Records()
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, int64(2), cnt)
+
+		r.Close()
+
+		// Reopening picks up the count and where the last record
+		// starts, and replaces the footer.
+		segment, err = NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		two := segmentHeaderSize + entrySize(len("one")) + entrySize(len("commit"))
+
+		assert.Equal(t, int64(2), segment.Records())
+		assert.Equal(t, two, segment.lastStart)
+
+		_, err = segment.Write([]byte("three"))
+		require.NoError(t, err)
+
+		require.NoError(t, segment.Close())
+
+		r, err = NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		cnt, ok, err = r.Records()
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, int64(3), cnt)
+
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+
+		tail, err := readTail(r.f, fi.Size())
+		require.NoError(t, err)
+		require.True(t, tail.hasLast)
+		assert.Equal(t, two+entrySize(len("two")), tail.last)
+
+		var values []string
+
+		for r.Next() {
+			values = append(values, string(r.Value()))
+		}
+
+		require.NoError(t, r.Error())
+		assert.Equal(t, []string{"one", "two", "three"}, values)
+	})
+
+	n.It("has no record count for a segment without a footer", func() {
+		writeLegacySegment(t, path, "one", "two")
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		_, ok, err := r.Records()
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	n.It("checks records against their content hash", func() {
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		good := extendedRecord{hash: contentHash([]byte("data"))}
+
+		_, err = segment.writeType(extendedType, good.encode(nil, []byte("data")))
+		require.NoError(t, err)
+
+		bad := extendedRecord{hash: contentHash([]byte("other"))}
+
+		_, err = segment.writeType(extendedType, bad.encode(nil, []byte("data")))
+		require.NoError(t, err)
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data", string(r.Value()))
+		assert.Equal(t, good.hash, r.ContentHash())
+
+		assert.False(t, r.Next())
+		assert.Equal(t, ErrHashMismatch, r.Error())
+	})
+
+	n.It("removes a partly written entry when the disk is full", func() {
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		_, err = segment.Write([]byte("first"))
+		require.NoError(t, err)
+
+		// Let the entry's header through but only half of its value.
+		writeFile = func(f SegmentFile, b []byte) (int, error) {
+			if len(b) == len("second") {
+				n, _ := f.Write(b[:3])
+				return n, syscall.ENOSPC
+			}
+
+			return f.Write(b)
+		}
+
+		_, err = segment.Write([]byte("second"))
+
+		writeFile = SegmentFile.Write
+
+		assert.True(t, errors.Is(err, ErrNoSpace))
+		assert.True(t, errors.Is(err, syscall.ENOSPC))
+
+		_, err = segment.Write([]byte("third"))
+		require.NoError(t, err)
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "first", string(r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "third", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+		assert.False(t, r.Truncated())
+	})
+
+	n.It("resets a reader to read another segment", func() {
+		other := filepath.Join(dir, "other")
+		defer os.Remove(other)
+
+		for i, p := range []string{path, other} {
+			segment, err := NewSegmentWriter(p)
+			require.NoError(t, err)
+
+			_, err = segment.Write([]byte(strings.Repeat("x", i+1)))
+			require.NoError(t, err)
+
+			err = segment.Close()
+			require.NoError(t, err)
+		}
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "x", string(r.Value()))
+
+		err = r.Reset(filepath.Join(dir, "missing"))
+		assert.True(t, os.IsNotExist(err))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		err = r.Reset(other)
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(0), r.Pos())
+		assert.Nil(t, r.Value())
+
+		require.True(t, r.Next())
+		assert.Equal(t, "xx", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("keeps the epoch a segment was created with", func() {
+		segment, err := openSegmentWriter(nil, path, 7, nil)
+		require.NoError(t, err)
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		segment, err = openSegmentWriter(nil, path, 8, nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(7), segment.epoch)
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		r, err := NewSegmentReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		assert.Equal(t, int64(7), r.epoch)
+	})
+
+	n.It("reports a damaged header along with the segment", func() {
+		path := filepath.Join(dir, "7")
+		defer os.Remove(path)
+
+		for _, off := range []int{4, 10} {
+			os.Remove(path)
+
+			segment, err := NewSegmentWriter(path)
+			require.NoError(t, err)
+
+			_, err = segment.Write([]byte("test data"))
+			require.NoError(t, err)
+
+			err = segment.Close()
+			require.NoError(t, err)
+
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+
+			data[off] ^= 0x40
+
+			err = ioutil.WriteFile(path, data, 0644)
+			require.NoError(t, err)
+
+			_, err = NewSegmentReader(path)
+			require.True(t, errors.Is(err, ErrCorruptHeader), "offset %d: %v", off, err)
+
+			var che *CorruptHeaderError
+			require.True(t, errors.As(err, &che))
+			assert.Equal(t, 7, che.Segment)
+
+			_, err = NewSegmentWriter(path)
+			assert.True(t, errors.Is(err, ErrCorruptHeader))
+		}
+	})
+
+	n.It("reports a header whose type was damaged", func() {
+		segment, err := NewSegmentWriter(path)
+		require.NoError(t, err)
+
+		_, err = segment.Write([]byte("test data"))
+		require.NoError(t, err)
+
+		err = segment.Close()
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+
+		// Any single bit flipped, such as turning it into 'x', and
+		// the types of entries written before headers existed.
+		var types []byte
+
+		for bit := 0; bit < 8; bit++ {
+			types = append(types, headerType^1<<bit)
+		}
+
+		types = append(types, statType, dataType, tagType)
+
+		for _, typ := range types {
+			damaged := append([]byte{}, data...)
+			damaged[4] = typ
+
+			err = ioutil.WriteFile(path, damaged, 0644)
+			require.NoError(t, err)
+
+			_, err = NewSegmentReader(path)
+			assert.True(t, errors.Is(err, ErrCorruptHeader), "type %q: %v", typ, err)
+		}
+	})
+
 	n.Meow()
 }
+
+// writeLegacySegment writes a segment the way it was written before
+// segments had a header.
+func writeLegacySegment(t *testing.T, path string, values ...string) {
+	var buf []byte
+
+	for _, v := range values {
+		var lenBuf [binary.MaxVarintLen64]byte
+
+		l := binary.PutUvarint(lenBuf[:], uint64(len(v)))
+
+		var hdr [5]byte
+
+		binary.BigEndian.PutUint32(hdr[:4], crc32.ChecksumIEEE(append(lenBuf[:l:l], v...)))
+		hdr[4] = dataType
+
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, lenBuf[:l]...)
+		buf = append(buf, v...)
+	}
+
+	buf = append(buf, closingMagic...)
+
+	err := ioutil.WriteFile(path, buf, 0644)
+	require.NoError(t, err)
+}
@@ -0,0 +1,200 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The seq file holds the last sequence written by WriteSeq, in decimal,
+// as of the last rotation. With the sequences in the segments still on
+// disk it gives the last sequence written when the writer is reopened,
+// even once every segment holding one has been pruned.
+const seqFileName = "seq"
+
+// ErrDuplicateSeq is returned by WriteSeq, when DedupBySeq is set, for a
+// sequence that isn't greater than the last one written. Nothing is
+// written, so a producer retrying a write can treat it as success.
+var ErrDuplicateSeq = errors.New("sequence already written")
+
+// WriteSeq writes data as a record with sequence seq, returning its
+// position. Readers return it from Next like any other record, and Seq
+// returns its sequence. With DedupBySeq set, ErrDuplicateSeq is returned
+// if seq isn't greater than the last sequence written.
+func (wal *WALWriter) WriteSeq(seq uint64, data []byte) (Position, error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
+
+	if wal.opts.DedupBySeq && wal.seqSet && seq <= wal.lastSeq {
+		return Position{}, ErrDuplicateSeq
+	}
+
+	// Whether the record is the first in its segment, for the seq
+	// index.
+	var starts bool
+
+	room := func(need int64) error {
+		err := wal.makeRoom(need)
+		starts = wal.segment.Records() == 0
+		return err
+	}
+
+	pos, err := wal.writeWith(data, extendedRecord{seq: seq, sequenced: true}, room)
+	if err != nil {
+		return Position{}, err
+	}
+
+	wal.lastSeq, wal.seqSet = seq, true
+
+	if starts && wal.opts.SeqIndex {
+		return pos, wal.indexSeq(pos, seq)
+	}
+
+	return pos, nil
+}
+
+// Seq returns the sequence of the current record, as written by
+// WriteSeq, and false if it was written without one.
+func (r *WALReader) Seq() (uint64, bool) {
+	if r.seg == nil {
+		return 0, false
+	}
+
+	ext := r.recordExt()
+
+	return ext.seq, ext.sequenced
+}
+
+// loadSeq sets the last sequence written from the seq file and the
+// latest segment holding a record with a sequence.
+func (wal *WALWriter) loadSeq() error {
+	data, err := ioutil.ReadFile(filepath.Join(wal.root, seqFileName))
+	if err == nil {
+		wal.lastSeq, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		wal.seqSet = true
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for i := wal.index; i >= wal.first; i-- {
+		seq, ok, err := lastSegmentSeq(wal.opts.OpenFile, wal.format.path(wal.root, i))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return err
+		}
+
+		if ok {
+			if !wal.seqSet || seq > wal.lastSeq {
+				wal.lastSeq, wal.seqSet = seq, true
+			}
+
+			break
+		}
+	}
+
+	return nil
+}
+
+// lastSegmentSeq returns the sequence of the last record with one in the
+// segment at path, and false if none has one.
+func lastSegmentSeq(open OpenFileFunc, path string) (uint64, bool, error) {
+	seg, err := openSegmentReader(open, path, nil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer seg.Close()
+
+	var (
+		seq uint64
+		ok  bool
+	)
+
+	for {
+		ent, err := seg.readNext()
+		if err != nil {
+			// A segment a crash left partly written holds nothing
+			// past the damage.
+			if err == io.EOF || err == io.ErrUnexpectedEOF || err == ErrCorruptCRC {
+				return seq, ok, nil
+			}
+
+			return 0, false, err
+		}
+
+		if ent.entryType != extendedType {
+			continue
+		}
+
+		ext, _, err := decodeExtended(ent.value)
+		if err == nil && ext.sequenced {
+			seq, ok = ext.seq, true
+		}
+	}
+}
+
+// saveSeq records the last sequence written in the seq file.
+func (wal *WALWriter) saveSeq() error {
+	if !wal.seqSet {
+		return nil
+	}
+
+	return replaceFile(filepath.Join(wal.root, seqFileName), []byte(strconv.FormatUint(wal.lastSeq, 10)+"\n"))
+}
+
+// ErrSeqGap is matched, using errors.Is, by the SeqGapError returned
+// when VerifySeqContiguous is set and records are missing or out of
+// order.
+var ErrSeqGap = errors.New("records are not in sequence")
+
+type SeqGapError struct {
+	// The sequence that should have come next, and the one read.
+	Expected uint64
+	Actual   uint64
+
+	// The position of the record read.
+	Position Position
+}
+
+func (e *SeqGapError) Error() string {
+	return fmt.Sprintf("expected sequence %d but read %d at segment %d offset %d",
+		e.Expected, e.Actual, e.Position.Segment, e.Position.Offset)
+}
+
+func (e *SeqGapError) Is(target error) bool {
+	return target == ErrSeqGap
+}
+
+// checkSeq checks the sequence of the record just read follows the last
+// one, for VerifySeqContiguous.
+func (r *WALReader) checkSeq() bool {
+	seq, ok := r.Seq()
+	if !ok {
+		return true
+	}
+
+	expected := r.lastSeq + 1
+	gap := r.seqSet && seq != expected
+
+	r.lastSeq, r.seqSet = seq, true
+
+	if gap {
+		r.err = &SeqGapError{Expected: expected, Actual: seq, Position: r.start}
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,202 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestSeq(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	opts := DefaultWriteOptions
+	opts.DedupBySeq = true
+
+	n.It("writes records with sequences", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		_, err = wal.WriteSeq(7, []byte("data"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("plain"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data", string(r.Value()))
+
+		seq, ok := r.Seq()
+		assert.True(t, ok)
+		assert.Equal(t, uint64(7), seq)
+
+		require.True(t, r.Next())
+
+		_, ok = r.Seq()
+		assert.False(t, ok)
+	})
+
+	n.It("rejects sequences already written", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		for i := uint64(1); i <= 3; i++ {
+			_, err = wal.WriteSeq(i, []byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		_, err = wal.WriteSeq(2, []byte("again"))
+		assert.Equal(t, ErrDuplicateSeq, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		wal, err = NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		_, err = wal.WriteSeq(3, []byte("again"))
+		assert.Equal(t, ErrDuplicateSeq, err)
+
+		_, err = wal.WriteSeq(4, []byte("data4"))
+		require.NoError(t, err)
+	})
+
+	n.It("remembers the last sequence once its segment is pruned", func() {
+		opts := opts
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 2
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		_, err = wal.WriteSeq(10, []byte("data"))
+		require.NoError(t, err)
+
+		for i := 0; i < 8; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		require.True(t, wal.first > 0)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		wal, err = NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		_, err = wal.WriteSeq(10, []byte("again"))
+		assert.Equal(t, ErrDuplicateSeq, err)
+	})
+
+	n.It("splits records with sequences like any other", func() {
+		opts := opts
+		opts.SegmentSize = segmentHeaderSize + 64
+		opts.MaxSegments = 100
+		opts.SplitLargeRecords = true
+		opts.SeqIndex = true
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		large := fmt.Sprintf("%0100d", 2)
+
+		_, err = wal.WriteSeq(1, []byte("data1"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteSeq(2, []byte(large))
+		require.NoError(t, err)
+
+		_, err = wal.WriteSeq(3, []byte("data3"))
+		require.NoError(t, err)
+
+		require.True(t, wal.index >= 2, "record wasn't split")
+
+		r, err := NewReaderWithOptions(path, ReadOptions{VerifySeqContiguous: true})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for seq, want := range []string{"data1", large, "data3"} {
+			require.True(t, r.Next())
+			assert.Equal(t, want, string(r.Value()))
+
+			got, ok := r.Seq()
+			require.True(t, ok)
+			assert.Equal(t, uint64(seq+1), got)
+		}
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		err = r.SeekSeq(2)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, large, string(r.Value()))
+	})
+
+	n.It("stops readers at a gap in the sequences", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for _, seq := range []uint64{1, 2, 4} {
+			_, err = wal.WriteSeq(seq, []byte(fmt.Sprintf("data%d", seq)))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReaderWithOptions(path, ReadOptions{VerifySeqContiguous: true})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		require.True(t, r.Next())
+
+		next := r.Pos()
+
+		assert.False(t, r.Next())
+		require.True(t, errors.Is(r.Error(), ErrSeqGap))
+
+		var sge *SeqGapError
+		require.True(t, errors.As(r.Error(), &sge))
+
+		assert.Equal(t, uint64(3), sge.Expected)
+		assert.Equal(t, uint64(4), sge.Actual)
+		assert.Equal(t, next, sge.Position)
+	})
+
+	n.Meow()
+}
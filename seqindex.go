@@ -0,0 +1,285 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The seq index file holds a line of JSON for each segment whose first
+// record was written by WriteSeq, giving the sequence of that record and
+// the epoch of the segment, so SeekSeq can find the segment holding a
+// sequence without reading the segments before it. It's rebuilt from the
+// first record of each segment when the writer is opened or the log is
+// truncated, and added to as segments are started, so it also has lines
+// for segments pruned since then. Lines from an earlier epoch are
+// ignored.
+const seqIndexFileName = "seqindex"
+
+type seqIndexEntry struct {
+	Segment int    `json:"segment"`
+	Seq     uint64 `json:"seq"`
+	Epoch   int64  `json:"epoch"`
+}
+
+var ErrSeqNotFound = errors.New("sequence not found")
+
+// openSeqIndex rebuilds the seq index file from the segments on disk,
+// leaving it open for the writer to add to.
+func (wal *WALWriter) openSeqIndex() error {
+	entries, err := buildSeqIndex(wal.opts.OpenFile, wal.root, wal.format, wal.first, wal.index)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+
+	wal.seqIndexed = make(map[int]bool)
+
+	for _, ent := range entries {
+		err = enc.Encode(ent)
+		if err != nil {
+			return err
+		}
+
+		wal.seqIndexed[ent.Segment] = true
+	}
+
+	path := filepath.Join(wal.root, seqIndexFileName)
+
+	err = replaceFile(path, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	wal.seqIndexFile, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	wal.seqIndexEnc = json.NewEncoder(wal.seqIndexFile)
+
+	return nil
+}
+
+// indexSeq adds seq to the seq index as the start of the segment of pos,
+// the first record in it, which was written with seq, unless it's
+// already there.
+func (wal *WALWriter) indexSeq(pos Position, seq uint64) error {
+	if wal.seqIndexed[pos.Segment] {
+		return nil
+	}
+
+	wal.seqIndexed[pos.Segment] = true
+
+	return wal.seqIndexEnc.Encode(seqIndexEntry{pos.Segment, seq, pos.Epoch})
+}
+
+// buildSeqIndex returns the seq index entries for segments first to last
+// of the WAL at root, from the first record of each.
+func buildSeqIndex(open OpenFileFunc, root string, format segmentFormat, first, last int) ([]seqIndexEntry, error) {
+	var entries []seqIndexEntry
+
+	for i := first; i <= last && first != -1; i++ {
+		seq, epoch, ok, err := firstSegmentSeq(open, format.path(root, i))
+		if err != nil {
+			// Merged away, or not created yet.
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		if ok {
+			entries = append(entries, seqIndexEntry{i, seq, epoch})
+		}
+	}
+
+	return entries, nil
+}
+
+// firstSegmentSeq returns the sequence of the first record in the segment
+// at path, and the segment's epoch, and false if it has none or it has no
+// records.
+func firstSegmentSeq(open OpenFileFunc, path string) (uint64, int64, bool, error) {
+	seg, err := openSegmentReader(open, path, nil)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	defer seg.Close()
+
+	for {
+		ent, err := seg.readNext()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF || err == ErrCorruptCRC {
+				return 0, 0, false, nil
+			}
+
+			return 0, 0, false, err
+		}
+
+		switch ent.entryType {
+		case dataType:
+			return 0, 0, false, nil
+		case extendedType:
+			ext, _, err := decodeExtended(ent.value)
+			if err != nil {
+				return 0, 0, false, nil
+			}
+
+			return ext.seq, seg.epoch, ext.sequenced, nil
+		}
+	}
+}
+
+// readSeqIndex returns the entries of the seq index file in root for
+// segments from first on written in epoch, ordered by segment, and false
+// if there's no index file.
+func readSeqIndex(root string, first int, epoch int64) ([]seqIndexEntry, bool, error) {
+	f, err := openFile(filepath.Join(root, seqIndexFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	defer f.Close()
+
+	latest := make(map[int]uint64)
+
+	// A partly written last line is ignored.
+	sc := bufio.NewScanner(f)
+
+	for sc.Scan() {
+		var ent seqIndexEntry
+
+		if json.Unmarshal(sc.Bytes(), &ent) != nil {
+			continue
+		}
+
+		if ent.Segment >= first && ent.Epoch == epoch {
+			latest[ent.Segment] = ent.Seq
+		}
+	}
+
+	if sc.Err() != nil {
+		return nil, false, sc.Err()
+	}
+
+	entries := make([]seqIndexEntry, 0, len(latest))
+
+	for seg, seq := range latest {
+		entries = append(entries, seqIndexEntry{seg, seq, epoch})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Segment < entries[j].Segment
+	})
+
+	return entries, true, nil
+}
+
+// SeekSeq positions the reader at the record written by WriteSeq with
+// sequence seq, so that the next call to Next returns it. Sequences are
+// taken to increase through the log, as DedupBySeq ensures. The segment
+// to start reading from is found in the seq index kept by a writer with
+// the SeqIndex option, or from the first record of every segment if
+// there's no index, and only the records from there on are read.
+// ErrSeqNotFound is returned if no record has seq, leaving the reader
+// after the records read.
+func (r *WALReader) SeekSeq(seq uint64) error {
+	first, last, err := rangeSegments(r.root, r.format)
+	if err != nil {
+		return err
+	}
+
+	if first == -1 {
+		return ErrNoSegments
+	}
+
+	epoch, err := readEpoch(r.root)
+	if err != nil {
+		return err
+	}
+
+	entries, ok, err := readSeqIndex(r.root, first, epoch)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		entries, err = buildSeqIndex(r.opts.OpenFile, r.root, r.format, first, last)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The last segment starting at or before seq.
+	start := first
+
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Seq > seq
+	})
+
+	if i > 0 {
+		start = entries[i-1].Segment
+	}
+
+	err = r.seekSegment(start)
+	if err != nil {
+		return err
+	}
+
+	for r.Next() {
+		n, ok := r.Seq()
+		if !ok || n < seq {
+			continue
+		}
+
+		if n > seq {
+			break
+		}
+
+		return r.seek(r.start, false)
+	}
+
+	err = r.Error()
+	if err != nil {
+		return err
+	}
+
+	return ErrSeqNotFound
+}
+
+// seekSegment moves the reader to the start of segment seg, or the first
+// segment after it if it's been merged away.
+func (r *WALReader) seekSegment(seg int) error {
+	for {
+		err := r.seek(Position{seg, 0, 0}, false)
+		if err == nil || !os.IsNotExist(err) {
+			return err
+		}
+
+		_, last, err := rangeSegments(r.root, r.format)
+		if err != nil {
+			return err
+		}
+
+		if seg >= last {
+			return ErrSeqNotFound
+		}
+
+		seg++
+	}
+}
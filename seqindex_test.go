@@ -0,0 +1,197 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestSeqIndex(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	opts := DefaultWriteOptions
+	opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data00")+3)
+	opts.MaxSegments = 100
+	opts.SeqIndex = true
+
+	write := func(t *testing.T, wal *WALWriter, from, to uint64) {
+		for i := from; i < to; i++ {
+			_, err := wal.WriteSeq(i, []byte(fmt.Sprintf("data%02d", i)))
+			require.NoError(t, err)
+		}
+	}
+
+	n.It("indexes the sequence each segment starts with", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		write(t, wal, 1, 9)
+
+		entries, ok, err := readSeqIndex(path, 0, 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		assert.Equal(t, []seqIndexEntry{{0, 1, 0}, {1, 3, 0}, {2, 5, 0}, {3, 7, 0}}, entries)
+	})
+
+	n.It("seeks to a sequence", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		write(t, wal, 1, 9)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		// Reopening rebuilds the index, which carries on from there.
+		wal, err = NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		write(t, wal, 9, 13)
+
+		var opened []string
+
+		defer func(orig func(string) (*os.File, error)) { openFile = orig }(openFile)
+
+		openFile = func(name string) (*os.File, error) {
+			opened = append(opened, filepath.Base(name))
+			return os.Open(name)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		opened = nil
+
+		err = r.SeekSeq(10)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data10", string(r.Value()))
+
+		// Only the index and the segments from the one holding 10.
+		assert.NotContains(t, opened, filepath.Base(wal.format.path(path, 0)))
+
+		err = r.SeekSeq(20)
+		assert.Equal(t, ErrSeqNotFound, err)
+	})
+
+	n.It("starts the index again when the log is truncated", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		write(t, wal, 1, 11)
+
+		err = wal.TruncateAll()
+		require.NoError(t, err)
+
+		write(t, wal, 100, 110)
+
+		entries, ok, err := readSeqIndex(path, 0, 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		assert.Empty(t, entries)
+
+		entries, _, err = readSeqIndex(path, 0, wal.epoch)
+		require.NoError(t, err)
+
+		require.NotEmpty(t, entries)
+		assert.Equal(t, seqIndexEntry{0, 100, wal.epoch}, entries[0])
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekSeq(104)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data104", string(r.Value()))
+	})
+
+	n.It("ignores index entries from an earlier epoch", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		write(t, wal, 1, 9)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		// As if the index were left over from before the log was
+		// truncated.
+		err = writeEpoch(path, 1)
+		require.NoError(t, err)
+
+		entries, _, err := readSeqIndex(path, 0, 1)
+		require.NoError(t, err)
+
+		assert.Empty(t, entries)
+	})
+
+	n.It("closes the index file when the writer is closed", func() {
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		write(t, wal, 1, 3)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		_, err = wal.seqIndexFile.Write([]byte("\n"))
+		assert.True(t, errors.Is(err, os.ErrClosed))
+	})
+
+	n.It("seeks to a sequence without an index", func() {
+		opts := opts
+		opts.SeqIndex = false
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		write(t, wal, 1, 9)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekSeq(6)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data06", string(r.Value()))
+	})
+
+	n.Meow()
+}
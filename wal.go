@@ -2,20 +2,32 @@ package wal
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"hash/crc32"
 	"io"
+	"iter"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type WriteOptions struct {
-	// The maximum size in bytes of each segment. When it reaches near this size,
-	// a new segment will be created.
+	// The maximum size in bytes of each segment. Before an entry is written,
+	// a new segment is created if the entry would take the current segment
+	// past this size, so a segment may be filled to exactly SegmentSize but
+	// never beyond it. The only exception is an entry that is larger than
+	// SegmentSize on its own, which is written to an otherwise empty segment.
+	// The header at the start of each segment is counted, the footer
+	// and marker written when a segment is closed are not. Rotation
+	// uses the exact size of each entry, see RecordSize, so the most a
+	// segment takes on disk is given by ClosedSegmentSize.
 	SegmentSize int64
 
 	// The maximum number of segments to keep on disk.
@@ -24,14 +36,201 @@ type WriteOptions struct {
 	// The maximum time of segments to keep on disk.
 	SegmentTTL time.Duration
 
+	// If set, segments are never pruned: MaxSegments, SegmentTTL,
+	// MaxRecords and MinSegments are ignored, neither writes nor Prune
+	// remove anything, and BeforePrune is never called. Segments
+	// accumulate until they're removed by something other than the
+	// writer.
+	NoPrune bool
+
+	// The fewest segments SegmentTTL prunes down to, including the one
+	// being written to, so that a log left idle for longer than the TTL
+	// keeps some history. Segments are still pruned as MaxSegments and
+	// MaxRecords require. 0 or 1 lets the TTL prune every segment but
+	// the current one.
+	MinSegments int
+
 	// If 0, sync is done after every write. Otherwise this controls
 	// how often the WAL is sync'd to disk. Setting this can speed
 	// up the WAL by sacrifing safety.
 	SyncRate time.Duration
+
+	// Segment files are named by their index, zero padded to at least
+	// SegmentDigits digits, between SegmentPrefix and SegmentSuffix.
+	// For example a prefix of "seg-", a suffix of ".wal" and 7 digits
+	// gives "seg-0000001.wal". The prefix may not end with a digit,
+	// and the suffix may not contain any. The default is bare numbers.
+	// These only apply to a new WAL, an existing one keeps the naming
+	// its segments already use.
+	SegmentPrefix string
+	SegmentSuffix string
+	SegmentDigits int
+
+	// The maximum number of records to keep on disk. When more than
+	// this are retained, the oldest segments are removed until no more
+	// than MaxRecords remain, though the segment being written to is
+	// always kept. Like the other limits, whichever removes the most
+	// segments wins. 0 means no limit. To know how many records are in
+	// the segments already on disk, opening the WAL reads all of them
+	// when this is set.
+	MaxRecords int64
+
+	// If set, every record is passed through Transform.OnWrite before
+	// it's written. Tags are written as given. Readers of the WAL
+	// should be given the same Transform in their ReadOptions.
+	Transform Transform
+
+	// If set, OnDurable is called once records have been synced to
+	// disk, with the position of the last record the sync covered;
+	// every record before it is durable too. When SyncRate is 0 it's
+	// called before each write returns, otherwise it's called by the
+	// background syncer some time later. It mustn't call back into the
+	// writer.
+	OnDurable func(p Position)
+
+	// If set, a SHA-256 hash of each record is stored along with it, so
+	// readers can return it from ContentHash and check the record
+	// against it when it's read. The hash is of the record as stored,
+	// after any Transform. It adds 33 bytes to every record, and the
+	// time to compute the hash to every write and read.
+	ContentHash bool
+
+	// If set, a watermark file is kept saying how far the WAL has been
+	// synced to disk, updated after each sync. Readers in other
+	// processes can then use ReadDurableOnly to see only what's synced.
+	// It costs writing and renaming a small file on every sync.
+	DurableWatermark bool
+
+	// If set, a record too large to fit in a segment of SegmentSize is
+	// split into chunks, each written as an entry of its own filling a
+	// segment, rather than being written to an oversized segment. Next
+	// reassembles the chunks, so the record is read back whole from the
+	// position of its first chunk, and Tail and SeekFromEnd count it
+	// once. Segmented, which reads segments independently, returns the
+	// chunks as separate records. Any record can be split other than
+	// one written by WriteGroup, and the first chunk carries the
+	// record's key, sequence or expiry. MaxSegments should allow for the
+	// segments the largest record takes, or the start of it may be
+	// pruned.
+	SplitLargeRecords bool
+
+	// If set, BeforePrune is called with the index of each segment
+	// before it's removed by pruning, oldest first, such as to archive
+	// it first. If it returns an error the segment is kept, along with
+	// every newer one, and pruning is tried again, calling BeforePrune
+	// again, on the next write. It's called with the WAL locked, so it
+	// holds up writes while it runs and mustn't call back into the
+	// writer, though it may read the segment.
+	BeforePrune func(segment int) error
+
+	// If set, opening the writer scans every segment for tags and
+	// rebuilds the tags cache from what it finds, so the cache holds
+	// the latest position of every tag still on disk from the moment
+	// the writer is open. Otherwise the cache starts out empty and
+	// readers scan the log for tags written before the writer was
+	// opened. It costs reading every segment on open.
+	ReconcileTagsOnOpen bool
+
+	// If set, the writer checks itself as it goes, for catching bugs
+	// in tests: every record and checkpoint written, other than by
+	// WriteGroup, is read back and compared with what was written, and
+	// after every rotation and prune the segments on disk are checked
+	// against those the writer thinks it has. A failed check returns an
+	// error wrapping ErrInconsistent describing it. The checks are
+	// slow, and aren't meant to be used in production.
+	Paranoid bool
+
+	// If set, segment files are opened with OpenFile rather than
+	// os.OpenFile, see OpenFileFunc. It's used for every segment the
+	// writer reads or writes, including when merging and compacting,
+	// but the segments must still be files in the WAL's directory.
+	OpenFile OpenFileFunc
+
+	// If set, WriteSeq returns ErrDuplicateSeq rather than writing a
+	// record whose sequence isn't greater than the last one written,
+	// so a producer that retries writes doesn't write a record twice.
+	// The last sequence is found again when the writer is reopened.
+	DedupBySeq bool
+
+	// If set, the writer keeps an index of the sequence each segment
+	// starts with, when its first record is written by WriteSeq, so
+	// SeekSeq can go straight to the segment holding a sequence. The
+	// index is rebuilt when the writer is opened, from the first
+	// record of each segment.
+	SeqIndex bool
+
+	// The most tags the tags cache holds. When a tag would take it
+	// past MaxTags, the tags with the oldest positions are dropped from
+	// the cache until it's back to MaxTags, bounding both the memory it
+	// takes and the size of the tags file. The tag entries themselves
+	// stay in the segments, so SeekTag still finds an evicted tag by
+	// scanning the log. 0 means no limit.
+	MaxTags int
+
+	// If set, each record stores a SHA-256 hash of itself and the hash
+	// stored with the record before it, chaining every record to all
+	// those written before it, so changing, removing or reordering any
+	// record breaks the chain from there on, which VerifyChain finds.
+	// The chain starts from ChainGenesis, or 32 zero bytes if it's
+	// empty. It adds 33 bytes to every record. Once a WAL is written
+	// with HashChain it should always be, as a record without a hash
+	// breaks the chain.
+	HashChain    bool
+	ChainGenesis []byte
+
+	// How writes and syncs of segments are retried after errors that
+	// may be transient. They hold up other writes while they wait.
+	// The default doesn't retry, see RetryPolicy.
+	RetryPolicy RetryPolicy
+}
+
+// Transform rewrites records as they are written and read, such as to
+// add an envelope to every record in one place. OnRead must undo
+// OnWrite. Transforms operate on whole records: OnWrite is applied
+// before a record is framed and OnRead after it's been read and its
+// checksum verified, so any byte level encoding of segments is always
+// applied to the output of OnWrite.
+type Transform interface {
+	OnWrite(record []byte) []byte
+	OnRead(record []byte) []byte
 }
 
+// MaxSegmentSize is the segment size used by the default options and
+// by CalculateFromTotal. It isn't a limit: SegmentSize may be larger,
+// and a single record may be larger than either, in which case it's
+// written to a segment of its own.
 const MaxSegmentSize = 16 * (1024 * 1024)
 
+// RecordSize returns the exact number of bytes a record of n bytes takes
+// in a segment with these options, as counted against SegmentSize when
+// deciding whether to rotate: the entry's framing, the record, and its
+// hashes if ContentHash or HashChain are set. n is the size of the record after any
+// Transform. Records split by SplitLargeRecords take this for each chunk.
+func (wo WriteOptions) RecordSize(n int) int64 {
+	if wo.ContentHash || wo.HashChain {
+		// The extended record's flags.
+		n++
+	}
+
+	if wo.ContentHash {
+		n += sha256.Size
+	}
+
+	if wo.HashChain {
+		n += sha256.Size
+	}
+
+	return entrySize(n)
+}
+
+// ClosedSegmentSize returns the most bytes a segment takes on disk once
+// it's closed, unless it holds a single record larger than SegmentSize:
+// SegmentSize, plus the footer and closing marker added when it's
+// closed, plus the entry Seal adds to the last segment.
+func (wo WriteOptions) ClosedSegmentSize() int64 {
+	return wo.SegmentSize + footerSize + int64(len(closingMagic)) + int64(len(sealMarker))
+}
+
 // Defaults to using 160MB of disk
 var DefaultWriteOptions = WriteOptions{
 	SegmentSize: MaxSegmentSize,
@@ -67,8 +266,74 @@ func (wo *WriteOptions) CalculateFromTotal(total int64) {
 	}
 }
 
+// EstimateRetention estimates how long the WAL retains data and how much
+// disk it uses at most, given records of avgRecordBytes written at a rate
+// of writesPerSec. The window is the span of data that's always retained:
+// right after a rotation, MaxSegments-1 full segments are kept alongside
+// the new one, further limited by SegmentTTL if set. The disk usage is
+// the peak just before a rotation, when MaxSegments segments are full,
+// including their headers, footers and closing markers. If writesPerSec
+// isn't positive, the window is 0.
+func (wo WriteOptions) EstimateRetention(avgRecordBytes int, writesPerSec float64) (window time.Duration, diskBytes int64) {
+	perRecord := wo.RecordSize(avgRecordBytes)
+
+	// A record too big for a segment gets one to itself.
+	perSegment := (wo.SegmentSize - segmentHeaderSize) / perRecord
+	if perSegment < 1 {
+		perSegment = 1
+	}
+
+	segmentBytes := segmentHeaderSize + perSegment*perRecord + footerSize + int64(len(closingMagic))
+
+	segments := int64(wo.MaxSegments)
+	if segments < 1 {
+		segments = 1
+	}
+
+	if writesPerSec > 0 {
+		secs := float64((segments-1)*perSegment) / writesPerSec
+		window = time.Duration(secs * float64(time.Second))
+
+		if wo.SegmentTTL > 0 {
+			if wo.SegmentTTL < window {
+				window = wo.SegmentTTL
+			}
+
+			// Segments older than the TTL are removed, so fewer than
+			// MaxSegments may ever exist at once.
+			fill := float64(perSegment) / writesPerSec
+			live := int64(wo.SegmentTTL.Seconds()/fill) + 2
+			if live < segments {
+				segments = live
+			}
+		}
+	}
+
+	return window, segments * segmentBytes
+}
+
 type tagCache struct {
 	Tags map[string]Position `json:"tags"`
+
+	// The CRC of the JSON encoding of Tags, so a damaged cache can be
+	// told apart from one that's merely out of date.
+	CRC uint32 `json:"crc"`
+}
+
+// tagsCRC returns the checksum of tags stored in a tagCache.
+func tagsCRC(tags map[string]Position) (uint32, error) {
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return 0, err
+	}
+
+	return crc32.ChecksumIEEE(data), nil
+}
+
+// valid reports whether the cache matches its checksum.
+func (c *tagCache) valid() bool {
+	crc, err := tagsCRC(c.Tags)
+	return err == nil && crc == c.CRC
 }
 
 type WALWriter struct {
@@ -77,26 +342,116 @@ type WALWriter struct {
 	lock    sync.Mutex
 	root    string
 	current string
+	format  segmentFormat
 
 	first int
 	index int
 
+	// The epoch of the WAL, given to the segments it creates.
+	epoch int64
+
 	segment *SegmentWriter
 
+	// Set when a rotation happened without pruning, so the next
+	// write catches up, or when BeforePrune stopped pruning.
+	prunePending bool
+	vetoed       bool
+
+	// The number of records in each segment other than the current
+	// one, used for MaxRecords.
+	counts map[int]int64
+
+	// The position of the last record written, see LastPos.
+	lastPos Position
+
+	// The last sequence written by WriteSeq, if seqSet.
+	lastSeq uint64
+	seqSet  bool
+
+	// The seq index, see SeqIndex, and the segments in it.
+	seqIndexFile *os.File
+	seqIndexEnc  *json.Encoder
+	seqIndexed   map[int]bool
+
+	// The hash of the last record in the hash chain, see HashChain.
+	chain []byte
+
 	cache     tagCache
 	cacheFile *os.File
 	cacheEnc  *json.Encoder
+
+	// The latest position of each key written, see WriteKeyed.
+	keys       map[string]Position
+	keysFile   *os.File
+	keysEnc    *json.Encoder
+	keysLogged int
+
+	sealed bool
+
+	// Set once the writer has been released, see Release.
+	released bool
+
+	// The first fatal error, see Err. It has its own lock because
+	// it's set by the background syncer.
+	errLock sync.Mutex
+	err     error
+
+	stats *syncStats
+
+	// Closed to wake readers created by NewReader when something is
+	// written, see wake.
+	written chan struct{}
+
+	// The channels returned by Notify, and whether they've been closed
+	// by Close.
+	notify       []chan struct{}
+	notifyClosed bool
+
+	// Where durable entries end, as last written to the watermark file.
+	// It has its own lock because it's set by the background syncer.
+	markLock sync.Mutex
+	durable  Position
 }
 
-func rangeSegments(path string) (int, int, error) {
+// readDirNames lists the names of the files in path, in no particular
+// order. It's a variable so tests can substitute their own listing.
+var readDirNames = func(path string) ([]string, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 
 	defer f.Close()
 
-	files, err := f.Readdirnames(-1)
+	return f.Readdirnames(-1)
+}
+
+// sortedSegments returns the indexes of the segments in path named using
+// format in ascending order, whatever order the filesystem lists them in.
+func sortedSegments(path string, format segmentFormat) ([]int, error) {
+	files, err := readDirNames(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+
+	for _, file := range files {
+		i, ok := format.parse(file)
+		if ok {
+			segments = append(segments, i)
+		}
+	}
+
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+// rangeSegments returns the lowest and highest index of the segments
+// in path named using format, or -1 for both if there are none.
+func rangeSegments(path string, format segmentFormat) (int, int, error) {
+	files, err := readDirNames(path)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -107,8 +462,8 @@ func rangeSegments(path string) (int, int, error) {
 	)
 
 	for _, file := range files {
-		i, err := strconv.Atoi(file)
-		if err == nil {
+		i, ok := format.parse(file)
+		if ok {
 			if first == -1 || i < first {
 				first = i
 			}
@@ -122,6 +477,22 @@ func rangeSegments(path string) (int, int, error) {
 	return first, last, nil
 }
 
+// existingFormat returns the naming format used by the segments already
+// in path, or def if there aren't any.
+func existingFormat(path string, def segmentFormat) (segmentFormat, error) {
+	files, err := readDirNames(path)
+	if err != nil {
+		return def, err
+	}
+
+	format, ok := detectFormat(files)
+	if !ok {
+		return def, nil
+	}
+
+	return format, nil
+}
+
 func New(root string) (*WALWriter, error) {
 	return NewWithOptions(root, DefaultWriteOptions)
 }
@@ -134,7 +505,24 @@ func NewWithOptions(root string, opts WriteOptions) (*WALWriter, error) {
 		}
 	}
 
-	first, last, err := rangeSegments(root)
+	format, err := newSegmentFormat(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Segments that already exist keep their naming, regardless of
+	// what the options ask for.
+	format, err = existingFormat(root, format)
+	if err != nil {
+		return nil, err
+	}
+
+	err = finishMerge(root, format)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last, err := rangeSegments(root, format)
 	if err != nil {
 		return nil, err
 	}
@@ -147,6 +535,15 @@ func NewWithOptions(root string, opts WriteOptions) (*WALWriter, error) {
 		first = 0
 	}
 
+	sealed, err := segmentSealed(opts.OpenFile, format.path(root, last))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if sealed {
+		return nil, ErrSealed
+	}
+
 	cache, err := os.Create(filepath.Join(root, "tags"))
 	if err != nil {
 		return nil, err
@@ -154,47 +551,238 @@ func NewWithOptions(root string, opts WriteOptions) (*WALWriter, error) {
 
 	wal := &WALWriter{
 		root:      root,
-		current:   filepath.Join(root, fmt.Sprintf("%d", last)),
+		current:   format.path(root, last),
 		first:     first,
 		index:     last,
 		opts:      opts,
+		format:    format,
 		cacheFile: cache,
 		cacheEnc:  json.NewEncoder(cache),
+		keys:      make(map[string]Position),
+		stats:     new(syncStats),
+		durable:   Position{-1, -1, 0},
+	}
+
+	err = wal.openKeysFile()
+	if err != nil {
+		cache.Close()
+		return nil, err
+	}
+
+	// Set once the writer is ready, until then any error closes the
+	// files opened along the way.
+	opened := false
+
+	defer func() {
+		if !opened {
+			wal.closeFiles()
+		}
+	}()
+
+	wal.epoch, err = readEpoch(root)
+	if err != nil {
+		return nil, err
+	}
+
+	wal.lastPos, err = lastPosition(opts.OpenFile, root, format, first, last)
+	if err != nil && err != ErrNoSegments {
+		return nil, err
 	}
 
 	wal.cache.Tags = make(map[string]Position)
 
-	seg, err := NewSegmentWriter(wal.current)
+	wal.counts = make(map[int]int64)
+
+	if opts.MaxRecords > 0 {
+		for i := first; i <= last; i++ {
+			cnt, err := countRecords(opts.OpenFile, format.path(root, i))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+
+			wal.counts[i] = cnt
+		}
+	}
+
+	if opts.ReconcileTagsOnOpen {
+		err = wal.reconcileTags()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DedupBySeq {
+		err = wal.loadSeq()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.SeqIndex {
+		err = wal.openSeqIndex()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.HashChain {
+		err = wal.loadChain()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seg, err := wal.openSegment(wal.current)
 	if err != nil {
 		return nil, err
 	}
 
+	// The count for the current segment is kept by the segment itself,
+	// which reads it from the footer if it has one.
+	if cnt, ok := wal.counts[last]; ok {
+		seg.records = cnt
+		delete(wal.counts, last)
+	}
+
 	wal.segment = seg
+	opened = true
+
+	return wal, nil
+}
+
+// reconcileTags rebuilds the tags cache from the tag entries in the
+// segments on disk, keeping the latest position of each tag.
+func (wal *WALWriter) reconcileTags() error {
+	for i := wal.first; i <= wal.index; i++ {
+		seg, err := openSegmentReader(wal.opts.OpenFile, wal.format.path(wal.root, i), nil)
+		if err != nil {
+			// Merged segments leave holes, and the current segment
+			// may not have been created yet.
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return err
+		}
+
+		for {
+			start := seg.Pos()
+
+			ent, err := seg.readNext()
+			if err != nil {
+				seg.Close()
+
+				// A segment a crash left partly written holds no
+				// tags past the damage.
+				if err == io.EOF || err == io.ErrUnexpectedEOF || err == ErrCorruptCRC {
+					break
+				}
+
+				return err
+			}
 
-	if opts.SyncRate > 0 {
-		seg.SetSyncRate(opts.SyncRate)
+			if ent.entryType == tagType {
+				wal.cache.Tags[string(ent.value)] = Position{i, start, seg.epoch}
+			}
+		}
 	}
 
-	return wal, nil
+	return wal.flushTagsFile()
+}
+
+// countRecords returns the number of records in the segment at path,
+// from its footer if it has one or by reading it if not.
+func countRecords(open OpenFileFunc, path string) (int64, error) {
+	seg, err := openSegmentReader(open, path, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer seg.Close()
+
+	cnt, ok, err := seg.Records()
+	if err != nil || ok {
+		return cnt, err
+	}
+
+	for seg.Next() {
+		cnt++
+	}
+
+	return cnt, seg.Error()
+}
+
+// openSegment opens the segment at path for writing, configured to
+// match the options.
+func (wal *WALWriter) openSegment(path string) (*SegmentWriter, error) {
+	seg, err := openSegmentWriter(wal.opts.OpenFile, path, wal.epoch, wal.stats)
+	if err != nil {
+		return nil, err
+	}
+
+	seg.onError = wal.fail
+	seg.retry = wal.opts.RetryPolicy
+
+	if wal.opts.OnDurable != nil || wal.opts.DurableWatermark {
+		idx, epoch := wal.index, seg.epoch
+		seg.onDurable = func(last, end int64) {
+			if last >= 0 && wal.opts.OnDurable != nil {
+				wal.opts.OnDurable(Position{idx, last, epoch})
+			}
+
+			if wal.opts.DurableWatermark {
+				wal.markDurable(Position{idx, end, epoch})
+			}
+		}
+	}
+
+	if wal.opts.SyncRate > 0 {
+		seg.SetSyncRate(wal.opts.SyncRate)
+	}
+
+	return seg, nil
 }
 
+// rotateSegment moves writing on to a new segment. The old segment is
+// synced and closed before anything is written to the next, so nothing
+// in the next becomes durable ahead of it.
 func (wal *WALWriter) rotateSegment() error {
+	wal.counts[wal.index] = wal.segment.records
+
 	err := wal.segment.Close()
 	if err != nil {
+		wal.fail(err)
 		return err
 	}
 
 	wal.index++
 
-	wal.current = filepath.Join(wal.root, fmt.Sprintf("%d", wal.index))
+	wal.current = wal.format.path(wal.root, wal.index)
 
-	seg, err := NewSegmentWriter(wal.current)
+	seg, err := wal.openSegment(wal.current)
 	if err != nil {
+		// There's no segment to write to any more.
+		wal.fail(err)
 		return err
 	}
 
 	wal.segment = seg
 
+	// The sequences in the old segment may be pruned from here on.
+	if wal.opts.DedupBySeq {
+		err = wal.saveSeq()
+		if err != nil {
+			return err
+		}
+	}
+
+	if wal.opts.Paranoid {
+		return wal.checkSegments()
+	}
+
 	return nil
 }
 
@@ -205,8 +793,14 @@ func (wal *WALWriter) pruneSegments(total int, expiration time.Time) error {
 	}
 
 	if !expiration.IsZero() {
-		for ; startAt < wal.index; startAt++ {
-			filePath := filepath.Join(wal.root, fmt.Sprintf("%d", startAt))
+		// Expired segments are only pruned down to MinSegments.
+		floor := wal.index
+		if wal.opts.MinSegments > 1 {
+			floor = wal.index - wal.opts.MinSegments + 1
+		}
+
+		for ; startAt < floor; startAt++ {
+			filePath := wal.format.path(wal.root, startAt)
 			stat, err := os.Stat(filePath)
 			if err != nil {
 				if !os.IsNotExist(err) {
@@ -220,14 +814,26 @@ func (wal *WALWriter) pruneSegments(total int, expiration time.Time) error {
 		}
 	}
 
+	// Oldest first, so that if BeforePrune stops pruning part way the
+	// segments that remain are still contiguous.
 	pruned := false
-	for i := startAt - 1; i >= wal.first; i-- {
-		err := os.Remove(filepath.Join(wal.root, fmt.Sprintf("%d", i)))
+	for i := wal.first; i < startAt; i++ {
+		if wal.opts.BeforePrune != nil {
+			if wal.opts.BeforePrune(i) != nil {
+				// Try again on the next write.
+				startAt = i
+				wal.vetoed = true
+				break
+			}
+		}
+
+		err := os.Remove(wal.format.path(wal.root, i))
 		if err != nil {
 			if !os.IsNotExist(err) {
 				return err
 			}
 		}
+		delete(wal.counts, i)
 		pruned = true
 	}
 
@@ -253,309 +859,3487 @@ func (wal *WALWriter) pruneSegments(total int, expiration time.Time) error {
 	return nil
 }
 
-const averageOverhead = 4 + 1 + 2
+// makeRoom rotates to a new segment, pruning old ones, if need more bytes
+// would not fit in the current segment. It must be called with the lock
+// held and before the position of the entries is taken.
+func (wal *WALWriter) makeRoom(need int64) error {
+	err := wal.rotateIfFull(need)
+	if err != nil {
+		return err
+	}
+
+	if wal.prunePending {
+		return wal.prune()
+	}
 
-func (wal *WALWriter) Write(data []byte) error {
-	wal.lock.Lock()
-	defer wal.lock.Unlock()
+	return nil
+}
+
+// rotateIfFull rotates to a new segment if need more bytes would not fit
+// in the current segment. Pruning is left pending.
+func (wal *WALWriter) rotateIfFull(need int64) error {
+	// Every write passes through here first.
+	if wal.sealed {
+		return ErrSealed
+	}
+
+	err := wal.Err()
+	if err != nil {
+		return err
+	}
 
-	newSize := int64(len(data)) + averageOverhead + wal.segment.Size()
+	newSize := wal.segment.Size() + need
 
-	if newSize > wal.opts.SegmentSize {
+	if !wal.segment.Empty() && newSize > wal.opts.SegmentSize {
 		err := wal.rotateSegment()
 		if err != nil {
 			return err
 		}
 
-		var expiration time.Time
-		if wal.opts.SegmentTTL != 0 {
-			expiration = time.Now().Add(-wal.opts.SegmentTTL)
-		}
-		err = wal.pruneSegments(wal.opts.MaxSegments, expiration)
-		if err != nil {
-			return err
-		}
+		wal.prunePending = true
 	}
 
-	_, err := wal.segment.Write(data)
-	return err
-}
-
-type Position struct {
-	Segment int   `json:"segment"`
-	Offset  int64 `json:"offset"`
-}
-
-func (p *Position) None() bool {
-	return p.Segment == -1
+	return nil
 }
 
-func (wal *WALWriter) Pos() (Position, error) {
+// Rotate moves writing on to a new segment straight away, as if the
+// current one were full, even if nothing has been written to it. As with
+// any rotation, old segments are pruned by the next write, or by Prune.
+// It lets rotation be driven directly, such as in tests of code built on
+// the WAL, without writing enough data to fill a segment.
+func (wal *WALWriter) Rotate() error {
 	wal.lock.Lock()
 	defer wal.lock.Unlock()
+	defer wal.wake()
 
-	pos := wal.segment.Pos()
-
-	return Position{wal.index, pos}, nil
-}
+	if wal.sealed {
+		return ErrSealed
+	}
 
-func (wal *WALWriter) flushTagsFile() error {
-	err := wal.cacheFile.Truncate(0)
+	err := wal.Err()
 	if err != nil {
 		return err
 	}
-	_, err = wal.cacheFile.Seek(0, os.SEEK_SET)
-	if err != nil {
-		return err
-	}
-	err = wal.cacheEnc.Encode(&wal.cache)
+
+	err = wal.rotateSegment()
 	if err != nil {
 		return err
 	}
 
-	return wal.cacheFile.Sync()
+	wal.prunePending = true
+
+	return nil
 }
 
-func (wal *WALWriter) WriteTag(tag []byte) error {
+// Prune removes the segments no longer retained according to the
+// options straight away, rather than waiting for the next write.
+func (wal *WALWriter) Prune() error {
 	wal.lock.Lock()
 	defer wal.lock.Unlock()
 
-	// We truncate the cache and rewrite it after the segment
-	// has confirmed the tag so the cache is either absent
-	// or correct, never present but out of date.
+	if wal.sealed {
+		return ErrSealed
+	}
 
-	segPos := wal.segment.Pos()
+	return wal.prune()
+}
+
+// prune removes the segments that are no longer retained according to
+// MaxSegments and SegmentTTL.
+func (wal *WALWriter) prune() error {
+	if wal.opts.NoPrune {
+		wal.prunePending = false
+		return nil
+	}
+
+	var expiration time.Time
+	if wal.opts.SegmentTTL != 0 {
+		expiration = time.Now().Add(-wal.opts.SegmentTTL)
+	}
 
-	err := wal.segment.WriteTag(tag)
+	total := wal.opts.MaxSegments
+
+	if wal.opts.MaxRecords > 0 {
+		keep := wal.keepForRecords()
+		if keep < total {
+			total = keep
+		}
+	}
+
+	wal.vetoed = false
+
+	err := wal.pruneSegments(total, expiration)
 	if err != nil {
 		return err
 	}
-	wal.cache.Tags[string(tag)] = Position{wal.index, segPos}
 
-	return wal.flushTagsFile()
-}
+	wal.prunePending = wal.vetoed
 
-func (wal *WALWriter) Close() error {
-	return wal.segment.Close()
+	if wal.opts.Paranoid {
+		return wal.checkSegments()
+	}
+
+	return nil
 }
 
-type WALReader struct {
-	root    string
-	current string
+// keepForRecords returns how many of the newest segments can be kept
+// without retaining more than MaxRecords records. The current segment is
+// always kept.
+func (wal *WALWriter) keepForRecords() int {
+	sum := wal.segment.records
+	keep := 1
 
-	first int
-	last  int
-	index int
+	for i := wal.index - 1; i >= wal.first; i-- {
+		sum += wal.counts[i]
+		if sum > wal.opts.MaxRecords {
+			break
+		}
 
-	seg *SegmentReader
+		keep++
+	}
 
-	err error
+	return keep
 }
 
-var ErrNoSegments = errors.New("no segments")
+// transform returns data as it should be written.
+func (wal *WALWriter) transform(data []byte) []byte {
+	if wal.opts.Transform == nil {
+		return data
+	}
 
-func NewReader(root string) (*WALReader, error) {
-	r := &WALReader{root: root}
+	return wal.opts.Transform.OnWrite(data)
+}
 
-	err := r.Reset()
-	if err != nil {
-		return nil, err
-	}
+func (wal *WALWriter) Write(data []byte) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
 
-	return r, nil
+	_, err := wal.write(data)
+	return err
 }
 
-func (wal *WALReader) Reset() error {
-	if wal.seg != nil {
-		wal.seg.Close()
-	}
+// record returns the type and value of the entry that stores data:
+// data transformed, and with its hash if ContentHash is set.
+func (wal *WALWriter) record(data []byte) (byte, []byte) {
+	return wal.encode(wal.transform(data), extendedRecord{})
+}
 
-	first, last, err := rangeSegments(wal.root)
-	if err != nil {
-		return err
+// encode returns the type and value of the entry that stores data, which
+// has already been transformed, with the fields in ext and its hash if
+// ContentHash is set. With HashChain set, room is left for the chain,
+// which writeEntry fills in.
+func (wal *WALWriter) encode(data []byte, ext extendedRecord) (byte, []byte) {
+	if wal.opts.ContentHash {
+		ext.hash = contentHash(data)
 	}
 
-	if first == -1 {
-		return ErrNoSegments
+	if wal.opts.HashChain {
+		ext.chain = make([]byte, sha256.Size)
 	}
 
-	cur := filepath.Join(wal.root, fmt.Sprintf("%d", first))
-
-	r, err := NewSegmentReader(cur)
-	if err != nil {
-		return err
+	if ext.empty() {
+		return dataType, data
 	}
 
-	wal.current = cur
-	wal.first = first
-	wal.last = last
-	wal.index = first
-	wal.seg = r
+	return extendedType, ext.encode(nil, data)
+}
 
-	return nil
+// write writes data as a record, returning its position. It must be
+// called with the lock held.
+func (wal *WALWriter) write(data []byte) (Position, error) {
+	return wal.writeWith(data, extendedRecord{}, wal.makeRoom)
 }
 
-func (wal *WALReader) Pos() Position {
-	if wal.err != nil || wal.seg == nil {
-		return Position{-1, -1}
+// writeWith writes data as a record with the fields in ext using room to
+// make room for each entry written, splitting it into chunks if it's too
+// large for a segment and SplitLargeRecords is set. Every method writing
+// a record goes through it.
+func (wal *WALWriter) writeWith(data []byte, ext extendedRecord, room func(int64) error) (Position, error) {
+	pos, err := wal.writeRecord(wal.transform(data), ext, room)
+	if err != nil || !wal.opts.Paranoid {
+		return pos, err
 	}
-	return Position{wal.index, wal.seg.Pos()}
+
+	return pos, wal.checkRecord(pos, data)
 }
 
-func (wal *WALReader) Seek(p Position) error {
-	if p.Segment == wal.index && wal.seg != nil {
-		return wal.seg.Seek(p.Offset)
+// writeRecord writes data, which has already been transformed, for
+// writeWith.
+func (wal *WALWriter) writeRecord(data []byte, ext extendedRecord, room func(int64) error) (Position, error) {
+	if wal.opts.SplitLargeRecords {
+		size := wal.chunkSize(ext)
+		if size > 0 && len(data) > size {
+			return wal.writeChunks(data, ext, size, room)
+		}
 	}
-	path := filepath.Join(wal.root, fmt.Sprintf("%d", p.Segment))
 
-	seg, err := NewSegmentReader(path)
+	typ, value := wal.encode(data, ext)
+
+	pos, err := wal.writeValue(typ, value, room)
 	if err != nil {
-		return err
+		return Position{}, err
 	}
 
-	err = seg.Seek(p.Offset)
+	wal.lastPos = pos
+
+	return pos, nil
+}
+
+// writeValue writes an entry of type typ with value, using room to make
+// room for it, and returns its position.
+func (wal *WALWriter) writeValue(typ byte, value []byte, room func(int64) error) (Position, error) {
+	err := room(entrySize(len(value)))
 	if err != nil {
-		return err
+		return Position{}, err
 	}
 
-	if wal.seg != nil {
-		wal.seg.Close()
-	}
+	pos := Position{wal.index, wal.segment.Pos(), wal.segment.epoch}
 
-	wal.index = p.Segment
-	wal.seg = seg
+	err = wal.writeEntry(typ, value)
+	if err != nil {
+		return Position{}, err
+	}
 
-	return nil
+	return pos, nil
 }
 
-func (wal *WALReader) SeekLast() error {
-	p1 := Position{
-		Segment: -1,
-		Offset:  -1,
+// chunkSize returns the most data a chunk of a split record with the
+// fields in ext can hold and still fit in a segment, or 0 if segments
+// are too small to hold any, allowing for the header of the segment and
+// the chunk's entry.
+func (wal *WALWriter) chunkSize(ext extendedRecord) int {
+	size := wal.opts.SegmentSize - segmentHeaderSize - 5 - binary.MaxVarintLen64
+
+	// The flags, the largest chunk number, and the hash.
+	size -= 1 + binary.MaxVarintLen64
+	if wal.opts.ContentHash {
+		size -= sha256.Size
 	}
-	p2 := Position{
-		Segment: wal.last,
-		Offset:  0,
+
+	// The fields the first chunk carries for the whole record.
+	if ext.key != nil {
+		size -= int64(uvarintLen(uint64(len(ext.key))) + len(ext.key))
 	}
-	err := wal.Seek(p2)
-	if err != nil {
-		return err
+
+	if ext.expires != 0 {
+		size -= 8
 	}
-	for wal.Next() {
-		p1 = p2
-		p2 = wal.Pos()
+
+	if ext.sequenced {
+		size -= binary.MaxVarintLen64
 	}
-	err = wal.Error()
-	if err != nil {
-		return err
+
+	if wal.opts.HashChain {
+		size -= sha256.Size
 	}
-	if p1.None() {
-		return ErrNoSegments
+
+	if size <= 0 {
+		return 0
 	}
-	return wal.Seek(p1)
+
+	return int(size)
 }
 
-func (wal *WALReader) SeekTag(tag []byte) error {
-	cacheFile, err := os.Open(filepath.Join(wal.root, "tags"))
-	if err == nil {
-		defer cacheFile.Close()
-		var cache tagCache
-		err = json.NewDecoder(cacheFile).Decode(&cache)
+// writeChunks writes data as a series of chunks of at most size bytes,
+// returning the position of the first. Only the first chunk carries the
+// fields in ext, and only it is written using room: later ones only
+// rotate, so that the start of the record isn't pruned while the rest of
+// it is written.
+func (wal *WALWriter) writeChunks(data []byte, ext extendedRecord, size int, room func(int64) error) (Position, error) {
+	var first Position
+
+	for i := 0; len(data) > 0; i++ {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+
+		chunk := extendedRecord{}
+		if i == 0 {
+			chunk = ext
+		}
+
+		chunk.chunked = true
+		chunk.chunk = uint64(i)
+		chunk.more = n < len(data)
+
+		typ, value := wal.encode(data[:n], chunk)
+
+		var err error
+
+		if i == 0 {
+			err = room(entrySize(len(value)))
+		} else {
+			err = wal.rotateIfFull(entrySize(len(value)))
+		}
+
 		if err != nil {
-			return err
+			return Position{}, err
 		}
-		if pos, found := cache.Tags[string(tag)]; found {
-			err = wal.Seek(pos)
-			if err != nil {
-				return err
-			}
-			if wal.next(tagType) {
-				if bytes.Equal(wal.Value(), tag) {
-					return nil
-				}
-			}
-			goto eof
+
+		pos := Position{wal.index, wal.segment.Pos(), wal.segment.epoch}
+		if i == 0 {
+			first = pos
 		}
-	} else {
-		// TODO: warning
+
+		err = wal.writeEntry(typ, value)
+		if err != nil {
+			return Position{}, err
+		}
+
+		data = data[n:]
 	}
 
-	for wal.next(tagType) {
-		if bytes.Equal(wal.Value(), tag) {
-			return nil
+	wal.lastPos = first
+
+	return first, nil
+}
+
+// WriteContext writes data like Write and returns its position, but
+// gives up when ctx is done, returning ctx.Err(). If ctx is done while
+// waiting for other writes to finish, the record is never written. If
+// it's done once the record is being written or synced, WriteContext
+// returns without waiting for that to finish, and the record may or may
+// not end up in the log: the caller must treat it as unknown, the same
+// as a write interrupted by a crash. data is copied first, so the caller
+// may reuse it as soon as WriteContext returns, even if the write goes
+// on without it. A record that WriteContext returns without error is as
+// durable as one written by Write, which with SyncRate set means it's
+// synced in the background.
+func (wal *WALWriter) WriteContext(ctx context.Context, data []byte) (Position, error) {
+	err := ctx.Err()
+	if err != nil {
+		return Position{}, err
+	}
+
+	data = append([]byte(nil), data...)
+
+	type result struct {
+		pos Position
+		err error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		wal.lock.Lock()
+		defer wal.lock.Unlock()
+		defer wal.wake()
+
+		// Don't start a write the caller has already given up on.
+		err := ctx.Err()
+		if err != nil {
+			done <- result{err: err}
+			return
 		}
+
+		pos, err := wal.write(data)
+		done <- result{pos, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.pos, res.err
+	case <-ctx.Done():
+		return Position{}, ctx.Err()
 	}
-eof:
-	err = wal.Error()
+}
+
+// Append writes data like Write, and returns the position it was written
+// at along with the size of the current segment after the write, both
+// taken atomically with the write itself.
+func (wal *WALWriter) Append(data []byte) (Position, int64, error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
+
+	pos, err := wal.write(data)
 	if err != nil {
-		return err
+		return Position{}, 0, err
 	}
-	return io.EOF
+
+	return pos, wal.segment.Size(), nil
 }
 
-func (r *WALReader) Close() error {
-	if r.seg == nil {
-		return nil
+// WriteNoPrune writes data like Write and returns its position, but never
+// prunes old segments. It still rotates to a new segment when needed, and
+// any pruning that rotation would have done happens on the next write
+// made with one of the other methods. This allows positions to be
+// captured without retention removing the segments they refer to.
+func (wal *WALWriter) WriteNoPrune(data []byte) (Position, error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
+
+	return wal.writeWith(data, extendedRecord{}, wal.rotateIfFull)
+}
+
+// WriteTTL writes data as a record that expires after ttl. Readers with
+// HonorRecordTTL set skip it once it has, though it stays in the log
+// until its segment is pruned like any other. The expiry is stored with
+// the record as a time, so it's judged by the clock of whoever reads it.
+func (wal *WALWriter) WriteTTL(data []byte, ttl time.Duration) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
+
+	ext := extendedRecord{expires: time.Now().Add(ttl).UnixNano()}
+
+	_, err := wal.writeWith(data, ext, wal.makeRoom)
+	return err
+}
+
+var ErrGroupTooLarge = errors.New("group is larger than a segment")
+
+// WriteGroup writes all of records to the same segment. If they won't fit
+// in the space remaining in the current segment, a new segment is rotated
+// in first. If they couldn't fit even in an empty segment ErrGroupTooLarge
+// is returned and nothing is written.
+func (wal *WALWriter) WriteGroup(records [][]byte) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
+
+	var (
+		types  = make([]byte, len(records))
+		values = make([][]byte, len(records))
+		total  int64
+	)
+
+	for i, data := range records {
+		types[i], values[i] = wal.record(data)
+		total += entrySize(len(values[i]))
 	}
 
-	return r.seg.Close()
+	if segmentHeaderSize+total > wal.opts.SegmentSize {
+		return ErrGroupTooLarge
+	}
+
+	err := wal.makeRoom(total)
+	if err != nil {
+		return err
+	}
+
+	for i, value := range values {
+		pos := Position{wal.index, wal.segment.Pos(), wal.segment.epoch}
+
+		err = wal.writeEntry(types[i], value)
+		if err != nil {
+			return err
+		}
+
+		wal.lastPos = pos
+	}
+
+	return nil
 }
 
-func (r *WALReader) Next() bool {
-	return r.next(dataType)
+type Position struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+
+	// Epoch is the epoch of the WAL when the segment was created, so
+	// a position in a segment that has since been replaced by another
+	// with the same number, such as after TruncateAll, is detected.
+	Epoch int64 `json:"epoch,omitempty"`
 }
 
-func (r *WALReader) next(typ byte) bool {
-	r.err = nil
-	if r.seg != nil && r.seg.next(typ) {
-		return true
+func (p *Position) None() bool {
+	return p.Segment == -1
+}
+
+func (wal *WALWriter) Pos() (Position, error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	pos := wal.segment.Pos()
+
+	return Position{wal.index, pos, wal.segment.epoch}, nil
+}
+
+// ReadAt returns the record at p, as returned by Append, passed through
+// Transform.OnRead if there's a Transform. A record in the segment being
+// written to is read using the writer's own file, so it's seen as soon
+// as it's written, without opening the segment again. Other segments
+// are opened to read from. A record split into chunks is returned
+// whole. ErrNotRecordPosition is returned if p isn't the start of a
+// record.
+func (wal *WALWriter) ReadAt(p Position) ([]byte, error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	return wal.readAt(p)
+}
+
+// readAt is ReadAt, called with the lock held.
+func (wal *WALWriter) readAt(p Position) ([]byte, error) {
+	var (
+		data []byte
+		want uint64
+	)
+
+	err := wal.checkEpoch(p)
+	if err != nil {
+		return nil, err
 	}
 
-	idx := r.index
 	for {
-		idx++
-		if idx > r.last {
-			_, last, err := rangeSegments(r.root)
-			if err != nil {
-				r.err = err
-				return false
-			}
-			r.last = last
-			if idx > r.last {
-				return false
-			}
+		ent, size, err := wal.readEntryAt(p)
+		if err != nil {
+			return nil, err
 		}
 
-		r.index = idx
+		switch ent.entryType {
+		case dataType:
+			if want != 0 {
+				return nil, ErrMalformedRecord
+			}
 
-		path := filepath.Join(r.root, fmt.Sprintf("%d", r.index))
+			return wal.readValue(ent.value), nil
+		case extendedType:
+		default:
+			return nil, ErrNotRecordPosition
+		}
 
-		seg, err := NewSegmentReader(path)
+		ext, value, err := decodeExtended(ent.value)
 		if err != nil {
-			r.err = err
-			return false
+			return nil, err
 		}
 
-		if r.seg != nil {
-			r.seg.Close()
+		if ext.hash != nil && !bytes.Equal(contentHash(value), ext.hash) {
+			return nil, ErrHashMismatch
 		}
-		r.seg = seg
-		if r.seg.next(typ) {
-			break
-		} else {
-			return false
+
+		if !ext.chunked {
+			return wal.readValue(value), nil
 		}
-	}
 
-	return true
-}
+		if ext.chunk != want {
+			if want == 0 {
+				return nil, ErrNotRecordPosition
+			}
+
+			return nil, ErrMalformedRecord
+		}
+
+		data = append(data, value...)
+
+		if !ext.more {
+			return wal.readValue(data), nil
+		}
+
+		want++
+
+		// The next chunk follows, unless it didn't fit and the writer
+		// rotated to start it at the beginning of the next segment.
+		p.Offset += size
+
+		next, _, err := wal.readEntryAt(p)
+		if err != nil || next.entryType != extendedType {
+			hdr, err := wal.segmentHeader(p.Segment + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			p = Position{p.Segment + 1, hdr.size, hdr.epoch}
+		}
+	}
+}
+
+// readEntryAt reads the entry at p, from the writer's file if it's in
+// the current segment.
+func (wal *WALWriter) readEntryAt(p Position) (segmentEntry, int64, error) {
+	if p.Segment == wal.index {
+		return readEntryAt(wal.segment.f, p.Offset, wal.segment.Size())
+	}
+
+	f, err := openRead(wal.opts.OpenFile, wal.format.path(wal.root, p.Segment))
+	if err != nil {
+		return segmentEntry{}, 0, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return segmentEntry{}, 0, err
+	}
+
+	return readEntryAt(f, p.Offset, fi.Size())
+}
+
+// readValue returns a record's value as read by readers.
+func (wal *WALWriter) readValue(value []byte) []byte {
+	if wal.opts.Transform == nil {
+		return value
+	}
+
+	return wal.opts.Transform.OnRead(value)
+}
+
+func (wal *WALWriter) flushTagsFile() error {
+	wal.evictTags()
+
+	err := wal.cacheFile.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = wal.cacheFile.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	wal.cache.CRC, err = tagsCRC(wal.cache.Tags)
+	if err != nil {
+		return err
+	}
+	err = wal.cacheEnc.Encode(&wal.cache)
+	if err != nil {
+		return err
+	}
+
+	return wal.cacheFile.Sync()
+}
+
+// evictTags drops the tags with the oldest positions from the tags
+// cache until it holds no more than MaxTags.
+func (wal *WALWriter) evictTags() {
+	excess := len(wal.cache.Tags) - wal.opts.MaxTags
+	if wal.opts.MaxTags <= 0 || excess <= 0 {
+		return
+	}
+
+	tags := make([]string, 0, len(wal.cache.Tags))
+	for tag := range wal.cache.Tags {
+		tags = append(tags, tag)
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		a, b := wal.cache.Tags[tags[i]], wal.cache.Tags[tags[j]]
+		if a.Segment != b.Segment {
+			return a.Segment < b.Segment
+		}
+
+		return a.Offset < b.Offset
+	})
+
+	for _, tag := range tags[:excess] {
+		delete(wal.cache.Tags, tag)
+	}
+}
+
+func (wal *WALWriter) WriteTag(tag []byte) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
+
+	// Tags are subject to rotation just like data, so make room
+	// first. The position must be taken afterwards so that it
+	// refers to the segment the tag actually lands in.
+	err := wal.makeRoom(entrySize(len(tag)))
+	if err != nil {
+		return err
+	}
+
+	// We truncate the cache and rewrite it after the segment
+	// has confirmed the tag so the cache is either absent
+	// or correct, never present but out of date.
+
+	segPos := wal.segment.Pos()
+
+	err = wal.segment.WriteTag(tag)
+	if err != nil {
+		return err
+	}
+	wal.cache.Tags[string(tag)] = Position{wal.index, segPos, wal.segment.epoch}
+
+	return wal.flushTagsFile()
+}
+
+// TruncateAll destructively resets the WAL to an empty state. Every
+// segment and every cached tag is removed and writing starts over in a
+// fresh segment 0. Readers and Positions that refer to the old contents
+// are no longer valid afterwards, and readers stop with ErrLogReset once
+// they reach the end of the segment they were reading. This is intended
+// for tests that want to reuse a WAL between cases.
+func (wal *WALWriter) TruncateAll() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
+
+	if wal.sealed {
+		return ErrSealed
+	}
+
+	err := wal.segment.Close()
+	if err != nil {
+		return err
+	}
+
+	err = wal.resetDurable()
+	if err != nil {
+		return err
+	}
+
+	for i := wal.first; i <= wal.index; i++ {
+		err := os.Remove(wal.format.path(wal.root, i))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	// Readers see the new epoch and stop rather than carry on into
+	// the new log as if it continued the old one.
+	epoch, err := readEpoch(wal.root)
+	if err != nil {
+		return err
+	}
+
+	err = writeEpoch(wal.root, epoch+1)
+	if err != nil {
+		return err
+	}
+
+	wal.epoch = epoch + 1
+	wal.first = 0
+	wal.index = 0
+	wal.current = wal.format.path(wal.root, 0)
+	wal.counts = make(map[int]int64)
+
+	wal.cache.Tags = make(map[string]Position)
+
+	err = wal.flushTagsFile()
+	if err != nil {
+		return err
+	}
+
+	wal.keys = make(map[string]Position)
+	wal.lastPos = Position{-1, -1, 0}
+
+	err = wal.compactKeysFile()
+	if err != nil {
+		return err
+	}
+
+	if wal.seqIndexFile != nil {
+		wal.seqIndexFile.Close()
+
+		err = wal.openSeqIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	if wal.opts.HashChain {
+		err = wal.startChain()
+		if err != nil {
+			return err
+		}
+	}
+
+	seg, err := wal.openSegment(wal.current)
+	if err != nil {
+		return err
+	}
+
+	wal.segment = seg
+
+	return nil
+}
+
+var ErrSealed = errors.New("wal is sealed")
+
+// Seal permanently ends the WAL. A marker is written to the current
+// segment saying that nothing more will ever be written, unlike the
+// marker written by Close which allows the WAL to be reopened and
+// appended to. The segment is closed, every later write returns
+// ErrSealed, and so does opening the WAL for writing again. Readers
+// report having reached the marker via WALReader.Sealed.
+func (wal *WALWriter) Seal() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer wal.wake()
+
+	if wal.sealed {
+		return ErrSealed
+	}
+
+	// If the marker couldn't be written the WAL isn't sealed, and
+	// Seal can be tried again.
+	err := wal.segment.Seal()
+	if err != nil {
+		return err
+	}
+
+	wal.sealed = true
+
+	return nil
+}
+
+func (wal *WALWriter) Close() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	defer wal.wake()
+	defer wal.closeNotify()
+
+	var err error
+
+	// Seal or Release already closed the segment.
+	if !wal.sealed && !wal.released {
+		err = wal.segment.Close()
+	}
+
+	wal.closeFiles()
+
+	return err
+}
+
+// closeFiles closes the files the writer keeps beside the segments.
+func (wal *WALWriter) closeFiles() {
+	if wal.keysFile != nil {
+		wal.keysFile.Close()
+	}
+
+	if wal.seqIndexFile != nil {
+		wal.seqIndexFile.Close()
+	}
+}
+
+// fail records err as the writer's fatal error, unless it already has one.
+func (wal *WALWriter) fail(err error) {
+	wal.errLock.Lock()
+	defer wal.errLock.Unlock()
+
+	if wal.err == nil {
+		wal.err = err
+	}
+}
+
+// Err returns the fatal error the writer has hit, if any. An error
+// writing to or syncing a segment, including from the background
+// syncer when SyncRate is set, or failing to rotate to a new segment is
+// fatal: it leaves the WAL unable to say what's durable, so once one
+// happens every write and Sync returns it until the writer is closed
+// and the WAL reopened. Other errors, such as ErrGroupTooLarge or a
+// failure to prune old segments or update the tags cache, don't affect
+// the data written so they're returned but aren't fatal.
+func (wal *WALWriter) Err() error {
+	wal.errLock.Lock()
+	defer wal.errLock.Unlock()
+
+	return wal.err
+}
+
+// Sync syncs everything written so far to disk, which is only needed
+// when SyncRate is set. It returns the writer's fatal error, if any.
+func (wal *WALWriter) Sync() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.sealed {
+		return ErrSealed
+	}
+
+	err := wal.Err()
+	if err != nil {
+		return err
+	}
+
+	return wal.segment.sync()
+}
+
+// PushVisible makes everything written so far visible to readers in
+// other processes, without syncing it to disk. The writer keeps no
+// buffer of its own, as every entry is written to its segment file as
+// soon as it's written to the WAL, so this only waits for any write in
+// progress to finish and returns the writer's fatal error, if any.
+// Records become durable only once synced, see Sync.
+func (wal *WALWriter) PushVisible() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.sealed {
+		return ErrSealed
+	}
+
+	return wal.Err()
+}
+
+// SetSyncRate changes SyncRate while the WAL is in use, taking effect
+// for the current segment straight away. Going from a rate to 0 syncs
+// anything written but not yet synced first, returning the error if
+// that sync fails, which like any failed sync is fatal.
+func (wal *WALWriter) SetSyncRate(d time.Duration) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	wal.opts.SyncRate = d
+
+	return wal.segment.SetSyncRate(d)
+}
+
+// SetMaxSegments changes MaxSegments while the WAL is in use. The
+// current segment is always kept, so n is at least 1. If fewer segments
+// are now allowed, the extra ones are removed by the next write.
+func (wal *WALWriter) SetMaxSegments(n int) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if n < 1 {
+		n = 1
+	}
+
+	wal.opts.MaxSegments = n
+	wal.prunePending = true
+}
+
+// SetSegmentTTL changes SegmentTTL while the WAL is in use. Segments
+// that have now expired are removed by the next write. SegmentSize
+// can't be changed this way, since segments are sized as they're
+// written.
+func (wal *WALWriter) SetSegmentTTL(d time.Duration) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	wal.opts.SegmentTTL = d
+	wal.prunePending = true
+}
+
+// Stats describes how the WAL is being synced to disk.
+type Stats struct {
+	// The SyncRate in use, 0 when every write is synced.
+	SyncRate time.Duration
+
+	// The number of entries written, including tags and the headers
+	// of segments.
+	Writes int64
+
+	// The number of writes made since the last sync, which would be
+	// lost if the system crashed now.
+	PendingWrites int64
+
+	// The number of syncs performed and the number of writes they
+	// made durable. SyncedWrites divided by Syncs is the average
+	// number of writes each sync covers.
+	Syncs        int64
+	SyncedWrites int64
+
+	// How long the last sync took, and all syncs in total.
+	LastSyncDuration  time.Duration
+	TotalSyncDuration time.Duration
+}
+
+// Stats returns counters describing how the WAL is being synced, to help
+// tune SyncRate. It's cheap and doesn't take the lock, so may be called
+// as often as needed without slowing down writes. Each counter is read
+// atomically, but they aren't read as a set.
+func (wal *WALWriter) Stats() Stats {
+	st := wal.stats
+
+	return Stats{
+		SyncRate:          time.Duration(atomic.LoadInt64(&st.syncRate)),
+		Writes:            atomic.LoadInt64(&st.writes),
+		PendingWrites:     atomic.LoadInt64(&st.pending),
+		Syncs:             atomic.LoadInt64(&st.syncs),
+		SyncedWrites:      atomic.LoadInt64(&st.synced),
+		LastSyncDuration:  time.Duration(atomic.LoadInt64(&st.lastNanos)),
+		TotalSyncDuration: time.Duration(atomic.LoadInt64(&st.syncNanos)),
+	}
+}
+
+// wake wakes readers waiting in WaitNext. It must be called with the
+// lock held.
+func (wal *WALWriter) wake() {
+	if wal.written != nil {
+		close(wal.written)
+		wal.written = nil
+	}
+
+	for _, ch := range wal.notify {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// Already signalled and not yet received.
+		}
+	}
+}
+
+// Notify returns a channel that receives a value after each write,
+// including writes that rotate to a new segment, so that a goroutine
+// reading the WAL can wait on it instead of polling. Signals coalesce:
+// however many writes happen before the channel is received from, it
+// holds a single value, so a slow receiver never causes a backlog. The
+// channel is closed when the writer is closed. Each call returns a new
+// channel, which is signalled until the writer is closed, so it should
+// be called once per receiver.
+func (wal *WALWriter) Notify() <-chan struct{} {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	ch := make(chan struct{}, 1)
+
+	if wal.notifyClosed {
+		close(ch)
+		return ch
+	}
+
+	wal.notify = append(wal.notify, ch)
+
+	return ch
+}
+
+// closeNotify closes the channels returned by Notify. It must be called
+// with the lock held.
+func (wal *WALWriter) closeNotify() {
+	for _, ch := range wal.notify {
+		close(ch)
+	}
+
+	wal.notify = nil
+	wal.notifyClosed = true
+}
+
+// writtenChan returns a channel that's closed the next time something
+// is written.
+func (wal *WALWriter) writtenChan() <-chan struct{} {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.written == nil {
+		wal.written = make(chan struct{})
+	}
+
+	return wal.written
+}
+
+// NewReader returns a reader of the WAL from its start, like the package
+// level NewReader, that's tied to this writer. As well as everything a
+// reader can do, it can wait in WaitNext to be woken by the writer as
+// soon as something is written, rather than polling for new records.
+func (wal *WALWriter) NewReader() (*WALReader, error) {
+	return wal.NewReaderWithOptions(DefaultReadOptions)
+}
+
+// NewReaderWithOptions is NewReader with the given options.
+func (wal *WALWriter) NewReaderWithOptions(opts ReadOptions) (*WALReader, error) {
+	r, err := NewReaderWithOptions(wal.root, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.writer = wal
+
+	return r, nil
+}
+
+type ReadOptions struct {
+	// Only read segments that were closed cleanly. When a segment
+	// without the closing marker is reached, such as the segment a
+	// writer is still appending to or one torn by a crash, Next
+	// returns false as if the end of the log had been reached.
+	StrictDurable bool
+
+	// If set, Transform.OnRead is applied to every value returned. It
+	// should match the Transform the WAL was written with.
+	Transform Transform
+
+	// If set, called as a tag scan by SeekTag or SeekTagContext enters
+	// each segment, so that the progress of a long scan can be shown.
+	ScanProgress func(ScanProgress)
+
+	// Only read entries that the writer has synced to disk, according
+	// to the watermark file it keeps when its DurableWatermark option
+	// is set. Next returns false on reaching one that isn't synced yet,
+	// and returns it once it is. If there's no watermark file nothing
+	// is read.
+	ReadDurableOnly bool
+
+	// If set, records written by WriteTTL are skipped once they've
+	// expired, as if they'd never been written. Expired reports how
+	// many have been.
+	HonorRecordTTL bool
+
+	// If set, segments are read with Framer rather than the framing
+	// this package writes, such as to read the logs of another system
+	// with segments named as these are. See Framer.
+	Framer Framer
+
+	// If set, segment files are opened with OpenFile, as for the
+	// writer's OpenFile option.
+	OpenFile OpenFileFunc
+
+	// If set, each record written by WriteSeq must have a sequence one
+	// more than the last such record read, or Next returns false with
+	// a SeqGapError, matching ErrSeqGap, from Error. Records without a
+	// sequence aren't checked, and the first record read after the
+	// reader is opened, Reset or moved by Seek may have any sequence.
+	VerifySeqContiguous bool
+
+	// If set, a record identical to the one read just before it, with
+	// the same data, key and sequence, is skipped, collapsing a write
+	// that was retried and landed twice into one. Only adjacent
+	// duplicates are collapsed, a record repeated with others between
+	// is read each time. It costs a copy of each record read. Collapsed
+	// reports how many have been.
+	DedupConsecutive bool
+}
+
+// ScanProgress describes how far a tag scan has got.
+type ScanProgress struct {
+	// The segment being scanned and the last segment of the log.
+	Segment     int
+	LastSegment int
+
+	// The number of records and tags read so far by the scan.
+	Records int64
+}
+
+var DefaultReadOptions = ReadOptions{}
+
+type WALReader struct {
+	opts ReadOptions
+
+	root    string
+	current string
+	format  segmentFormat
+
+	first int
+	last  int
+	index int
+
+	seg *SegmentReader
+
+	// Set when ReadInto was given a buffer too small for the current
+	// record, so the next call returns it again instead of advancing.
+	pending bool
+
+	errLock sync.Mutex
+	err     error
+
+	// The writer this reader was created by, if any.
+	writer *WALWriter
+
+	// The watermark last read for ReadDurableOnly, if one has been.
+	durable   Position
+	durableOK bool
+
+	// Where the current record starts, and its value and the fields
+	// of its first chunk if it was split into chunks, see
+	// SplitLargeRecords.
+	start     Position
+	assembled []byte
+	firstExt  extendedRecord
+
+	// The number of segments pruned before the reader reached them.
+	skipped int
+
+	// The number of expired records skipped, see HonorRecordTTL.
+	expired int64
+
+	// The epoch of the WAL when the reader was opened or last Reset.
+	epoch int64
+
+	// The sequence of the last record read with one, if seqSet, see
+	// VerifySeqContiguous.
+	lastSeq uint64
+	seqSet  bool
+
+	// Set while records are read by FilterKey, to skip those whose
+	// keys don't match.
+	keyFilter func([]byte) bool
+
+	// The last record read, if prevSet, and the number of records
+	// skipped as duplicates of it, see DedupConsecutive.
+	prev      dedupRecord
+	prevSet   bool
+	collapsed int64
+}
+
+var ErrNoSegments = errors.New("no segments")
+
+// ErrOrphanedTags is returned when opening a reader on a directory that
+// has no segments but does have tags cached, such as when every segment
+// has been removed but the tags file was left behind. The tags refer to
+// segments that are gone. Opening a writer on the directory starts the
+// tags cache afresh, clearing them.
+var ErrOrphanedTags = errors.New("tags cached but no segments")
+
+func NewReader(root string) (*WALReader, error) {
+	return NewReaderWithOptions(root, DefaultReadOptions)
+}
+
+// readerWaitPoll is how often NewReaderWait looks for the first segment.
+const readerWaitPoll = 10 * time.Millisecond
+
+// NewReaderWait is NewReader, but if root doesn't exist or has no
+// segments yet it waits up to timeout for the first segment to appear,
+// such as when the reader starts before the writer. It creates nothing
+// itself, and returns ErrNoSegments if there's still no segment once the
+// timeout has passed.
+func NewReaderWait(root string, timeout time.Duration) (*WALReader, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		r, err := NewReader(root)
+		if err == nil {
+			return r, nil
+		}
+
+		if err != ErrNoSegments && err != ErrOrphanedTags && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, ErrNoSegments
+		}
+
+		time.Sleep(readerWaitPoll)
+	}
+}
+
+func NewReaderWithOptions(root string, opts ReadOptions) (*WALReader, error) {
+	// Pin the reader to the directory root refers to now, see SourcePath.
+	resolved, err := filepath.EvalSymlinks(root)
+	if err == nil {
+		root = resolved
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	r := &WALReader{root: root, opts: opts}
+
+	err = r.Reset()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (wal *WALReader) Reset() error {
+	if wal.seg != nil {
+		wal.seg.Close()
+	}
+
+	format, err := existingFormat(wal.root, wal.format)
+	if err != nil {
+		return err
+	}
+
+	wal.format = format
+
+	first, last, err := rangeSegments(wal.root, wal.format)
+	if err != nil {
+		return err
+	}
+
+	if first == -1 {
+		if hasCachedTags(wal.root) {
+			return ErrOrphanedTags
+		}
+
+		return ErrNoSegments
+	}
+
+	epoch, err := readEpoch(wal.root)
+	if err != nil {
+		return err
+	}
+
+	cur := wal.format.path(wal.root, first)
+
+	r, err := wal.openSegment(cur)
+	if err != nil {
+		return err
+	}
+
+	wal.current = cur
+	wal.first = first
+	wal.last = last
+	wal.index = first
+	wal.seg = r
+	wal.pending = false
+	wal.epoch = epoch
+	wal.seqSet = false
+	wal.prevSet = false
+
+	return nil
+}
+
+// SourcePath returns the directory the reader reads from. Symlinks in
+// the path the reader was opened with are resolved when it's opened, so
+// if the path is a symlink that's later pointed at another directory,
+// the reader carries on reading the directory it was opened on, which
+// SourcePath still returns. To tell whether that's happened, compare
+// SourcePath with the result of filepath.EvalSymlinks on the original
+// path; to follow the symlink, open a new reader. If the directory
+// itself is removed or replaced, the reader stops when it next needs a
+// segment it can't open, with the error available from Error.
+func (wal *WALReader) SourcePath() string {
+	return wal.root
+}
+
+// Pos returns the position the reader will read from next, which after
+// Next returns true is just after the current record rather than the
+// start of it, see CurrentPos. Seeking to it carries on after the
+// current record.
+func (wal *WALReader) Pos() Position {
+	if wal.err != nil || wal.seg == nil {
+		return Position{-1, -1, 0}
+	}
+	return Position{wal.index, wal.seg.Pos(), wal.seg.epoch}
+}
+
+// CurrentPos returns the position of the start of the current record,
+// the one Value returns, so that seeking to it reads the record again.
+// For a record split into chunks it's the start of the first chunk. It's
+// only valid after Next returns true.
+func (wal *WALReader) CurrentPos() Position {
+	if wal.err != nil || wal.seg == nil {
+		return Position{-1, -1, 0}
+	}
+
+	return wal.start
+}
+
+// ReaderStat is a snapshot of where a reader is, from Stat.
+type ReaderStat struct {
+	// The segment being read and the offset in it, -1 if the reader
+	// hasn't opened a segment.
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+
+	// The first and last segments the reader knew of when it last
+	// looked.
+	First int `json:"first"`
+	Last  int `json:"last"`
+
+	// The error the reader stopped on, if any.
+	LastError string `json:"last_error,omitempty"`
+
+	// Whether the segment being read was closed properly, so has no
+	// more to come.
+	Clean bool `json:"clean"`
+
+	// The number of segments pruned before the reader reached them,
+	// see Skipped.
+	Skipped int `json:"skipped"`
+}
+
+// Stat returns a snapshot of the reader's state, for diagnosing a reader
+// that's stuck or in the wrong place. Other than checking whether the
+// current segment was closed properly, which reads its end, it only
+// reads what the reader already knows.
+func (wal *WALReader) Stat() ReaderStat {
+	st := ReaderStat{
+		Segment: -1,
+		Offset:  -1,
+		First:   wal.first,
+		Last:    wal.last,
+		Skipped: wal.skipped,
+	}
+
+	if wal.seg != nil {
+		st.Segment = wal.index
+		st.Offset = wal.seg.Pos()
+
+		// A segment that can't be checked is reported as not clean.
+		st.Clean, _ = wal.seg.Clean()
+	}
+
+	if err := wal.Error(); err != nil {
+		st.LastError = err.Error()
+	}
+
+	return st
+}
+
+// Lag returns how far the reader is behind the end of the log: the
+// bytes of entries, including tags, written after its position, and
+// roughly how many records those hold. It's cheap enough to call often,
+// such as for a gauge of how far behind a consumer is, as the segments
+// left to read aren't read, only a few bytes at either end. Records are
+// counted from the footers of segments not yet started, and estimated
+// from the average size of records for the rest.
+func (r *WALReader) Lag() (records int64, bytes int64, err error) {
+	_, last, err := rangeSegments(r.root, r.format)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		counted      int64
+		countedBytes int64
+		estimate     int64
+	)
+
+	for i := r.index; i <= last; i++ {
+		var start int64
+		if i == r.index && r.seg != nil {
+			start = r.seg.Pos()
+		}
+
+		ext, err := segmentExtent(r.opts.OpenFile, r.format.path(r.root, i))
+		if err != nil {
+			// Merged into the one before it.
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return 0, 0, err
+		}
+
+		if start < ext.start {
+			start = ext.start
+		}
+
+		if start >= ext.end {
+			continue
+		}
+
+		bytes += ext.end - start
+
+		if ext.footer && start == ext.start {
+			records += ext.records
+			counted += ext.records
+			countedBytes += ext.end - ext.start
+		} else {
+			estimate += ext.end - start
+		}
+	}
+
+	if estimate > 0 {
+		avg := int64(0)
+
+		switch {
+		case counted > 0:
+			avg = countedBytes / counted
+		case r.seg != nil && r.seg.valueEnd > r.seg.valueStart:
+			avg = r.seg.valueEnd - r.seg.valueStart
+		}
+
+		if avg > 0 {
+			records += (estimate + avg - 1) / avg
+		}
+	}
+
+	return records, bytes, nil
+}
+
+// extent describes where the entries of a segment start and end, as
+// found by segmentExtent.
+type extent struct {
+	start, end int64
+
+	// Set if the segment has a footer, in which case records is its
+	// count.
+	footer  bool
+	records int64
+}
+
+// segmentExtent returns where the entries of the segment at path start,
+// after its header, and end, before any footer and closing marker, read
+// from either end of the segment without walking its entries.
+func segmentExtent(open OpenFileFunc, path string) (extent, error) {
+	f, err := openRead(open, path)
+	if err != nil {
+		return extent{}, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return extent{}, err
+	}
+
+	ext := extent{end: fi.Size()}
+
+	hdr, _, err := readHeader(f)
+	if err != nil {
+		return extent{}, err
+	}
+
+	ext.start = hdr.size
+
+	magic := ext.end - int64(len(closingMagic))
+	if magic < ext.start {
+		return ext, nil
+	}
+
+	buf := make([]byte, len(closingMagic))
+
+	_, err = f.ReadAt(buf, magic)
+	if err != nil {
+		return extent{}, err
+	}
+
+	if !bytes.Equal(buf, closingMagic) {
+		return ext, nil
+	}
+
+	footer, at, err := readFooter(f, magic)
+	if err != nil {
+		return extent{}, err
+	}
+
+	ext.end = magic
+
+	if at >= ext.start {
+		ext.footer = true
+		ext.records = footer.records
+		ext.end = at
+	}
+
+	return ext, nil
+}
+
+// Seek positions the reader at p, as returned by the writer or reader.
+// ErrStalePosition is returned if p's segment has since been replaced by
+// another with the same number.
+func (wal *WALReader) Seek(p Position) error {
+	return wal.seek(p, true)
+}
+
+// seek is Seek, only checking the epoch of p if check is set, for
+// positions made up by the reader rather than returned to the caller.
+func (wal *WALReader) seek(p Position, check bool) error {
+	wal.pending = false
+	wal.seqSet = false
+	wal.prevSet = false
+
+	if p.Segment == wal.index && wal.seg != nil {
+		if check && p.Epoch != wal.seg.epoch {
+			return ErrStalePosition
+		}
+
+		return wal.seg.Seek(p.Offset)
+	}
+	path := wal.format.path(wal.root, p.Segment)
+
+	seg, err := wal.openSegment(path)
+	if err != nil {
+		return err
+	}
+
+	if check && p.Epoch != seg.epoch {
+		seg.Close()
+		return ErrStalePosition
+	}
+
+	err = seg.Seek(p.Offset)
+	if err != nil {
+		return err
+	}
+
+	if wal.seg != nil {
+		wal.seg.Close()
+	}
+
+	wal.index = p.Segment
+	wal.seg = seg
+
+	return nil
+}
+
+// ValidPosition reports whether p refers to a location within this WAL:
+// its segment must exist and its offset must be within that segment.
+// Only the directory listing and the segment's size are consulted, no
+// data is read, so a valid position may still not be the start of an
+// entry.
+func (wal *WALReader) ValidPosition(p Position) (bool, error) {
+	if p.Segment < 0 || p.Offset < 0 {
+		return false, nil
+	}
+
+	first, last, err := rangeSegments(wal.root, wal.format)
+	if err != nil {
+		return false, err
+	}
+
+	if first == -1 || p.Segment < first || p.Segment > last {
+		return false, nil
+	}
+
+	fi, err := os.Stat(wal.format.path(wal.root, p.Segment))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return p.Offset <= fi.Size(), nil
+}
+
+// NextPos returns the position just after the current record, where
+// the next entry starts. It's only valid after Next returns true.
+func (wal *WALReader) NextPos() Position {
+	if wal.seg == nil {
+		return Position{-1, -1, 0}
+	}
+
+	return Position{wal.index, wal.seg.valueEnd, wal.seg.epoch}
+}
+
+// NextPosition returns the position just after the entry at p in the WAL
+// in root, where the next entry in the same segment starts. Only the
+// header of the entry at p is read, so its value isn't checked against
+// its CRC, and p must be the start of an entry, as returned by Append,
+// for the result to mean anything. ErrNotRecordPosition is returned if
+// there's no complete entry at p.
+func NextPosition(root string, p Position) (Position, error) {
+	format, err := existingFormat(root, segmentFormat{})
+	if err != nil {
+		return Position{}, err
+	}
+
+	f, err := openFile(format.path(root, p.Segment))
+	if err != nil {
+		return Position{}, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return Position{}, err
+	}
+
+	var hdr [5 + binary.MaxVarintLen64]byte
+
+	n, err := f.ReadAt(hdr[:], p.Offset)
+	if err != nil && err != io.EOF {
+		return Position{}, err
+	}
+
+	if n < 6 {
+		return Position{}, ErrNotRecordPosition
+	}
+
+	cnt, l := binary.Uvarint(hdr[5:n])
+	if l <= 0 {
+		return Position{}, ErrNotRecordPosition
+	}
+
+	end := p.Offset + 5 + int64(l) + int64(cnt)
+	if int64(cnt) < 0 || end > fi.Size() {
+		return Position{}, ErrNotRecordPosition
+	}
+
+	return Position{p.Segment, end, p.Epoch}, nil
+}
+
+// Checkpoint returns the reader's position encoded so that it can be
+// stored and later passed to ResumeReader to carry on reading from the
+// same place.
+func (wal *WALReader) Checkpoint() []byte {
+	data, _ := json.Marshal(wal.Pos())
+	return data
+}
+
+var ErrStaleCheckpoint = errors.New("checkpoint is no longer within the log")
+
+// ResumeReader opens a reader of the WAL at root positioned where the
+// reader that returned checkpoint from Checkpoint was. If the position
+// is no longer within the log, such as because its segment has been
+// pruned, ErrStaleCheckpoint is returned and the caller should start
+// reading from the beginning instead.
+func ResumeReader(root string, checkpoint []byte) (*WALReader, error) {
+	var pos Position
+
+	err := json.Unmarshal(checkpoint, &pos)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewReader(root)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := r.ValidPosition(pos)
+	if err == nil && !ok {
+		err = ErrStaleCheckpoint
+	}
+
+	if err == nil {
+		err = r.Seek(pos)
+	}
+
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// LastPos returns the position of the last record written to the WAL,
+// as Append returned it, including records written before the writer was
+// opened, or Position{-1, -1} if there are none. It's kept in memory, so
+// is cheap enough to call as often as needed.
+func (wal *WALWriter) LastPos() Position {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	return wal.lastPos
+}
+
+// LastPosition returns the position of the last record in the WAL at
+// root, as Append returned it, or ErrNoSegments if there are no records.
+// Unlike SeekLast, no records are read. A closed segment's footer says
+// where its last record starts, and the segment being written is read
+// backward from its end, so usually only a block of each segment looked
+// at is read. Only if that fails are the headers of the segment's
+// entries walked. A writer's LastPos is cheaper still.
+func LastPosition(root string) (Position, error) {
+	format, err := existingFormat(root, segmentFormat{})
+	if err != nil {
+		return Position{-1, -1, 0}, err
+	}
+
+	first, last, err := rangeSegments(root, format)
+	if err != nil {
+		return Position{-1, -1, 0}, err
+	}
+
+	return lastPosition(nil, root, format, first, last)
+}
+
+// lastPosition returns the position of the last record in segments first
+// to last of the WAL at root, or ErrNoSegments if there are no records.
+func lastPosition(open OpenFileFunc, root string, format segmentFormat, first, last int) (Position, error) {
+	for i := last; i >= first && i >= 0; i-- {
+		off, epoch, err := lastRecordStart(open, format.path(root, i))
+		if err != nil {
+			// Merged away, or pruned since the segments were listed.
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return Position{-1, -1, 0}, err
+		}
+
+		if off >= 0 {
+			return Position{i, off, epoch}, nil
+		}
+	}
+
+	return Position{-1, -1, 0}, ErrNoSegments
+}
+
+// lastRecordStart returns the offset of the entry that starts the last
+// record in the segment at path, or -1 if no record starts in it, along
+// with the segment's epoch. It's found as lastRecordFromEnd finds it, and
+// only if that fails are the entries of the segment walked.
+func lastRecordStart(open OpenFileFunc, path string) (int64, int64, error) {
+	f, err := openRead(open, path)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return -1, 0, err
+	}
+
+	hdr, _, err := readHeader(f)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	last, ok, err := findLastRecord(f, hdr, fi.Size())
+	if err != nil {
+		return -1, 0, err
+	}
+
+	if !ok {
+		last = scanLastRecord(f, fi.Size())
+	}
+
+	return last, hdr.epoch, nil
+}
+
+// lastRecordFromEnd returns the offset of the entry that starts the last
+// record in the segment at path, or -1 if none is found, without walking
+// the segment's entries, see findLastRecord.
+func lastRecordFromEnd(open OpenFileFunc, path string) (int64, error) {
+	f, err := openRead(open, path)
+	if err != nil {
+		return -1, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return -1, err
+	}
+
+	hdr, _, err := readHeader(f)
+	if err != nil {
+		return -1, err
+	}
+
+	last, ok, err := findLastRecord(f, hdr, fi.Size())
+	if err != nil || !ok {
+		return -1, err
+	}
+
+	return last, nil
+}
+
+// findLastRecord returns the offset of the entry that starts the last
+// record in the segment in f, with header hdr and size bytes long, or -1
+// if no record starts in it, and false if that couldn't be found
+// cheaply. A closed segment's footer says where it is, which is taken
+// once the entry there is checked to start a record, and an entry found
+// to end where the footer starts. Otherwise the segment is read backward
+// from its end. Entries can't be read backward as such, so each offset
+// before the start of the entry found last is tried as the start of an
+// entry that ends there, which is taken to be the case if its checksum
+// matches. The segment is read in blocks, growing when an entry doesn't
+// fit in one, so usually only its last block is read. A segment that
+// doesn't end with a complete entry has nothing found in it. As a
+// record's value may itself hold what looks like an entry, the entry
+// found is only taken to start a record if another entry ends just
+// before it, or it's the first entry after the header. Only a value
+// holding more than one entry, the last of them at its very end, would
+// fool either check.
+func findLastRecord(f io.ReaderAt, hdr segmentHeader, size int64) (int64, bool, error) {
+	last, ok, err := footerLastRecord(f, hdr, size)
+	if err != nil || ok {
+		return last, ok, err
+	}
+
+	start, err := probeLastRecord(f, size)
+	if err != nil || start < 0 {
+		return -1, false, err
+	}
+
+	ok, err = entryEndsAt(f, hdr.size, start)
+	if err != nil || !ok {
+		return -1, false, err
+	}
+
+	return start, true, nil
+}
+
+// footerLastRecord returns where the footer of the segment in f, with
+// header hdr and size bytes long, says the last record starts, and false
+// if there's no footer saying so or it doesn't check out, see
+// findLastRecord.
+func footerLastRecord(f io.ReaderAt, hdr segmentHeader, size int64) (int64, bool, error) {
+	magic := size - int64(len(closingMagic))
+	if magic < hdr.size {
+		return -1, false, nil
+	}
+
+	buf := make([]byte, len(closingMagic))
+
+	_, err := f.ReadAt(buf, magic)
+	if err != nil {
+		return -1, false, err
+	}
+
+	if !bytes.Equal(buf, closingMagic) {
+		return -1, false, nil
+	}
+
+	footer, at, err := readFooter(f, magic)
+	if err != nil || at < hdr.size || !footer.hasLast {
+		return -1, false, err
+	}
+
+	ok, err := entryEndsAt(f, hdr.size, at)
+	if err != nil || !ok {
+		return -1, false, err
+	}
+
+	if footer.last < 0 {
+		return -1, true, nil
+	}
+
+	if footer.last < hdr.size || footer.last >= at {
+		return -1, false, nil
+	}
+
+	ent, _, err := readEntryAt(f, footer.last, at)
+	if err != nil {
+		if err == ErrNotRecordPosition || err == ErrCorruptCRC {
+			err = nil
+		}
+
+		return -1, false, err
+	}
+
+	if !startsRecord(ent.entryType, ent.value) {
+		return -1, false, nil
+	}
+
+	return footer.last, true, nil
+}
+
+// probeLastRecord is lastRecordFromEnd's search backward from the end of
+// the segment in f, which is size bytes long, without checking what it
+// finds.
+func probeLastRecord(f io.ReaderAt, size int64) (int64, error) {
+	var (
+		bound = size
+		block = int64(64 * 1024)
+	)
+
+	for bound > 0 {
+		lo := bound - block
+		if lo < 0 {
+			lo = 0
+		}
+
+		buf := make([]byte, bound-lo)
+
+		_, err := f.ReadAt(buf, lo)
+		if err != nil {
+			return -1, err
+		}
+
+		end := len(buf)
+
+		for {
+			off := entryEndingAt(buf, end)
+			if off < 0 {
+				break
+			}
+
+			switch buf[off+4] {
+			case dataType:
+				return lo + int64(off), nil
+			case extendedType:
+				_, l := binary.Uvarint(buf[off+5 : end])
+
+				ext, _, err := decodeExtended(buf[off+5+l : end])
+				if err == nil && (!ext.chunked || ext.chunk == 0) {
+					return lo + int64(off), nil
+				}
+			}
+
+			end = off
+		}
+
+		if lo == 0 {
+			break
+		}
+
+		// The entry ending here starts before the block.
+		if end == len(buf) {
+			block *= 2
+		}
+
+		bound = lo + int64(end)
+	}
+
+	return -1, nil
+}
+
+// entryEndsAt reports whether an entry of the segment in f ends at off,
+// or off is from, where the segment's entries start. It searches
+// backward from off, a block at a time, for the entry before off,
+// reading only as much of the segment as that entry takes up.
+func entryEndsAt(f io.ReaderAt, from, off int64) (bool, error) {
+	if off == from {
+		return true, nil
+	}
+
+	block := int64(64 * 1024)
+
+	for {
+		lo := off - block
+		if lo < from {
+			lo = from
+		}
+
+		buf := make([]byte, off-lo)
+
+		_, err := f.ReadAt(buf, lo)
+		if err != nil {
+			return false, err
+		}
+
+		if entryEndingAt(buf, len(buf)) >= 0 {
+			return true, nil
+		}
+
+		if lo == from {
+			return false, nil
+		}
+
+		block *= 2
+	}
+}
+
+// entryEndingAt returns the offset in buf of the entry that ends at end,
+// or -1 if there's none.
+func entryEndingAt(buf []byte, end int) int {
+	for off := end - 6; off >= 0; off-- {
+		if !knownType(buf[off+4]) {
+			continue
+		}
+
+		cnt, l := binary.Uvarint(buf[off+5 : end])
+		if l <= 0 || cnt != uint64(end-off-5-l) {
+			continue
+		}
+
+		if crc32.ChecksumIEEE(buf[off+5:end]) == binary.BigEndian.Uint32(buf[off:]) {
+			return off
+		}
+	}
+
+	return -1
+}
+
+// SeekLast positions the reader so that the next call to Next returns the
+// last record in the log. A reader created by a writer starts from the
+// last position the writer wrote. Otherwise the last segment is read
+// backward from its end to find where the last record probably starts,
+// which is checked against where its entries start. Only if that fails,
+// or reading forward from there doesn't end with that record, is the
+// whole segment read.
+func (wal *WALReader) SeekLast() error {
+	if wal.writer != nil {
+		last := wal.writer.LastPos()
+		if last.Segment == wal.last && wal.seekLastRecord(Position{last.Segment, last.Offset, 0}) {
+			return nil
+		}
+	}
+
+	if wal.opts.Framer == nil || wal.opts.Framer == DefaultFramer {
+		start, err := lastRecordFromEnd(wal.opts.OpenFile, wal.format.path(wal.root, wal.last))
+		if err == nil && start >= 0 && wal.seekLastRecord(Position{wal.last, start, 0}) {
+			return nil
+		}
+	}
+
+	return wal.scanLast()
+}
+
+// seekLastRecord reports whether the record at p is the last one the
+// reader returns, leaving the reader positioned at it if so.
+func (wal *WALReader) seekLastRecord(p Position) bool {
+	err := wal.seek(p, false)
+	if err != nil || !wal.Next() {
+		return false
+	}
+
+	p = Position{wal.index, wal.seg.valueStart, wal.seg.epoch}
+
+	if wal.Next() || wal.Error() != nil {
+		return false
+	}
+
+	return wal.seek(p, false) == nil
+}
+
+// scanLast is SeekLast, reading every record in the last segment.
+func (wal *WALReader) scanLast() error {
+	p1 := Position{
+		Segment: -1,
+		Offset:  -1,
+	}
+	p2 := Position{
+		Segment: wal.last,
+		Offset:  0,
+	}
+	err := wal.seek(p2, false)
+	if err != nil {
+		return err
+	}
+	for wal.Next() {
+		p1 = p2
+		p2 = wal.Pos()
+	}
+	err = wal.Error()
+	if err != nil {
+		return err
+	}
+	if p1.None() {
+		return ErrNoSegments
+	}
+	return wal.Seek(p1)
+}
+
+// SeekEnd positions the reader at the current write head of the log.
+// Unlike SeekLast, which positions the reader so the last existing
+// record is returned again, the next call to Next after SeekEnd only
+// returns records written after SeekEnd was called.
+func (wal *WALReader) SeekEnd() error {
+	_, last, err := rangeSegments(wal.root, wal.format)
+	if err != nil {
+		return err
+	}
+
+	if last == -1 {
+		return ErrNoSegments
+	}
+
+	wal.last = last
+
+	err = wal.seek(Position{Segment: last, Offset: 0}, false)
+	if err != nil {
+		return err
+	}
+
+	return wal.seg.seekEnd()
+}
+
+func (wal *WALReader) SeekTag(tag []byte) error {
+	return wal.SeekTagContext(context.Background(), tag)
+}
+
+// SeekTagContext is SeekTag, but stops scanning the log and returns
+// ctx.Err() if ctx is done before the tag is found. The context is
+// checked between every entry read. Progress is reported to the
+// ScanProgress callback in the ReadOptions, if set.
+func (wal *WALReader) SeekTagContext(ctx context.Context, tag []byte) error {
+	cacheFile, err := openFile(filepath.Join(wal.root, "tags"))
+	if err == nil {
+		defer cacheFile.Close()
+		var cache tagCache
+		err = json.NewDecoder(cacheFile).Decode(&cache)
+		// An empty cache, as left by a writer that has no tags
+		// yet, decodes to io.EOF and has nothing in it. A cache
+		// that can't be decoded or fails its checksum has been
+		// damaged, and can't be trusted any more than a missing
+		// one, so it's ignored and the log is scanned.
+		if err != nil || !cache.valid() {
+			cache.Tags = nil
+		}
+		if pos, found := cache.Tags[string(tag)]; found {
+			ok, err := wal.seekCachedTag(pos, tag)
+			if err != nil {
+				return err
+			}
+			if ok {
+				return nil
+			}
+			// The cache is out of date, fall back to scanning.
+		}
+	} else {
+		// TODO: warning
+	}
+
+	progress := wal.opts.ScanProgress
+
+	var records int64
+
+	scanning := wal.index
+	if progress != nil && wal.seg != nil {
+		progress(ScanProgress{scanning, wal.last, records})
+	}
+
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		if !wal.next(anyType) {
+			break
+		}
+
+		if progress != nil && wal.index != scanning {
+			scanning = wal.index
+			progress(ScanProgress{scanning, wal.last, records})
+		}
+
+		switch wal.seg.valueType {
+		case dataType, tagType:
+			records++
+		}
+
+		if wal.seg.valueType == tagType && bytes.Equal(wal.seg.Value(), tag) {
+			return nil
+		}
+	}
+
+	err = wal.Error()
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// hasCachedTags reports whether the tags file in root holds any tags.
+func hasCachedTags(root string) bool {
+	f, err := openFile(filepath.Join(root, "tags"))
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	var cache tagCache
+
+	err = json.NewDecoder(f).Decode(&cache)
+	if err != nil || !cache.valid() {
+		return false
+	}
+
+	return len(cache.Tags) > 0
+}
+
+// seekCachedTag checks that the tag entry cached at pos really is tag,
+// leaving the reader positioned after it if so. Only the single entry at
+// pos is read. The current segment is reused when pos is within it, and
+// if the tag isn't there the reader is left where it was.
+func (wal *WALReader) seekCachedTag(pos Position, tag []byte) (bool, error) {
+	seg := wal.seg
+
+	if seg == nil || pos.Segment != wal.index {
+		path := wal.format.path(wal.root, pos.Segment)
+
+		var err error
+		seg, err = wal.openSegment(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+
+	orig := seg.Pos()
+
+	err := seg.Seek(pos.Offset)
+	if err == nil {
+		var ent segmentEntry
+
+		ent, err = seg.readNext()
+		if err == nil && ent.entryType == tagType && bytes.Equal(ent.value, tag) {
+			seg.value = ent.value
+			seg.valueCRC = ent.crc
+
+			if seg != wal.seg {
+				if wal.seg != nil {
+					wal.seg.Close()
+				}
+
+				wal.seg = seg
+				wal.index = pos.Segment
+			}
+
+			wal.pending = false
+
+			return true, nil
+		}
+	}
+
+	if seg == wal.seg {
+		seg.Seek(orig)
+	} else {
+		seg.Close()
+	}
+
+	switch err {
+	case nil, io.EOF, io.ErrUnexpectedEOF, ErrCorruptCRC:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// TagHistory scans every segment and returns the position of each tag
+// entry matching tag, oldest first. Unlike SeekTag, which consults the
+// tag cache that only remembers the latest position of each tag, this is
+// an authoritative scan of the log. The reader's position is unaffected.
+func (r *WALReader) TagHistory(tag []byte) ([]Position, error) {
+	first, last, err := rangeSegments(r.root, r.format)
+	if err != nil {
+		return nil, err
+	}
+
+	var positions []Position
+
+	for i := first; i <= last && first != -1; i++ {
+		seg, err := r.openSegment(r.format.path(r.root, i))
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			start := seg.Pos()
+
+			ent, err := seg.readNext()
+			if err != nil {
+				seg.Close()
+
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+
+				return nil, err
+			}
+
+			if ent.entryType == tagType && bytes.Equal(ent.value, tag) {
+				positions = append(positions, Position{i, start, seg.epoch})
+			}
+		}
+	}
+
+	return positions, nil
+}
+
+// PrevTag returns the latest tag written before the reader's position,
+// along with its position, so that with SeekTag the records between two
+// consecutive tags can be read. A tag the reader is positioned directly
+// after, as SeekTag leaves it, is passed over, giving the tag before it.
+// Segments are scanned starting from the current one, and earlier
+// segments are only opened when the later ones have no tag. The reader
+// isn't moved. ErrTagNotFound is returned if there's no earlier tag.
+func (r *WALReader) PrevTag() ([]byte, Position, error) {
+	if r.seg == nil {
+		return nil, Position{-1, -1, 0}, ErrTagNotFound
+	}
+
+	cur := r.Pos()
+
+	// Segments before the first have been pruned.
+	first, _, err := rangeSegments(r.root, r.format)
+	if err != nil {
+		return nil, Position{-1, -1, 0}, err
+	}
+
+	for i := cur.Segment; i >= first; i-- {
+		seg, err := r.openSegment(r.format.path(r.root, i))
+		if err != nil {
+			// Merged away, or pruned since.
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, Position{-1, -1, 0}, err
+		}
+
+		var (
+			tag []byte
+			pos = Position{-1, -1, 0}
+		)
+
+		for seg.nextOfType(tagType) {
+			if i == cur.Segment && seg.Pos() >= cur.Offset {
+				break
+			}
+
+			tag = append(tag[:0], seg.Value()...)
+			pos = Position{i, seg.valueStart, seg.epoch}
+		}
+
+		err = seg.Error()
+		seg.Close()
+
+		if err != nil {
+			return nil, Position{-1, -1, 0}, err
+		}
+
+		if !pos.None() {
+			return tag, pos, nil
+		}
+	}
+
+	return nil, Position{-1, -1, 0}, ErrTagNotFound
+}
+
+// Tail returns the values of the last n records in the log, oldest
+// first. Segments are read starting from the last one, and earlier
+// segments are only opened when the later ones don't contain enough
+// records. A record split by SplitLargeRecords is returned whole, and
+// counted once. If there are fewer than n records, all of them are
+// returned. The reader's position is unaffected.
+func (r *WALReader) Tail(n int) ([][]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	recs, err := r.lastRecords(n, true)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(recs))
+
+	for i, rec := range recs {
+		values[i] = rec.value
+
+		if r.opts.Transform != nil {
+			values[i] = r.opts.Transform.OnRead(rec.value)
+		}
+	}
+
+	return values, nil
+}
+
+var ErrNotEnoughRecords = errors.New("not enough records in log")
+
+// SeekFromEnd positions the reader so that the next call to Next returns
+// the record n places before the end of the log, with 0 being the last
+// record. Like Tail, segments are read starting from the last one, and
+// a record split by SplitLargeRecords counts once. If the log has n
+// records or fewer, ErrNotEnoughRecords is returned and the reader isn't
+// moved.
+func (r *WALReader) SeekFromEnd(n int) error {
+	if n < 0 {
+		return ErrNotEnoughRecords
+	}
+
+	recs, err := r.lastRecords(n+1, false)
+	if err != nil {
+		return err
+	}
+
+	if len(recs) <= n {
+		return ErrNotEnoughRecords
+	}
+
+	return r.seek(recs[0].pos, false)
+}
+
+// tailRecord is a record found reading the log from the end, which for
+// a record split by SplitLargeRecords may be only some of its chunks.
+type tailRecord struct {
+	pos   Position
+	value []byte
+
+	// For chunks of a split record, the number of the first chunk held
+	// and of the next one wanted, and whether more chunks follow.
+	first uint64
+	next  uint64
+	open  bool
+}
+
+// join returns the chunks in rec followed by those in more, if more
+// carries on where rec leaves off.
+func (rec tailRecord) join(more *tailRecord) (tailRecord, bool) {
+	if !rec.open || more == nil || more.first != rec.next {
+		return rec, false
+	}
+
+	rec.value = append(rec.value, more.value...)
+	rec.next = more.next
+	rec.open = more.open
+
+	return rec, true
+}
+
+// lastRecords returns the last n whole records in the log, oldest
+// first, with their values, reassembled from their chunks, if values
+// is set. Chunks are carried back from the start of a segment to the
+// record they continue in an earlier one. A record missing any of its
+// chunks, because they were pruned or never written, is left out, the
+// same as Next skips it.
+func (r *WALReader) lastRecords(n int, values bool) ([]tailRecord, error) {
+	segments, err := sortedSegments(r.root, r.format)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		recs []tailRecord
+
+		// The chunks at the start of the segment after the one being
+		// read, continuing a record started before it.
+		carry *tailRecord
+	)
+
+	for j := len(segments) - 1; j >= 0 && len(recs) < n; j-- {
+		lead, found, err := r.tailSegment(segments[j], n-len(recs), values)
+		if err != nil {
+			if os.IsNotExist(err) {
+				carry = nil
+				continue
+			}
+
+			return nil, err
+		}
+
+		if len(found) == 0 {
+			// Nothing but chunks continuing an earlier record.
+			if lead != nil && lead.open {
+				joined, ok := lead.join(carry)
+				lead = nil
+				if ok {
+					lead = &joined
+				}
+			}
+
+			carry = lead
+			continue
+		}
+
+		last := found[len(found)-1]
+		if last.open {
+			found = found[:len(found)-1]
+
+			if joined, ok := last.join(carry); ok && !joined.open {
+				found = append(found, joined)
+			}
+		}
+
+		// Only a segment holding nothing else can leave lead open.
+		carry = lead
+
+		recs = append(found, recs...)
+	}
+
+	if len(recs) > n {
+		recs = recs[len(recs)-n:]
+	}
+
+	return recs, nil
+}
+
+// tailSegment reads segment i for lastRecords. It returns the
+// chunks at its start continuing a record from an earlier segment, if
+// any, and the last n whole records in it, followed by the start of a
+// record continued in a later segment if it ends with one.
+func (r *WALReader) tailSegment(i, n int, values bool) (*tailRecord, []tailRecord, error) {
+	seg, err := r.openSegment(r.format.path(r.root, i))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer seg.Close()
+
+	var (
+		lead *tailRecord
+
+		// A record being put together from its chunks.
+		cur *tailRecord
+
+		// A ring of the last n records, next being the oldest once it's
+		// full.
+		ring []tailRecord
+		next int
+
+		started bool
+	)
+
+	add := func(rec tailRecord) {
+		if len(ring) < n {
+			ring = append(ring, rec)
+			return
+		}
+
+		ring[next] = rec
+		next = (next + 1) % n
+	}
+
+	for seg.Next() {
+		ext := seg.ext
+
+		var val []byte
+		if values {
+			val = append([]byte(nil), seg.Value()...)
+		}
+
+		switch {
+		case !ext.chunked || ext.chunk == 0:
+			started = true
+			cur = nil
+
+			rec := tailRecord{
+				pos:   Position{i, seg.valueStart, seg.epoch},
+				value: val,
+				next:  1,
+				open:  ext.chunked && ext.more,
+			}
+
+			if rec.open {
+				cur = &rec
+			} else {
+				add(rec)
+			}
+		case started:
+			if cur == nil || ext.chunk != cur.next {
+				// The rest of a record whose start is missing.
+				cur = nil
+				continue
+			}
+
+			cur.value = append(cur.value, val...)
+			cur.next++
+			cur.open = ext.more
+
+			if !cur.open {
+				add(*cur)
+				cur = nil
+			}
+		case lead == nil:
+			lead = &tailRecord{
+				value: val,
+				first: ext.chunk,
+				next:  ext.chunk + 1,
+				open:  ext.more,
+			}
+		case lead.open && ext.chunk == lead.next:
+			lead.value = append(lead.value, val...)
+			lead.next++
+			lead.open = ext.more
+		}
+	}
+
+	if seg.Error() != nil {
+		return nil, nil, seg.Error()
+	}
+
+	found := append(ring[next:], ring[:next]...)
+
+	if cur != nil {
+		found = append(found, *cur)
+	}
+
+	return lead, found, nil
+}
+
+// Segmented returns the records of the log grouped by segment. For each
+// segment, oldest first, it yields the segment's index and an iterator
+// over the segment's records. Each of those iterators opens its own
+// SegmentReader when it's ranged over, so they may be collected and
+// then ranged over concurrently, such as to replay segments in
+// parallel. A record's value is only valid until the iterator moves on
+// to the next one. If reading fails, iteration stops early and the
+// error is available from Error once all the iterators are done. The
+// reader's position is unaffected.
+func (r *WALReader) Segmented() iter.Seq2[int, iter.Seq[[]byte]] {
+	return func(yield func(int, iter.Seq[[]byte]) bool) {
+		segments, err := sortedSegments(r.root, r.format)
+		if err != nil {
+			r.setErr(err)
+			return
+		}
+
+		for _, i := range segments {
+			if !yield(i, r.segmentRecords(r.format.path(r.root, i))) {
+				return
+			}
+		}
+	}
+}
+
+// Since returns the records written after the record at p, each with
+// the position it starts at. p is the position of a record as returned
+// by Append or by a previous Since, so a caller can store the position
+// of the last record it consumed and later pick up from there. The
+// reader is moved to p, and then past each record as it's returned. If
+// p isn't the position of a record, or reading fails, nothing more is
+// returned and the error is available from Error.
+func (r *WALReader) Since(p Position) iter.Seq2[[]byte, Position] {
+	return func(yield func([]byte, Position) bool) {
+		err := r.Seek(p)
+		if err != nil {
+			r.err = err
+			return
+		}
+
+		// Skip over the record at p itself, however long it is.
+		if !r.Next() {
+			if r.Error() == nil {
+				r.err = ErrNotRecordPosition
+			}
+			return
+		}
+
+		if r.start != p {
+			r.err = ErrNotRecordPosition
+			return
+		}
+
+		for r.Next() {
+			if !yield(r.Value(), r.start) {
+				return
+			}
+		}
+	}
+}
+
+var ErrNotRecordPosition = errors.New("position is not the start of a record")
+
+// Filter returns the records from the reader's position on for which
+// pred returns true, each with the position it starts at, moving the
+// reader past each record as it's read. Every record is read to test
+// it. If reading fails, nothing more is returned and the error is
+// available from Error.
+func (r *WALReader) Filter(pred func([]byte) bool) iter.Seq2[[]byte, Position] {
+	return func(yield func([]byte, Position) bool) {
+		for r.Next() {
+			if !pred(r.Value()) {
+				continue
+			}
+
+			if !yield(r.Value(), r.start) {
+				return
+			}
+		}
+	}
+}
+
+// FilterKey is Filter, but tests the keys of records written by
+// WriteKeyed, passing over records without a key. The key is read from
+// the start of each record's entry and records that don't match are
+// skipped over without reading the rest of them, unless the
+// VerifySeqContiguous option is set, as it needs to see every record.
+func (r *WALReader) FilterKey(pred func(key []byte) bool) iter.Seq2[[]byte, Position] {
+	return func(yield func([]byte, Position) bool) {
+		if !r.opts.VerifySeqContiguous {
+			r.keyFilter = pred
+			defer func() { r.keyFilter = nil }()
+		}
+
+		for r.Next() {
+			key := r.Key()
+			if key == nil || !pred(key) {
+				continue
+			}
+
+			if !yield(r.Value(), r.start) {
+				return
+			}
+		}
+	}
+}
+
+// TagsOnly returns every tag in the WAL, oldest first, with the position
+// of each. Only the headers of records are read, their values are
+// skipped over, so listing the tags of a large WAL doesn't mean reading
+// all of its data. The reader isn't moved. If reading fails, nothing
+// more is returned and the error is available from Error.
+func (r *WALReader) TagsOnly() iter.Seq2[[]byte, Position] {
+	return func(yield func([]byte, Position) bool) {
+		segments, err := sortedSegments(r.root, r.format)
+		if err != nil {
+			r.setErr(err)
+			return
+		}
+
+		for _, idx := range segments {
+			seg, err := r.openSegment(r.format.path(r.root, idx))
+			if err != nil {
+				// Pruned since the segments were listed.
+				if os.IsNotExist(err) {
+					continue
+				}
+
+				r.setErr(err)
+				return
+			}
+
+			for seg.nextOfType(tagType) {
+				if !yield(seg.Value(), Position{idx, seg.valueStart, seg.epoch}) {
+					seg.Close()
+					return
+				}
+			}
+
+			err = seg.Error()
+			seg.Close()
+
+			if err != nil {
+				r.setErr(err)
+				return
+			}
+		}
+	}
+}
+
+// RecordSizes returns the size of every record in the WAL, oldest first,
+// for working out how large records tend to be. The size is of the
+// record's data as stored, after any Transform, leaving out the fields
+// stored with it, such as its key or hash. A record split by
+// SplitLargeRecords is returned once, with the size of all its chunks
+// together, and tags aren't records so they're left out. Only the
+// headers of entries and the fields of records are read, their data is
+// skipped over. The reader isn't moved. If reading fails, nothing more
+// is returned and the error is available from Error.
+func (r *WALReader) RecordSizes() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		segments, err := sortedSegments(r.root, r.format)
+		if err != nil {
+			r.setErr(err)
+			return
+		}
+
+		var sizes recordSizer
+
+		for _, idx := range segments {
+			seg, err := r.openSegment(r.format.path(r.root, idx))
+			if err != nil {
+				// Pruned since the segments were listed.
+				if os.IsNotExist(err) {
+					continue
+				}
+
+				r.setErr(err)
+				return
+			}
+
+			more, err := seg.recordSizes(&sizes, yield)
+			seg.Close()
+
+			if err != nil {
+				r.setErr(err)
+				return
+			}
+
+			if !more {
+				return
+			}
+		}
+	}
+}
+
+// segmentRecords returns an iterator over the records of the segment at
+// path.
+func (r *WALReader) segmentRecords(path string) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		seg, err := r.openSegment(path)
+		if err != nil {
+			// Pruned since the segments were listed.
+			if !os.IsNotExist(err) {
+				r.setErr(err)
+			}
+			return
+		}
+
+		defer seg.Close()
+
+		if r.opts.StrictDurable {
+			clean, err := seg.Clean()
+			if err != nil {
+				r.setErr(err)
+				return
+			}
+
+			if !clean {
+				return
+			}
+		}
+
+		for seg.Next() {
+			val := seg.Value()
+			if r.opts.Transform != nil {
+				val = r.opts.Transform.OnRead(val)
+			}
+
+			if !yield(val) {
+				return
+			}
+		}
+
+		if err := seg.Error(); err != nil {
+			r.setErr(err)
+		}
+	}
+}
+
+// setErr records err to be returned by Error. It's safe to call from
+// the concurrently running iterators returned by Segmented.
+func (r *WALReader) setErr(err error) {
+	r.errLock.Lock()
+	defer r.errLock.Unlock()
+
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// Gaps returns the indexes of any segments missing from between the
+// oldest and newest segments on disk. Pruning only ever removes the
+// oldest segments, so the segments that remain should always be
+// contiguous, apart from those merged into the segment before them by
+// MergeSegments, which aren't gaps. A gap means segments were removed by
+// something else, and the records in them have been lost.
+func (r *WALReader) Gaps() ([]int, error) {
+	segments, err := sortedSegments(r.root, r.format)
+	if err != nil {
+		return nil, err
+	}
+
+	var gaps []int
+
+	for j := 1; j < len(segments); j++ {
+		start := segments[j-1] + 1
+		if start == segments[j] {
+			continue
+		}
+
+		through, ok, err := mergedThrough(r.opts.OpenFile, r.format.path(r.root, segments[j-1]))
+		if err != nil {
+			return nil, err
+		}
+
+		if ok && through >= start {
+			start = through + 1
+		}
+
+		for i := start; i < segments[j]; i++ {
+			gaps = append(gaps, i)
+		}
+	}
 
+	return gaps, nil
+}
+
+// SegmentTime is the span of time covered by a segment.
+type SegmentTime struct {
+	Segment int
+
+	// When the segment was started, as recorded in its header. For
+	// segments written before headers existed this falls back to the
+	// segment's modification time.
+	Start time.Time
+
+	// When the segment was last written to.
+	Modified time.Time
+}
+
+// SegmentTimes returns the span of time covered by each segment, oldest
+// first.
+func (r *WALReader) SegmentTimes() ([]SegmentTime, error) {
+	segments, err := sortedSegments(r.root, r.format)
+	if err != nil {
+		return nil, err
+	}
+
+	var times []SegmentTime
+
+	for _, i := range segments {
+		f, err := openRead(r.opts.OpenFile, r.format.path(r.root, i))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		hdr, ok, err := readHeader(f)
+		f.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		st := SegmentTime{
+			Segment:  i,
+			Start:    fi.ModTime(),
+			Modified: fi.ModTime(),
+		}
+
+		if ok {
+			st.Start = hdr.created
+		}
+
+		times = append(times, st)
+	}
+
+	return times, nil
+}
+
+func (r *WALReader) Close() error {
+	if r.seg == nil {
+		return nil
+	}
+
+	return r.seg.Close()
+}
+
+func (r *WALReader) Next() bool {
+	for {
+		r.assembled = nil
+
+		if !r.next(dataType) {
+			return false
+		}
+
+		if !r.assemble() {
+			return false
+		}
+
+		if !r.opts.DedupConsecutive || !r.duplicate() {
+			break
+		}
+
+		r.collapsed++
+	}
+
+	if r.opts.VerifySeqContiguous {
+		return r.checkSeq()
+	}
+
+	return true
+}
+
+// assemble reads the rest of the chunks of a record split by
+// SplitLargeRecords when the entry just read is its first chunk. Chunks
+// without the start of their record, whose segment was pruned, and the
+// start of a record that was never finished because the writer crashed,
+// are skipped. If the rest of the record hasn't been written yet, the
+// reader is moved back to its start so that it's read whole later.
+func (r *WALReader) assemble() bool {
+top:
+	r.start = Position{r.index, r.seg.valueStart, r.seg.epoch}
+
+	ext := r.seg.ext
+	if !ext.chunked {
+		return true
+	}
+
+	if ext.chunk != 0 {
+		if !r.next(dataType) {
+			return false
+		}
+
+		goto top
+	}
+
+	start := r.start
+	first := ext
+	buf := append([]byte{}, r.seg.Value()...)
+
+	for want := uint64(1); ext.more; want++ {
+		if !r.next(dataType) {
+			if r.err == nil {
+				err := r.Seek(start)
+				if err != nil {
+					r.err = err
+				}
+			}
+
+			return false
+		}
+
+		ext = r.seg.ext
+
+		if !ext.chunked || ext.chunk != want {
+			goto top
+		}
+
+		buf = append(buf, r.seg.Value()...)
+	}
+
+	r.start = start
+	r.assembled = buf
+	r.firstExt = first
+
+	return true
+}
+
+// recordExt returns the fields of the current record, which the first
+// chunk of a split record carries for all of it.
+func (r *WALReader) recordExt() extendedRecord {
+	if r.assembled != nil {
+		return r.firstExt
+	}
+
+	return r.seg.ext
+}
+
+func (r *WALReader) next(typ byte) bool {
+	r.err = nil
+	r.pending = false
+	if r.seg != nil {
+		if !r.readable() {
+			return false
+		}
+
+		ok, held := r.segNext(typ)
+		if ok || held {
+			return ok
+		}
+	}
+
+	// A segment may hold no entries of typ, such as one holding only a
+	// tag or checkpoint too large to share a segment, so keep going.
+	for {
+		ok, err := r.openNext()
+		if err != nil {
+			r.err = err
+			return false
+		}
+
+		if !ok || !r.readable() {
+			return false
+		}
+
+		ok, held := r.segNext(typ)
+		if ok || held || r.Error() != nil {
+			return ok
+		}
+	}
+}
+
+// segNext reads the next entry of type typ from the current segment.
+// With ReadDurableOnly, an entry past the watermark is put back and
+// held is true, as the rest of the log is past it too. With
+// HonorRecordTTL, expired records are skipped.
+func (r *WALReader) segNext(typ byte) (ok, held bool) {
+	for {
+		if r.keyFilter != nil && typ == dataType {
+			r.seg.skipKeys(r.keyFilter)
+		}
+
+		if !r.seg.next(typ) {
+			return false, false
+		}
+
+		if r.opts.ReadDurableOnly {
+			ok, err := r.durableEntry()
+			if err != nil {
+				r.err = err
+				return false, true
+			}
+
+			if !ok {
+				r.seg.Seek(r.seg.valueStart)
+				return false, true
+			}
+		}
+
+		if r.opts.HonorRecordTTL && r.seg.expired(time.Now()) {
+			r.expired++
+			continue
+		}
+
+		return true, false
+	}
+}
+
+// readable reports whether entries may be read from the current segment,
+// which is always true unless the StrictDurable option is set.
+func (r *WALReader) readable() bool {
+	if !r.opts.StrictDurable {
+		return true
+	}
+
+	clean, err := r.seg.Clean()
+	if err != nil {
+		r.err = err
+		return false
+	}
+
+	return clean
+}
+
+// openNext moves the reader to the start of the next segment, reporting
+// false if there isn't one yet.
+func (r *WALReader) openNext() (bool, error) {
+	idx := r.index + 1
+	if idx > r.last {
+		_, last, err := rangeSegments(r.root, r.format)
+		if err != nil {
+			return false, err
+		}
+
+		err = r.checkReset(last)
+		if err != nil {
+			return false, err
+		}
+
+		r.last = last
+		if idx > r.last {
+			return false, nil
+		}
+	}
+
+	err := r.openIndex(idx)
+
+	// A segment can be missing because it was merged into the one before
+	// it, or because it was pruned since the reader last looked. Either
+	// way, move on to the next that exists.
+	for os.IsNotExist(err) {
+		first, last, scanErr := rangeSegments(r.root, r.format)
+		if scanErr == nil {
+			scanErr = r.checkReset(last)
+		}
+
+		if scanErr != nil {
+			return false, scanErr
+		}
+
+		r.last = last
+
+		switch {
+		case idx > last:
+			return false, nil
+		case idx < first:
+			r.skipped += first - idx
+			r.first = first
+			idx = first
+		case idx < last:
+			idx++
+		}
+
+		// Otherwise it's the last, which went between looking and
+		// opening it, so look again.
+
+		err = r.openIndex(idx)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	r.index = idx
+
+	return true, nil
+}
+
+// openIndex points the reader at the start of segment idx, reusing its
+// SegmentReader if it has one. If the segment can't be opened the reader
+// is left as it was.
+func (r *WALReader) openIndex(idx int) error {
+	path := r.format.path(r.root, idx)
+
+	if r.seg != nil {
+		return r.seg.Reset(path)
+	}
+
+	seg, err := r.openSegment(path)
+	if err != nil {
+		return err
+	}
+
+	r.seg = seg
+
+	return nil
+}
+
+// Skipped returns the number of segments the reader has skipped because
+// they were pruned, by the writer's retention limits or otherwise, before
+// it reached them. Next moves on to the oldest segment left rather than
+// failing, so the records in skipped segments are never returned.
+func (r *WALReader) Skipped() int {
+	return r.skipped
+}
+
+// Status says how NextDurable moved the reader.
+type Status int
+
+const (
+	// A record was read, following the last one read.
+	StatusNormal Status = iota
+
+	// A record was read, but segments holding records that should
+	// have come before it were pruned before the reader reached them,
+	// so it's from the oldest segment left.
+	StatusJumpedAfterPrune
+
+	// There's no record to read yet.
+	StatusAtEnd
+)
+
+// NextDurable moves to the next record like Next, returning it with its
+// position and a Status saying how the reader got there, for consumers
+// that want every case handled in one place. Segments written since the
+// last call are moved on to as usual. If segments the reader hadn't
+// reached have been pruned, the record returned is the first of the
+// oldest segment left and the status is StatusJumpedAfterPrune, with
+// Skipped saying how many segments were lost. At the end of the log it
+// returns StatusAtEnd and no record, and can be called again once more
+// is written. The value is only valid until the reader is next moved,
+// as with Value.
+func (r *WALReader) NextDurable() ([]byte, Position, Status, error) {
+	skipped := r.skipped
+
+	if !r.Next() {
+		return nil, Position{}, StatusAtEnd, r.Error()
+	}
+
+	status := StatusNormal
+	if r.skipped > skipped {
+		status = StatusJumpedAfterPrune
+	}
+
+	return r.Value(), r.start, status, nil
+}
+
+// openSegment opens the segment at path to be read with the reader's
+// framer.
+func (r *WALReader) openSegment(path string) (*SegmentReader, error) {
+	return openSegmentReader(r.opts.OpenFile, path, r.opts.Framer)
+}
+
+// Expired returns the number of records the reader has skipped because
+// they had expired, see HonorRecordTTL.
+func (r *WALReader) Expired() int64 {
+	return r.expired
+}
+
+// dedupRecord is what DedupConsecutive compares records by.
+type dedupRecord struct {
+	value []byte
+	key   []byte
+
+	sequenced bool
+	seq       uint64
+}
+
+// duplicate reports whether the record just read is the same as the one
+// read before it, remembering it for the next if not.
+func (r *WALReader) duplicate() bool {
+	seq, sequenced := r.Seq()
+	value, key := r.Value(), r.Key()
+
+	if r.prevSet && bytes.Equal(r.prev.value, value) && bytes.Equal(r.prev.key, key) &&
+		(key == nil) == (r.prev.key == nil) && r.prev.sequenced == sequenced && r.prev.seq == seq {
+		return true
+	}
+
+	r.prev = dedupRecord{
+		value:     append(r.prev.value[:0], value...),
+		sequenced: sequenced,
+		seq:       seq,
+	}
+
+	if key != nil {
+		r.prev.key = append([]byte{}, key...)
+	}
+
+	r.prevSet = true
+
+	return false
+}
+
+// Collapsed returns the number of records the reader has skipped as
+// duplicates of the record before them, see DedupConsecutive.
+func (r *WALReader) Collapsed() int64 {
+	return r.collapsed
+}
+
+var ErrNoWriter = errors.New("reader was not created by a writer")
+
+// WaitNext is Next, but if there's no record to read it waits for the
+// writer to write one, or for ctx to be done in which case it returns
+// false with ctx.Err() available from Error. Only readers created by
+// WALWriter.NewReader can wait, for others it returns false with
+// ErrNoWriter. Records are still read from disk, the writer only says
+// when to look, so rotation and everything else is handled as by Next.
+func (r *WALReader) WaitNext(ctx context.Context) bool {
+	if r.writer == nil {
+		r.err = ErrNoWriter
+		return false
+	}
+
+	for {
+		// Take the channel before looking so a write made in between
+		// isn't missed.
+		written := r.writer.writtenChan()
+
+		if r.Next() {
+			return true
+		}
+
+		if r.Error() != nil {
+			return false
+		}
+
+		select {
+		case <-written:
+		case <-ctx.Done():
+			r.err = ctx.Err()
+			return false
+		}
+	}
+}
+
+// ReadInto advances to the next record and copies its value into buf,
+// returning the length of the value and true if there was a record. If
+// buf is too small, nothing is copied and the returned length is the
+// size buf needs to be; the reader stays on the record so that calling
+// ReadInto again with a large enough buffer returns it. This allows a
+// replay loop to reuse a single buffer for every record.
+func (r *WALReader) ReadInto(buf []byte) (int, bool) {
+	if !r.pending && !r.Next() {
+		return 0, false
+	}
+
+	val := r.Value()
+
+	if len(val) > len(buf) {
+		r.pending = true
+		return len(val), true
+	}
+
+	r.pending = false
+
+	return copy(buf, val), true
+}
+
+// Value returns the value of the current record, passed through the
+// Transform in the ReadOptions if there is one.
 func (r *WALReader) Value() []byte {
 	if r.seg == nil {
 		return nil
 	}
 
-	return r.seg.Value()
+	val := r.seg.Value()
+	if r.assembled != nil {
+		val = r.assembled
+	}
+
+	if r.opts.Transform != nil {
+		return r.opts.Transform.OnRead(val)
+	}
+
+	return val
+}
+
+// ContentHash returns the hash stored with the current record, see
+// WriteOptions.ContentHash, or nil if it doesn't have one. Each chunk
+// of a split record has its own hash, checked as it's read, and the
+// hash of the whole record is returned.
+func (r *WALReader) ContentHash() []byte {
+	if r.seg == nil {
+		return nil
+	}
+
+	if r.assembled != nil && r.seg.ContentHash() != nil {
+		return contentHash(r.assembled)
+	}
+
+	return r.seg.ContentHash()
+}
+
+// Truncated reports whether Next last returned false because the final
+// entry of the current segment is incomplete. See SegmentReader.Truncated.
+func (r *WALReader) Truncated() bool {
+	if r.seg == nil {
+		return false
+	}
+
+	return r.seg.Truncated()
+}
+
+// Sealed reports whether the reader has reached the end of a WAL that
+// was sealed with WALWriter.Seal, so there will never be more records to
+// read.
+func (r *WALReader) Sealed() bool {
+	if r.seg == nil {
+		return false
+	}
+
+	return r.seg.Sealed()
 }
 
 func (r *WALReader) Error() error {
@@ -1,10 +1,21 @@
 package wal
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"iter"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -230,7 +241,7 @@ func TestWal(t *testing.T) {
 
 		assert.False(t, r.Next())
 
-		pos.Offset += int64(len(closingMagic))
+		pos.Offset += footerSize + int64(len(closingMagic))
 		assert.Equal(t, pos, r.Pos())
 	})
 
@@ -633,5 +644,3742 @@ func TestWal(t *testing.T) {
 		assert.Equal(t, "more data", string(r2.Value()))
 	})
 
+	n.It("can seek to the end and only see new records", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("old data"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekEnd()
+		require.NoError(t, err)
+
+		require.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		err = wal.Write([]byte("new data"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+
+		assert.Equal(t, "new data", string(r.Value()))
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		r2, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r2.Close()
+
+		err = r2.SeekEnd()
+		require.NoError(t, err)
+
+		wal, err = New(path)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("after reopen"))
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		require.True(t, r2.Next())
+
+		assert.Equal(t, "after reopen", string(r2.Value()))
+
+		assert.False(t, r2.Next())
+	})
+
+	n.It("caches the position a tag lands at when it causes a rotation", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 20
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("this is data"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("a tag that does not fit"))
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, wal.index)
+		assert.Equal(t, Position{1, segmentHeaderSize, 0}, wal.cache.Tags["a tag that does not fit"])
+
+		err = wal.Write([]byte("more"))
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekTag([]byte("a tag that does not fit"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+
+		assert.Equal(t, "more", string(r.Value()))
+	})
+
+	n.It("fills a segment to exactly SegmentSize before rotating", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 20
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		// 5 bytes of header, 1 byte of length and 14 bytes of data
+		err = wal.Write([]byte("fourteen bytes"))
+		require.NoError(t, err)
+
+		assert.Equal(t, 0, wal.index)
+		assert.Equal(t, opts.SegmentSize, wal.segment.Size())
+
+		err = wal.Write([]byte("x"))
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, wal.index)
+		assert.Equal(t, segmentHeaderSize+entrySize(1), wal.segment.Size())
+	})
+
+	n.It("rotates when an entry would exceed SegmentSize by one byte", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 20
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("a"))
+		require.NoError(t, err)
+
+		// 7 + 13 fits exactly
+		err = wal.Write([]byte("1234567"))
+		require.NoError(t, err)
+
+		assert.Equal(t, 0, wal.index)
+		assert.Equal(t, opts.SegmentSize, wal.segment.Size())
+
+		err = wal.rotateSegment()
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("a"))
+		require.NoError(t, err)
+
+		// 7 + 14 is one over
+		err = wal.Write([]byte("12345678"))
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, wal.index)
+		assert.Equal(t, segmentHeaderSize+entrySize(8), wal.segment.Size())
+	})
+
+	n.It("writes an entry larger than SegmentSize to an empty segment", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 20
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		data := []byte("this is much larger than the size of a segment")
+
+		err = wal.Write(data)
+		require.NoError(t, err)
+
+		assert.Equal(t, 0, wal.index)
+		assert.Equal(t, segmentHeaderSize+entrySize(len(data)), wal.segment.Size())
+
+		err = wal.Write([]byte("x"))
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, wal.index)
+	})
+
+	n.It("can truncate everything and start over", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first data"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		err = wal.rotateSegment()
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("second data"))
+		require.NoError(t, err)
+
+		err = wal.TruncateAll()
+		require.NoError(t, err)
+
+		assert.Equal(t, 0, wal.first)
+		assert.Equal(t, 0, wal.index)
+		assert.Empty(t, wal.cache.Tags)
+
+		_, err = os.Stat(filepath.Join(path, "1"))
+		require.True(t, os.IsNotExist(err))
+
+		err = wal.Write([]byte("fresh data"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "fresh data", string(r.Value()))
+
+		assert.False(t, r.Next())
+
+		err = r.SeekTag([]byte("commit"))
+		assert.Equal(t, io.EOF, err)
+	})
+
+	n.It("can read records into a provided buffer", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("short"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("a much longer value"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		buf := make([]byte, 8)
+
+		n, ok := r.ReadInto(buf)
+		require.True(t, ok)
+		assert.Equal(t, "short", string(buf[:n]))
+
+		n, ok = r.ReadInto(buf)
+		require.True(t, ok)
+		require.Equal(t, len("a much longer value"), n)
+
+		buf = make([]byte, n)
+
+		n, ok = r.ReadInto(buf)
+		require.True(t, ok)
+		assert.Equal(t, "a much longer value", string(buf[:n]))
+
+		_, ok = r.ReadInto(buf)
+		assert.False(t, ok)
+	})
+
+	n.It("can list every position a tag was written at", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		var expected []Position
+
+		for i := 0; i < 3; i++ {
+			err = wal.Write([]byte("data"))
+			require.NoError(t, err)
+
+			pos, err := wal.Pos()
+			require.NoError(t, err)
+
+			expected = append(expected, pos)
+
+			err = wal.WriteTag([]byte("commit"))
+			require.NoError(t, err)
+
+			err = wal.WriteTag([]byte("other"))
+			require.NoError(t, err)
+
+			if i == 1 {
+				err = wal.rotateSegment()
+				require.NoError(t, err)
+			}
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		positions, err := r.TagHistory([]byte("commit"))
+		require.NoError(t, err)
+
+		assert.Equal(t, expected, positions)
+
+		assert.Equal(t, Position{0, 0, 0}, r.Pos())
+
+		positions, err = r.TagHistory([]byte("missing"))
+		require.NoError(t, err)
+
+		assert.Empty(t, positions)
+	})
+
+	n.It("scans for a tag when the cached position is out of date", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("this is data"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("more data"))
+		require.NoError(t, err)
+
+		// Point the cache somewhere that isn't the tag
+		wal.cache.Tags["commit"] = Position{0, 0, 0}
+
+		err = wal.flushTagsFile()
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekTag([]byte("commit"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+
+		assert.Equal(t, "more data", string(r.Value()))
+	})
+
+	n.It("can check if a position is within the WAL", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first data"))
+		require.NoError(t, err)
+
+		err = wal.rotateSegment()
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("second data"))
+		require.NoError(t, err)
+
+		pos, err := wal.Pos()
+		require.NoError(t, err)
+
+		err = wal.pruneSegments(1, time.Time{})
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		ok, err := r.ValidPosition(pos)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = r.ValidPosition(Position{1, pos.Offset + 1, 0})
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = r.ValidPosition(Position{0, 0, 0})
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = r.ValidPosition(Position{2, 0, 0})
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = r.ValidPosition(Position{1, -1, 0})
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	n.It("writes a group of records to the same segment", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 40
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("this is data"))
+		require.NoError(t, err)
+
+		err = wal.WriteGroup([][]byte{[]byte("group one"), []byte("group two")})
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, wal.index)
+		assert.Equal(t, segmentHeaderSize+2*entrySize(len("group one")), wal.segment.Size())
+
+		err = wal.WriteGroup([][]byte{[]byte("group one"), []byte("group two"), []byte("group three")})
+		assert.Equal(t, ErrGroupTooLarge, err)
+
+		assert.Equal(t, 1, wal.index)
+		assert.Equal(t, segmentHeaderSize+2*entrySize(len("group one")), wal.segment.Size())
+	})
+
+	n.It("can stop reading at the first segment not closed cleanly", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("first data"))
+		require.NoError(t, err)
+
+		err = wal.rotateSegment()
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("second data"))
+		require.NoError(t, err)
+
+		r, err := NewReaderWithOptions(path, ReadOptions{StrictDurable: true})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "first data", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "second data", string(r.Value()))
+	})
+
+	n.It("reports the span of time each segment covers", func() {
+		err := os.Mkdir(path, 0755)
+		require.NoError(t, err)
+
+		writeLegacySegment(t, filepath.Join(path, "0"), "old data")
+
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.rotateSegment()
+		require.NoError(t, err)
+
+		legacy, err := os.Stat(filepath.Join(path, "0"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("new data"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		times, err := r.SegmentTimes()
+		require.NoError(t, err)
+
+		require.Equal(t, 2, len(times))
+
+		assert.Equal(t, 0, times[0].Segment)
+		assert.Equal(t, legacy.ModTime(), times[0].Start)
+
+		assert.Equal(t, 1, times[1].Segment)
+		assert.Equal(t, wal.segment.created.UnixNano(), times[1].Start.UnixNano())
+		assert.False(t, times[1].Modified.Before(times[1].Start.Truncate(time.Second)))
+	})
+
+	n.It("can write without pruning and catch up later", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 30
+		opts.MaxSegments = 1
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first data"))
+		require.NoError(t, err)
+
+		pos, err := wal.WriteNoPrune([]byte("second data"))
+		require.NoError(t, err)
+
+		assert.Equal(t, Position{1, segmentHeaderSize, 0}, pos)
+
+		_, err = os.Stat(filepath.Join(path, "0"))
+		require.NoError(t, err)
+
+		assert.Equal(t, 0, wal.first)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.Seek(pos)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "second data", string(r.Value()))
+
+		// No rotation is needed for this write, but it still prunes
+		err = wal.WriteTag([]byte("c"))
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, wal.index)
+
+		_, err = os.Stat(filepath.Join(path, "0"))
+		assert.True(t, os.IsNotExist(err))
+
+		assert.Equal(t, 1, wal.first)
+	})
+
+	n.It("returns the last records in the log", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i, v := range []string{"one", "two", "three", "four", "five"} {
+			if i == 2 || i == 4 {
+				err = wal.rotateSegment()
+				require.NoError(t, err)
+			}
+
+			err = wal.Write([]byte(v))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		values, err := r.Tail(3)
+		require.NoError(t, err)
+
+		assert.Equal(t, [][]byte{[]byte("three"), []byte("four"), []byte("five")}, values)
+
+		values, err = r.Tail(1)
+		require.NoError(t, err)
+
+		assert.Equal(t, [][]byte{[]byte("five")}, values)
+
+		values, err = r.Tail(4)
+		require.NoError(t, err)
+
+		assert.Equal(t, [][]byte{[]byte("two"), []byte("three"), []byte("four"), []byte("five")}, values)
+
+		values, err = r.Tail(10)
+		require.NoError(t, err)
+
+		assert.Equal(t, 5, len(values))
+		assert.Equal(t, "one", string(values[0]))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "one", string(r.Value()))
+	})
+
+	n.It("returns the tail of a segment holding more records than asked for", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 7; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		values, err := r.Tail(3)
+		require.NoError(t, err)
+
+		assert.Equal(t, [][]byte{[]byte("data4"), []byte("data5"), []byte("data6")}, values)
+	})
+
+	n.It("reports the position and segment size when appending", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 30
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		pos, size, err := wal.Append([]byte("first data"))
+		require.NoError(t, err)
+
+		assert.Equal(t, Position{0, segmentHeaderSize, 0}, pos)
+		assert.Equal(t, segmentHeaderSize+entrySize(len("first data")), size)
+
+		pos, size, err = wal.Append([]byte("second data"))
+		require.NoError(t, err)
+
+		assert.Equal(t, Position{1, segmentHeaderSize, 0}, pos)
+		assert.Equal(t, segmentHeaderSize+entrySize(len("second data")), size)
+	})
+
+	n.It("estimates the retention of a set of options", func() {
+		opts := WriteOptions{
+			SegmentSize: segmentHeaderSize + 10*entrySize(100),
+			MaxSegments: 5,
+		}
+
+		window, disk := opts.EstimateRetention(100, 10)
+
+		// 4 full segments of 10 records at 10 records a second
+		assert.Equal(t, 4*time.Second, window)
+		assert.Equal(t, 5*(opts.SegmentSize+footerSize+int64(len(closingMagic))), disk)
+
+		opts.SegmentTTL = 2 * time.Second
+
+		window, disk = opts.EstimateRetention(100, 10)
+
+		assert.Equal(t, 2*time.Second, window)
+		assert.Equal(t, 4*(opts.SegmentSize+footerSize+int64(len(closingMagic))), disk)
+
+		window, _ = opts.EstimateRetention(100, 0)
+		assert.Equal(t, time.Duration(0), window)
+	})
+
+	n.It("applies a transform to records as they are written and read", func() {
+		opts := DefaultWriteOptions
+		opts.Transform = versionStamp{}
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		raw, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer raw.Close()
+
+		require.True(t, raw.Next())
+		assert.Equal(t, "v1:data", string(raw.Value()))
+
+		r, err := NewReaderWithOptions(path, ReadOptions{Transform: versionStamp{}})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data", string(r.Value()))
+
+		err = r.SeekTag([]byte("commit"))
+		require.NoError(t, err)
+	})
+
+	n.It("reports progress while scanning for a tag", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 6; i++ {
+			err = wal.Write([]byte("data"))
+			require.NoError(t, err)
+		}
+
+		var seen []ScanProgress
+
+		r, err := NewReaderWithOptions(path, ReadOptions{
+			ScanProgress: func(p ScanProgress) {
+				seen = append(seen, p)
+			},
+		})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekTag([]byte("commit"))
+		assert.Equal(t, io.EOF, err)
+
+		assert.Equal(t, []ScanProgress{
+			{0, 2, 0},
+			{1, 2, 2},
+			{2, 2, 4},
+		}, seen)
+	})
+
+	n.It("lists segments in order regardless of the directory order", func() {
+		defer func(orig func(string) ([]string, error)) { readDirNames = orig }(readDirNames)
+
+		readDirNames = func(string) ([]string, error) {
+			return []string{"10", "tags", "2", "0", "1"}, nil
+		}
+
+		segments, err := sortedSegments(path, segmentFormat{})
+		require.NoError(t, err)
+
+		assert.Equal(t, []int{0, 1, 2, 10}, segments)
+
+		first, last, err := rangeSegments(path, segmentFormat{})
+		require.NoError(t, err)
+
+		assert.Equal(t, 0, first)
+		assert.Equal(t, 10, last)
+	})
+
+	n.It("returns records grouped by segment", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 5; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var (
+			indexes []int
+			records []iter.Seq[[]byte]
+		)
+
+		for i, recs := range r.Segmented() {
+			indexes = append(indexes, i)
+			records = append(records, recs)
+		}
+
+		assert.Equal(t, []int{0, 1, 2}, indexes)
+
+		values := make([][]string, len(records))
+
+		var wg sync.WaitGroup
+
+		for i, recs := range records {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for val := range recs {
+					values[i] = append(values[i], string(val))
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, [][]string{
+			{"data0", "data1"},
+			{"data2", "data3"},
+			{"data4"},
+		}, values)
+	})
+
+	n.It("can be sealed so nothing more is written", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.False(t, r.Next())
+		assert.False(t, r.Sealed())
+
+		err = wal.Seal()
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("more data"))
+		assert.Equal(t, ErrSealed, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		assert.Equal(t, ErrSealed, err)
+
+		require.NoError(t, wal.Close())
+
+		assert.False(t, r.Next())
+		assert.True(t, r.Sealed())
+
+		_, err = New(path)
+		assert.Equal(t, ErrSealed, err)
+	})
+
+	n.It("isn't sealed if the marker can't be written", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		writeFile = func(f SegmentFile, b []byte) (int, error) {
+			return 0, syscall.ENOSPC
+		}
+
+		err = wal.Seal()
+
+		writeFile = SegmentFile.Write
+
+		assert.True(t, errors.Is(err, ErrNoSpace))
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		err = wal.Seal()
+		require.NoError(t, err)
+
+		_, err = New(path)
+		assert.Equal(t, ErrSealed, err)
+	})
+
+	n.It("wakes readers created by the writer when records are written", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + entrySize(len("data0"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		r, err := wal.NewReader()
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		values := make(chan string)
+
+		go func() {
+			for i := 0; i < 3; i++ {
+				if !r.WaitNext(context.Background()) {
+					close(values)
+					return
+				}
+
+				values <- string(r.Value())
+			}
+		}()
+
+		for i := 0; i < 3; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+
+			select {
+			case val := <-values:
+				assert.Equal(t, fmt.Sprintf("data%d", i), val)
+			case <-time.After(5 * time.Second):
+				t.Fatal("reader wasn't woken")
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		assert.False(t, r.WaitNext(ctx))
+		assert.Equal(t, context.DeadlineExceeded, r.Error())
+
+		plain, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer plain.Close()
+
+		assert.False(t, plain.WaitNext(context.Background()))
+		assert.Equal(t, ErrNoWriter, plain.Error())
+	})
+
+	n.It("ignores a damaged tags cache", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first data"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("second data"))
+		require.NoError(t, err)
+
+		tagsPath := filepath.Join(path, "tags")
+
+		data, err := ioutil.ReadFile(tagsPath)
+		require.NoError(t, err)
+
+		var tc tagCache
+
+		err = json.Unmarshal(data, &tc)
+		require.NoError(t, err)
+
+		assert.True(t, tc.valid())
+
+		// Simulate a flipped bit in the offset.
+		pos := tc.Tags["commit"]
+		pos.Offset ^= 1
+		tc.Tags["commit"] = pos
+
+		assert.False(t, tc.valid())
+
+		for _, damaged := range [][]byte{mustJSON(t, &tc), []byte(`{"tags":`)} {
+			err = ioutil.WriteFile(tagsPath, damaged, 0644)
+			require.NoError(t, err)
+
+			r, err := NewReader(path)
+			require.NoError(t, err)
+
+			err = r.SeekTag([]byte("commit"))
+			require.NoError(t, err)
+
+			require.True(t, r.Next())
+			assert.Equal(t, "second data", string(r.Value()))
+
+			r.Close()
+		}
+	})
+
+	n.It("writes records larger than a segment", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 1024 * 1024
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		large := bytes.Repeat([]byte("0123456789abcdef"), 3*1024*1024/16)
+
+		err = wal.Write([]byte("small"))
+		require.NoError(t, err)
+
+		err = wal.Write(large)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("small"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "small", string(r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, 1, r.Pos().Segment)
+		assert.True(t, bytes.Equal(large, r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "small", string(r.Value()))
+		assert.Equal(t, 2, r.Pos().Segment)
+	})
+
+	n.It("returns the records since a position", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		var positions []Position
+
+		for i := 0; i < 5; i++ {
+			pos, _, err := wal.Append([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+
+			positions = append(positions, pos)
+
+			if i == 2 {
+				err = wal.WriteTag([]byte("t"))
+				require.NoError(t, err)
+			}
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var (
+			values []string
+			seen   []Position
+		)
+
+		for val, pos := range r.Since(positions[1]) {
+			values = append(values, string(val))
+			seen = append(seen, pos)
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, []string{"data2", "data3", "data4"}, values)
+		assert.Equal(t, positions[2:], seen)
+
+		for range r.Since(positions[4]) {
+			t.Fatal("no records expected")
+		}
+
+		require.NoError(t, r.Error())
+
+		bad := positions[1]
+		bad.Offset++
+
+		for range r.Since(bad) {
+		}
+
+		assert.Equal(t, ErrNotRecordPosition, r.Error())
+	})
+
+	n.It("counts the syncs made", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 3; i++ {
+			err = wal.Write([]byte("data"))
+			require.NoError(t, err)
+		}
+
+		st := wal.Stats()
+
+		// The segment's header is a write too, synced along with the
+		// first record.
+		assert.Equal(t, time.Duration(0), st.SyncRate)
+		assert.Equal(t, int64(4), st.Writes)
+		assert.Equal(t, int64(0), st.PendingWrites)
+		assert.Equal(t, int64(3), st.Syncs)
+		assert.Equal(t, int64(4), st.SyncedWrites)
+		assert.True(t, st.TotalSyncDuration >= st.LastSyncDuration)
+	})
+
+	n.It("counts the writes covered by background syncs across rotation", func() {
+		opts := DefaultWriteOptions
+		opts.SyncRate = 10 * time.Millisecond
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 6; i++ {
+			err = wal.Write([]byte("data"))
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 2, wal.index)
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for wal.Stats().PendingWrites != 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		st := wal.Stats()
+
+		// The records and the headers of the four segments.
+		assert.Equal(t, opts.SyncRate, st.SyncRate)
+		assert.Equal(t, int64(11), st.Writes)
+		assert.Equal(t, int64(0), st.PendingWrites)
+		assert.Equal(t, int64(11), st.SyncedWrites)
+		assert.True(t, st.Syncs >= 1)
+	})
+
+	n.It("reports the position of records once they're durable", func() {
+		var durable []Position
+
+		opts := DefaultWriteOptions
+		opts.OnDurable = func(p Position) {
+			durable = append(durable, p)
+		}
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		var written []Position
+
+		for i := 0; i < 3; i++ {
+			pos, _, err := wal.Append([]byte("data"))
+			require.NoError(t, err)
+
+			written = append(written, pos)
+		}
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		assert.Equal(t, written, durable)
+	})
+
+	n.It("reports durable positions from the background syncer", func() {
+		var (
+			lock    sync.Mutex
+			durable Position
+		)
+
+		opts := DefaultWriteOptions
+		opts.SyncRate = 10 * time.Millisecond
+		opts.OnDurable = func(p Position) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			durable = p
+		}
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		var last Position
+
+		for i := 0; i < 5; i++ {
+			last, _, err = wal.Append([]byte("data"))
+			require.NoError(t, err)
+		}
+
+		current := func() Position {
+			lock.Lock()
+			defer lock.Unlock()
+
+			return durable
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for current() != last && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		assert.Equal(t, last, current())
+	})
+
+	n.It("seeks to a record counted from the end", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 5; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekFromEnd(0)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data4", string(r.Value()))
+		assert.False(t, r.Next())
+
+		err = r.SeekFromEnd(2)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data2", string(r.Value()))
+
+		err = r.SeekFromEnd(4)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data0", string(r.Value()))
+
+		err = r.SeekFromEnd(5)
+		assert.Equal(t, ErrNotEnoughRecords, err)
+	})
+
+	n.It("refuses writes after a fatal error", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		require.NoError(t, wal.Sync())
+		require.NoError(t, wal.Err())
+
+		// Break the segment out from under the writer.
+		seg := wal.segment
+		seg.f.Close()
+
+		err = wal.Write([]byte("lost"))
+		require.Error(t, err)
+
+		fatal := wal.Err()
+		assert.Equal(t, err, fatal)
+
+		err = wal.Write([]byte("more"))
+		assert.Equal(t, fatal, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		assert.Equal(t, fatal, err)
+
+		err = wal.Sync()
+		assert.Equal(t, fatal, err)
+
+		wal, err = New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		require.NoError(t, wal.Err())
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+	})
+
+	n.It("closes the old segment properly as it rotates", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + entrySize(len("data"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		seg, err := NewSegmentReader(filepath.Join(path, "0"))
+		require.NoError(t, err)
+
+		defer seg.Close()
+
+		clean, err := seg.Clean()
+		require.NoError(t, err)
+
+		assert.True(t, clean)
+	})
+
+	n.It("reports segments missing from the middle of the log", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + entrySize(len("data"))
+		opts.MaxSegments = 6
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 8; i++ {
+			err = wal.Write([]byte("data"))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		gaps, err := r.Gaps()
+		require.NoError(t, err)
+
+		// Pruning the oldest segments doesn't leave gaps.
+		assert.Empty(t, gaps)
+
+		for _, i := range []int{3, 5, 6} {
+			err = os.Remove(filepath.Join(path, strconv.Itoa(i)))
+			require.NoError(t, err)
+		}
+
+		gaps, err = r.Gaps()
+		require.NoError(t, err)
+
+		assert.Equal(t, []int{3, 5, 6}, gaps)
+	})
+
+	n.It("gives up on a write when the context is done", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		pos, err := wal.WriteContext(context.Background(), []byte("first data"))
+		require.NoError(t, err)
+
+		assert.Equal(t, Position{0, segmentHeaderSize, 0}, pos)
+
+		// Hold the lock as a slow write would.
+		wal.lock.Lock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err = wal.WriteContext(ctx, []byte("timed out"))
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		wal.lock.Unlock()
+
+		pos, err = wal.WriteContext(context.Background(), []byte("second data"))
+		require.NoError(t, err)
+
+		assert.Equal(t, Position{0, segmentHeaderSize + entrySize(len("first data")), 0}, pos)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "first data", string(r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "second data", string(r.Value()))
+
+		assert.False(t, r.Next())
+	})
+
+	n.It("writes what it was given when it gives up mid-write", func() {
+		opts := DefaultWriteOptions
+		gate := gateTransform{started: make(chan struct{}, 2), release: make(chan struct{})}
+		opts.Transform = gate
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		data := []byte("original")
+
+		_, err = wal.WriteContext(ctx, data)
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		<-gate.started
+
+		// The caller reuses its buffer while the write carries on.
+		copy(data, "reused!!")
+		close(gate.release)
+
+		err = wal.Write([]byte("after"))
+		require.NoError(t, err)
+
+		r, err := NewReaderWithOptions(path, ReadOptions{Transform: gate})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "original", string(r.Value()))
+	})
+
+	n.It("prunes segments to keep a maximum number of records", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxRecords = 5
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		for i := 0; i < 9; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		values := func() []string {
+			r, err := NewReader(path)
+			require.NoError(t, err)
+
+			defer r.Close()
+
+			var values []string
+
+			for r.Next() {
+				values = append(values, string(r.Value()))
+			}
+
+			require.NoError(t, r.Error())
+
+			return values
+		}
+
+		assert.Equal(t, []string{"data4", "data5", "data6", "data7", "data8"}, values())
+
+		require.NoError(t, wal.Close())
+
+		// The records already on disk are counted when reopening.
+		opts.MaxRecords = 3
+
+		wal, err = NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 9; i < 11; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, []string{"data8", "data9", "data10"}, values())
+	})
+
+	n.It("resumes a reader from a checkpoint", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 2
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 3; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		require.True(t, r.Next())
+
+		cp := r.Checkpoint()
+		r.Close()
+
+		r, err = ResumeReader(path, cp)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data2", string(r.Value()))
+		r.Close()
+
+		// Prune the segment the checkpoint refers to.
+		for i := 3; i < 6; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		_, err = ResumeReader(path, cp)
+		assert.Equal(t, ErrStaleCheckpoint, err)
+	})
+
+	n.It("lists tags with their positions without reading records", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 64 * 1024
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		big := bytes.Repeat([]byte("x"), 40*1024)
+
+		var want []Position
+
+		for i := 0; i < 3; i++ {
+			err = wal.Write(big)
+			require.NoError(t, err)
+
+			pos, err := wal.Pos()
+			require.NoError(t, err)
+
+			err = wal.WriteTag([]byte(fmt.Sprintf("tag%d", i)))
+			require.NoError(t, err)
+
+			want = append(want, pos)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var (
+			tags []string
+			got  []Position
+		)
+
+		for tag, pos := range r.TagsOnly() {
+			tags = append(tags, string(tag))
+			got = append(got, pos)
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, []string{"tag0", "tag1", "tag2"}, tags)
+		assert.Equal(t, want, got)
+		assert.Equal(t, 2, got[2].Segment)
+	})
+
+	n.It("stores a content hash with each record when asked", func() {
+		opts := DefaultWriteOptions
+		opts.ContentHash = true
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("k"), []byte("second"))
+		require.NoError(t, err)
+
+		err = wal.WriteGroup([][]byte{[]byte("third")})
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for _, val := range []string{"first", "second", "third"} {
+			require.True(t, r.Next())
+			assert.Equal(t, val, string(r.Value()))
+
+			sum := sha256.Sum256([]byte(val))
+			assert.Equal(t, sum[:], r.ContentHash())
+		}
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("keeps reading the directory a symlink pointed to when opened", func() {
+		other := filepath.Join(dir, "other")
+		link := filepath.Join(dir, "current")
+
+		defer os.RemoveAll(other)
+		defer os.Remove(link)
+
+		for _, root := range []string{path, other} {
+			wal, err := New(root)
+			require.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				err = wal.Write([]byte(filepath.Base(root)))
+				require.NoError(t, err)
+			}
+
+			wal.Close()
+		}
+
+		err := os.Symlink(path, link)
+		require.NoError(t, err)
+
+		r, err := NewReader(link)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		real, err := filepath.EvalSymlinks(path)
+		require.NoError(t, err)
+
+		assert.Equal(t, real, r.SourcePath())
+
+		require.True(t, r.Next())
+		assert.Equal(t, "wal", string(r.Value()))
+
+		// Swap the symlink mid read.
+		err = os.Symlink(other, link+".new")
+		require.NoError(t, err)
+
+		err = os.Rename(link+".new", link)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "wal", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		err = r.Reset()
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "wal", string(r.Value()))
+		assert.Equal(t, real, r.SourcePath())
+	})
+
+	n.It("changes the sync rate while in use", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		err = wal.SetSyncRate(10 * time.Millisecond)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		assert.Equal(t, 10*time.Millisecond, wal.Stats().SyncRate)
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for wal.Stats().PendingWrites != 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		assert.Equal(t, int64(0), wal.Stats().PendingWrites)
+
+		err = wal.SetSyncRate(time.Hour)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(1), wal.Stats().PendingWrites)
+
+		err = wal.SetSyncRate(0)
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(0), wal.Stats().PendingWrites)
+
+		syncs := wal.Stats().Syncs
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		assert.Equal(t, syncs+1, wal.Stats().Syncs)
+		assert.Equal(t, int64(0), wal.Stats().PendingWrites)
+	})
+
+	n.It("returns the error syncing when going back to syncing every write", func() {
+		var fail bool
+
+		opts := DefaultWriteOptions
+		opts.SyncRate = time.Hour
+		opts.OpenFile = func(name string, flag int, perm os.FileMode) (SegmentFile, error) {
+			f, err := DefaultOpenFile(name, flag, perm)
+			if err != nil {
+				return nil, err
+			}
+
+			return failingSyncFile{f, &fail}, nil
+		}
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		fail = true
+
+		err = wal.SetSyncRate(0)
+		assert.True(t, errors.Is(err, syscall.EIO))
+		assert.True(t, errors.Is(wal.Err(), syscall.EIO))
+	})
+
+	n.It("prunes to a lowered MaxSegments on the next write", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 6; i++ {
+			err = wal.Write([]byte("data"))
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, 0, wal.first)
+		require.Equal(t, 2, wal.index)
+
+		wal.SetMaxSegments(2)
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		assert.Equal(t, 3, wal.index)
+		assert.Equal(t, 2, wal.first)
+
+		_, err = os.Stat(wal.format.path(path, 1))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	n.It("keeps working after a write fails for lack of space", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		writeFile = func(f SegmentFile, b []byte) (int, error) {
+			return 0, syscall.ENOSPC
+		}
+
+		err = wal.Write([]byte("lost"))
+
+		writeFile = SegmentFile.Write
+
+		assert.True(t, errors.Is(err, ErrNoSpace))
+		assert.NoError(t, wal.Err())
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data", string(r.Value()))
+	})
+
+	n.It("computes the position after a record", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		first, _, err := wal.Append([]byte("first"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("tag"))
+		require.NoError(t, err)
+
+		second, _, err := wal.Append([]byte("second"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+
+		next := r.NextPos()
+		assert.Equal(t, Position{first.Segment, first.Offset + entrySize(len("first")), 0}, next)
+
+		pos, err := NextPosition(path, first)
+		require.NoError(t, err)
+		assert.Equal(t, next, pos)
+
+		// The tag comes next.
+		pos, err = NextPosition(path, pos)
+		require.NoError(t, err)
+		assert.Equal(t, second, pos)
+
+		require.True(t, r.Next())
+
+		pos, err = NextPosition(path, second)
+		require.NoError(t, err)
+		assert.Equal(t, r.NextPos(), pos)
+
+		_, err = NextPosition(path, pos)
+		assert.Equal(t, ErrNotRecordPosition, err)
+	})
+
+	n.It("notifies every receiver of writes, coalescing them", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		a := wal.Notify()
+		b := wal.Notify()
+
+		for i := 0; i < 3; i++ {
+			err = wal.Write([]byte("data"))
+			require.NoError(t, err)
+		}
+
+		for _, ch := range []<-chan struct{}{a, b} {
+			select {
+			case _, ok := <-ch:
+				assert.True(t, ok)
+			default:
+				t.Fatal("not notified")
+			}
+
+			select {
+			case <-ch:
+				t.Fatal("writes weren't coalesced")
+			default:
+			}
+		}
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		for _, ch := range []<-chan struct{}{a, b, wal.Notify()} {
+			_, ok := <-ch
+			assert.False(t, ok)
+		}
+	})
+
+	n.It("splits records too large for a segment and reads them whole", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 128
+		opts.SplitLargeRecords = true
+		opts.ContentHash = true
+		opts.MaxSegments = 100
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		big := make([]byte, 1000)
+		for i := range big {
+			big[i] = byte(i)
+		}
+
+		err = wal.Write([]byte("before"))
+		require.NoError(t, err)
+
+		pos, _, err := wal.Append(big)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("after"))
+		require.NoError(t, err)
+
+		assert.True(t, wal.index > 5)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var got [][]byte
+
+		for val, p := range r.Since(Position{0, segmentHeaderSize, 0}) {
+			got = append(got, append([]byte{}, val...))
+
+			if len(val) == len(big) {
+				assert.Equal(t, pos, p)
+
+				sum := sha256.Sum256(big)
+				assert.Equal(t, sum[:], r.ContentHash())
+			}
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, [][]byte{big, []byte("after")}, got)
+	})
+
+	n.It("waits for the rest of a split record", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 128
+		opts.SplitLargeRecords = true
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		pos, _, err := wal.Append(make([]byte, 500))
+		require.NoError(t, err)
+
+		last := wal.index
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		// Lose the last chunk, as if it hadn't been written yet.
+		err = os.Truncate(wal.format.path(path, last), segmentHeaderSize)
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+		assert.Equal(t, pos, r.Pos())
+	})
+
+	n.It("skips chunks whose record was pruned", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 128
+		opts.SplitLargeRecords = true
+		opts.MaxSegments = 3
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		_, _, err = wal.Append(make([]byte, 500))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("after"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "after", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		tail, err := r.Tail(5)
+		require.NoError(t, err)
+
+		assert.Equal(t, [][]byte{[]byte("after")}, tail)
+	})
+
+	n.It("counts split records once from the end", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 128
+		opts.SplitLargeRecords = true
+		opts.MaxSegments = 100
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		big := make([]byte, 1000)
+		for i := range big {
+			big[i] = byte(i)
+		}
+
+		err = wal.Write([]byte("before"))
+		require.NoError(t, err)
+
+		err = wal.Write(big)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("after"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		tail, err := r.Tail(2)
+		require.NoError(t, err)
+
+		assert.Equal(t, [][]byte{big, []byte("after")}, tail)
+
+		tail, err = r.Tail(10)
+		require.NoError(t, err)
+
+		assert.Equal(t, [][]byte{[]byte("before"), big, []byte("after")}, tail)
+
+		err = r.SeekFromEnd(1)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, big, r.Value())
+
+		err = r.SeekFromEnd(2)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "before", string(r.Value()))
+
+		assert.Equal(t, ErrNotEnoughRecords, r.SeekFromEnd(3))
+
+		// The last chunk of a record that hasn't been finished.
+		_, _, err = wal.Append(make([]byte, 500))
+		require.NoError(t, err)
+
+		err = os.Truncate(wal.format.path(path, wal.index), wal.segment.Pos()-1)
+		require.NoError(t, err)
+
+		tail, err = r.Tail(1)
+		require.NoError(t, err)
+
+		assert.Equal(t, [][]byte{[]byte("after")}, tail)
+
+		err = r.SeekFromEnd(0)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "after", string(r.Value()))
+	})
+
+	n.It("rotates and prunes on demand", func() {
+		opts := DefaultWriteOptions
+		opts.MaxSegments = 2
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first"))
+		require.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			err = wal.Rotate()
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 3, wal.index)
+		assert.Equal(t, 0, wal.first)
+
+		err = wal.Prune()
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, wal.first)
+
+		_, err = os.Stat(wal.format.path(path, 1))
+		assert.True(t, os.IsNotExist(err))
+
+		err = wal.Write([]byte("second"))
+		require.NoError(t, err)
+
+		pos, err := wal.Pos()
+		require.NoError(t, err)
+
+		assert.Equal(t, 3, pos.Segment)
+	})
+
+	n.It("reads segments written with different segment sizes", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 4096
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		var positions []Position
+
+		for i := 0; i < 20; i++ {
+			pos, _, err := wal.Append([]byte(fmt.Sprintf("data%02d", i)))
+			require.NoError(t, err)
+
+			positions = append(positions, pos)
+		}
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data00"))
+
+		wal, err = NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 20; i < 26; i++ {
+			pos, _, err := wal.Append([]byte(fmt.Sprintf("data%02d", i)))
+			require.NoError(t, err)
+
+			positions = append(positions, pos)
+		}
+
+		assert.Equal(t, 0, positions[19].Segment)
+		assert.Equal(t, 1, positions[20].Segment)
+		assert.True(t, positions[19].Offset > opts.SegmentSize)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		ok, err := r.ValidPosition(positions[19])
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		err = r.Seek(positions[18])
+		require.NoError(t, err)
+
+		for i := 18; i < 26; i++ {
+			require.True(t, r.Next())
+			assert.Equal(t, fmt.Sprintf("data%02d", i), string(r.Value()))
+			assert.Equal(t, positions[i], r.start)
+		}
+
+		assert.False(t, r.Next())
+
+		err = r.SeekFromEnd(6)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data19", string(r.Value()))
+
+		next, err := NextPosition(path, positions[19])
+		require.NoError(t, err)
+		assert.Equal(t, r.NextPos(), next)
+	})
+
+	n.It("lets BeforePrune keep a segment until it's ready", func() {
+		var (
+			called []int
+			veto   = true
+		)
+
+		opts := DefaultWriteOptions
+		opts.MaxSegments = 2
+		opts.BeforePrune = func(seg int) error {
+			called = append(called, seg)
+
+			if seg == 1 && veto {
+				return errors.New("not archived yet")
+			}
+
+			return nil
+		}
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 3; i++ {
+			err = wal.Write([]byte("data"))
+			require.NoError(t, err)
+
+			err = wal.Rotate()
+			require.NoError(t, err)
+		}
+
+		err = wal.Prune()
+		require.NoError(t, err)
+
+		assert.Equal(t, []int{0, 1}, called)
+		assert.Equal(t, 1, wal.first)
+
+		_, err = os.Stat(wal.format.path(path, 1))
+		assert.NoError(t, err)
+
+		veto = false
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		assert.Equal(t, []int{0, 1, 1}, called)
+		assert.Equal(t, 2, wal.first)
+
+		_, err = os.Stat(wal.format.path(path, 1))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	n.It("reads records at a position through the writer", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 128
+		opts.SplitLargeRecords = true
+		opts.MaxSegments = 100
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		first, _, err := wal.Append([]byte("first"))
+		require.NoError(t, err)
+
+		big := bytes.Repeat([]byte("0123456789"), 50)
+
+		split, _, err := wal.Append(big)
+		require.NoError(t, err)
+
+		tag, err := wal.Pos()
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("tag"))
+		require.NoError(t, err)
+
+		last, _, err := wal.Append([]byte("last"))
+		require.NoError(t, err)
+
+		assert.Equal(t, wal.index, last.Segment)
+
+		for pos, want := range map[Position][]byte{
+			first: []byte("first"),
+			split: big,
+			last:  []byte("last"),
+		} {
+			val, err := wal.ReadAt(pos)
+			require.NoError(t, err)
+			assert.Equal(t, want, val)
+		}
+
+		_, err = wal.ReadAt(tag)
+		assert.Equal(t, ErrNotRecordPosition, err)
+
+		_, err = wal.ReadAt(Position{last.Segment, last.Offset + 1, 0})
+		assert.Error(t, err)
+	})
+
+	n.It("waits for the first segment before opening a reader", func() {
+		start := time.Now()
+
+		_, err := NewReaderWait(path, 20*time.Millisecond)
+		assert.Equal(t, ErrNoSegments, err)
+		assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+
+			wal, err := New(path)
+			if err != nil {
+				return
+			}
+
+			wal.Write([]byte("data"))
+			wal.Close()
+		}()
+
+		r, err := NewReaderWait(path, 5*time.Second)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for !r.Next() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		assert.Equal(t, "data", string(r.Value()))
+	})
+
+	n.It("rebuilds the tags cache from the segments on open", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("old"))
+		require.NoError(t, err)
+
+		for i := 0; i < 4; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		pos := wal.cache.Tags["commit"]
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		// The segment holding the oldest tag is gone, as after pruning.
+		err = os.Remove(filepath.Join(path, "0"))
+		require.NoError(t, err)
+
+		opts.ReconcileTagsOnOpen = true
+
+		wal, err = NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		f, err := os.Open(filepath.Join(path, "tags"))
+		require.NoError(t, err)
+
+		defer f.Close()
+
+		var tc tagCache
+
+		err = json.NewDecoder(f).Decode(&tc)
+		require.NoError(t, err)
+
+		assert.True(t, tc.valid())
+		assert.Equal(t, map[string]Position{"commit": pos}, tc.Tags)
+	})
+
+	n.It("reports where a reader is from Stat", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 3; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+
+		st := r.Stat()
+		assert.Equal(t, 0, st.Segment)
+		assert.Equal(t, r.Pos().Offset, st.Offset)
+		assert.Equal(t, 0, st.First)
+		assert.Equal(t, 1, st.Last)
+		assert.Equal(t, "", st.LastError)
+		assert.True(t, st.Clean)
+
+		for r.Next() {
+		}
+
+		st = r.Stat()
+		assert.Equal(t, 1, st.Segment)
+		assert.False(t, st.Clean)
+
+		_, err = json.Marshal(st)
+		require.NoError(t, err)
+	})
+
+	n.It("skips segments pruned before the reader reaches them", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 100
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 4; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data0", string(r.Value()))
+
+		for i := 4; i < 8; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 3; i++ {
+			err = os.Remove(wal.format.path(path, i))
+			require.NoError(t, err)
+		}
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data1", string(r.Value()))
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data6", string(r.Value()))
+
+		assert.Equal(t, 2, r.Skipped())
+		assert.Equal(t, 2, r.Stat().Skipped)
+	})
+
+	n.It("gives the exact size records and closed segments take", func() {
+		opts := DefaultWriteOptions
+
+		for _, hash := range []bool{false, true} {
+			os.RemoveAll(path)
+
+			opts.ContentHash = hash
+			opts.SegmentSize = segmentHeaderSize + 3*opts.RecordSize(len("data0"))
+
+			wal, err := NewWithOptions(path, opts)
+			require.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				_, size, err := wal.Append([]byte(fmt.Sprintf("data%d", i)))
+				require.NoError(t, err)
+
+				assert.Equal(t, segmentHeaderSize+int64(i+1)*opts.RecordSize(len("data0")), size)
+			}
+
+			err = wal.Seal()
+			require.NoError(t, err)
+
+			err = wal.Close()
+			require.NoError(t, err)
+
+			fi, err := os.Stat(wal.format.path(path, 0))
+			require.NoError(t, err)
+
+			assert.Equal(t, opts.ClosedSegmentSize(), fi.Size())
+		}
+	})
+
+	n.It("finds the position of the last record without reading records", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 100
+		opts.SplitLargeRecords = true
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		assert.Equal(t, Position{-1, -1, 0}, wal.LastPos())
+
+		_, err = LastPosition(path)
+		assert.Equal(t, ErrNoSegments, err)
+
+		var pos Position
+
+		for i := 0; i < 3; i++ {
+			pos, _, err = wal.Append([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		assert.Equal(t, pos, wal.LastPos())
+
+		last, err := LastPosition(path)
+		require.NoError(t, err)
+		assert.Equal(t, pos, last)
+
+		pos, _, err = wal.Append([]byte("a record that takes several segments"))
+		require.NoError(t, err)
+
+		err = wal.Rotate()
+		require.NoError(t, err)
+
+		assert.Equal(t, pos, wal.LastPos())
+
+		last, err = LastPosition(path)
+		require.NoError(t, err)
+		assert.Equal(t, pos, last)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		wal, err = NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		assert.Equal(t, pos, wal.LastPos())
+	})
+
+	n.It("finds the last record of a segment without walking its entries", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = 1 << 20
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		data := bytes.Repeat([]byte("x"), 100)
+
+		for i := 0; i < 4000; i++ {
+			err = wal.Write(data)
+			require.NoError(t, err)
+		}
+
+		pos, _, err := wal.Append([]byte("last"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		var read int64
+
+		open := func(name string, flag int, perm os.FileMode) (SegmentFile, error) {
+			f, err := DefaultOpenFile(name, flag, perm)
+			return readCountingFile{f, &read}, err
+		}
+
+		segPath := wal.format.path(path, 0)
+
+		// Read backward from the end of the segment being written.
+		off, _, err := lastRecordStart(open, segPath)
+		require.NoError(t, err)
+		assert.Equal(t, pos.Offset, off)
+
+		assert.True(t, read < opts.SegmentSize/4, read)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		fromFooter := func() (int64, bool) {
+			f, err := os.Open(segPath)
+			require.NoError(t, err)
+
+			defer f.Close()
+
+			fi, err := f.Stat()
+			require.NoError(t, err)
+
+			hdr, _, err := readHeader(f)
+			require.NoError(t, err)
+
+			off, ok, err := footerLastRecord(f, hdr, fi.Size())
+			require.NoError(t, err)
+
+			return off, ok
+		}
+
+		// Taken from the footer once it's closed.
+		read = 0
+
+		off, _, err = lastRecordStart(open, segPath)
+		require.NoError(t, err)
+		assert.Equal(t, pos.Offset, off)
+
+		assert.True(t, read < opts.SegmentSize/4, read)
+
+		off, ok := fromFooter()
+		require.True(t, ok)
+		assert.Equal(t, pos.Offset, off)
+
+		// A footer holding only the count, as written before the last
+		// record's offset was added, has the segment read backward.
+		seg, err := ioutil.ReadFile(segPath)
+		require.NoError(t, err)
+
+		end := len(seg) - len(closingMagic) - footerSize
+		ft, ok := decodeFooter(seg[end : end+footerSize])
+		require.True(t, ok)
+
+		seg = append(seg[:end], encodeEntry(footerType, seg[end+6:end+6+countFooterLen])...)
+		seg = append(seg, closingMagic...)
+
+		err = ioutil.WriteFile(segPath, seg, 0644)
+		require.NoError(t, err)
+
+		read = 0
+
+		_, ok = fromFooter()
+		assert.False(t, ok)
+
+		off, _, err = lastRecordStart(open, segPath)
+		require.NoError(t, err)
+		assert.Equal(t, pos.Offset, off)
+
+		r, err := NewSegmentReader(segPath)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		cnt, ok, err := r.Records()
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, ft.records, cnt)
+	})
+
+	n.It("reports how far a reader is behind the end of the log", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 100
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 10; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		records, size, err := r.Lag()
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(10), records)
+		assert.Equal(t, 10*entrySize(len("data0")), size)
+
+		for i := 0; i < 3; i++ {
+			require.True(t, r.Next())
+		}
+
+		records, size, err = r.Lag()
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(7), records)
+		assert.Equal(t, 7*entrySize(len("data0")), size)
+
+		for r.Next() {
+		}
+
+		records, size, err = r.Lag()
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(0), records)
+		assert.Equal(t, int64(0), size)
+	})
+
+	n.It("keeps MinSegments segments however old they are", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 100
+		opts.SegmentTTL = time.Hour
+		opts.MinSegments = 3
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 10; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, 4, wal.index)
+
+		old := time.Now().Add(-2 * time.Hour)
+
+		for i := 0; i <= 4; i++ {
+			err = os.Chtimes(wal.format.path(path, i), old, old)
+			require.NoError(t, err)
+		}
+
+		err = wal.Prune()
+		require.NoError(t, err)
+
+		first, last, err := rangeSegments(path, wal.format)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, first)
+		assert.Equal(t, 4, last)
+	})
+
+	n.It("skips records written with a TTL once they expire", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first"))
+		require.NoError(t, err)
+
+		err = wal.WriteTTL([]byte("stale"), -time.Second)
+		require.NoError(t, err)
+
+		err = wal.WriteTTL([]byte("fresh"), time.Hour)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("last"))
+		require.NoError(t, err)
+
+		read := func(opts ReadOptions) ([]string, *WALReader) {
+			r, err := NewReaderWithOptions(path, opts)
+			require.NoError(t, err)
+
+			var got []string
+
+			for r.Next() {
+				got = append(got, string(r.Value()))
+			}
+
+			require.NoError(t, r.Error())
+
+			return got, r
+		}
+
+		got, r := read(ReadOptions{HonorRecordTTL: true})
+		defer r.Close()
+
+		assert.Equal(t, []string{"first", "fresh", "last"}, got)
+		assert.Equal(t, int64(1), r.Expired())
+
+		got, r = read(ReadOptions{})
+		defer r.Close()
+
+		assert.Equal(t, []string{"first", "stale", "fresh", "last"}, got)
+		assert.Equal(t, int64(0), r.Expired())
+
+		seg, err := NewSegmentReader(wal.format.path(path, 0))
+		require.NoError(t, err)
+
+		defer seg.Close()
+
+		require.True(t, seg.Next())
+		assert.True(t, seg.Expires().IsZero())
+
+		require.True(t, seg.Next())
+		assert.True(t, seg.Expires().Before(time.Now()))
+
+		require.True(t, seg.Next())
+		assert.True(t, seg.Expires().After(time.Now().Add(time.Minute)))
+	})
+
+	n.It("splits records written with a TTL like any other", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 64
+		opts.MaxSegments = 100
+		opts.SplitLargeRecords = true
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		stale := string(bytes.Repeat([]byte("stale"), 10))
+		fresh := string(bytes.Repeat([]byte("fresh"), 10))
+
+		err = wal.WriteTTL([]byte(stale), -time.Second)
+		require.NoError(t, err)
+
+		err = wal.WriteTTL([]byte(fresh), time.Hour)
+		require.NoError(t, err)
+
+		require.True(t, wal.index >= 3, "records weren't split")
+
+		err = wal.Write([]byte("last"))
+		require.NoError(t, err)
+
+		r, err := NewReaderWithOptions(path, ReadOptions{HonorRecordTTL: true})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var got []string
+
+		for r.Next() {
+			got = append(got, string(r.Value()))
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, []string{fresh, "last"}, got)
+		assert.Equal(t, int64(1), r.Expired())
+	})
+
+	n.It("reports tags left behind by segments that are gone", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		err = wal.Close()
+		require.NoError(t, err)
+
+		err = os.Remove(filepath.Join(path, "0"))
+		require.NoError(t, err)
+
+		_, err = NewReader(path)
+		assert.Equal(t, ErrOrphanedTags, err)
+
+		// A writer starts the tags afresh.
+		wal, err = New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		assert.Equal(t, io.EOF, r.SeekTag([]byte("commit")))
+	})
+
+	n.It("never removes a segment with NoPrune set", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 1
+		opts.MaxRecords = 1
+		opts.SegmentTTL = time.Nanosecond
+		opts.NoPrune = true
+		opts.BeforePrune = func(int) error {
+			t.Error("BeforePrune called")
+			return nil
+		}
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 10; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+
+			old := time.Now().Add(-time.Hour)
+
+			err = os.Chtimes(wal.format.path(path, 0), old, old)
+			require.NoError(t, err)
+		}
+
+		err = wal.Rotate()
+		require.NoError(t, err)
+
+		err = wal.Prune()
+		require.NoError(t, err)
+
+		for i := 0; i <= 5; i++ {
+			_, err = os.Stat(wal.format.path(path, i))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for i := 0; i < 10; i++ {
+			require.True(t, r.Next())
+			assert.Equal(t, fmt.Sprintf("data%d", i), string(r.Value()))
+		}
+	})
+
+	n.It("stops readers with ErrLogReset when the log starts over", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 100
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 4; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for r.Next() {
+		}
+
+		require.NoError(t, r.Error())
+
+		err = wal.TruncateAll()
+		require.NoError(t, err)
+
+		// Enough that the new log has a segment after the one the
+		// reader was in.
+		for i := 0; i < 6; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("new%d", i)))
+			require.NoError(t, err)
+		}
+
+		assert.False(t, r.Next())
+		assert.Equal(t, ErrLogReset, r.Error())
+
+		err = r.Reset()
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "new0", string(r.Value()))
+	})
+
+	n.It("rejects positions from before the log started over", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		pos, _, err := wal.Append([]byte("old data"))
+		require.NoError(t, err)
+
+		err = wal.TruncateAll()
+		require.NoError(t, err)
+
+		newPos, _, err := wal.Append([]byte("new data"))
+		require.NoError(t, err)
+
+		// The same segment and offset, in the segment that replaced it
+		require.Equal(t, pos.Segment, newPos.Segment)
+		require.Equal(t, pos.Offset, newPos.Offset)
+		assert.Equal(t, pos.Epoch+1, newPos.Epoch)
+
+		_, err = wal.ReadAt(pos)
+		assert.Equal(t, ErrStalePosition, err)
+
+		data, err := wal.ReadAt(newPos)
+		require.NoError(t, err)
+		assert.Equal(t, "new data", string(data))
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.Seek(pos)
+		assert.Equal(t, ErrStalePosition, err)
+
+		err = r.Seek(newPos)
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "new data", string(r.Value()))
+		assert.Equal(t, newPos.Epoch, r.Pos().Epoch)
+	})
+
+	n.It("finds the tag before the reader's position", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 100
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("data0"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("A"))
+		require.NoError(t, err)
+
+		for i := 1; i < 5; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		err = wal.WriteTag([]byte("B"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("data5"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekTag([]byte("B"))
+		require.NoError(t, err)
+
+		end := r.Pos()
+
+		tag, pos, err := r.PrevTag()
+		require.NoError(t, err)
+
+		assert.Equal(t, "A", string(tag))
+		assert.Equal(t, end, r.Pos())
+
+		err = r.Seek(pos)
+		require.NoError(t, err)
+
+		for i := 1; i < 5; i++ {
+			require.True(t, r.Next())
+			assert.Equal(t, fmt.Sprintf("data%d", i), string(r.Value()))
+		}
+
+		err = r.SeekTag([]byte("A"))
+		require.NoError(t, err)
+
+		_, _, err = r.PrevTag()
+		assert.Equal(t, ErrTagNotFound, err)
+	})
+
+	n.It("only looks for an earlier tag in segments that remain", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + entrySize(len("data00"))
+		opts.MaxSegments = 2
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 50; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%02d", i)))
+			require.NoError(t, err)
+		}
+
+		var opens int
+
+		ropts := DefaultReadOptions
+		ropts.OpenFile = func(name string, flag int, perm os.FileMode) (SegmentFile, error) {
+			opens++
+			return DefaultOpenFile(name, flag, perm)
+		}
+
+		r, err := NewReaderWithOptions(path, ropts)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+
+		opens = 0
+
+		_, _, err = r.PrevTag()
+		assert.Equal(t, ErrTagNotFound, err)
+
+		assert.Equal(t, 1, opens)
+	})
+
+	n.It("seeks to the last record past trailing tags", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("key"), []byte("keyed data"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		err = r.SeekLast()
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "keyed data", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("seeks to the last record when its value holds an entry", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first"))
+		require.NoError(t, err)
+
+		last := append([]byte("prefix-"), encodeEntry(dataType, []byte("nested"))...)
+
+		err = wal.Write(last)
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		wr, err := wal.NewReader()
+		require.NoError(t, err)
+
+		defer wr.Close()
+
+		for _, r := range []*WALReader{r, wr} {
+			err = r.SeekLast()
+			require.NoError(t, err)
+
+			require.True(t, r.Next())
+			assert.Equal(t, last, r.Value())
+
+			assert.False(t, r.Next())
+			require.NoError(t, r.Error())
+		}
+	})
+
+	n.It("reports the position of the current record", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		first, _, err := wal.Append([]byte("first"))
+		require.NoError(t, err)
+
+		second, _, err := wal.Append([]byte("second"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, first, r.CurrentPos())
+		assert.Equal(t, second, r.Pos())
+
+		require.True(t, r.Next())
+		assert.Equal(t, second, r.CurrentPos())
+
+		err = r.Seek(r.CurrentPos())
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "second", string(r.Value()))
+	})
+
+	n.It("returns only the records matching a predicate", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		var want []Position
+
+		for i := 0; i < 6; i++ {
+			pos, _, err := wal.Append([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+
+			if i%2 == 0 {
+				want = append(want, pos)
+			}
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var (
+			got       []string
+			positions []Position
+		)
+
+		for val, pos := range r.Filter(func(val []byte) bool { return (val[4]-'0')%2 == 0 }) {
+			got = append(got, string(val))
+			positions = append(positions, pos)
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, []string{"data0", "data2", "data4"}, got)
+		assert.Equal(t, want, positions)
+	})
+
+	n.It("skips records whose keys don't match", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		big := bytes.Repeat([]byte("x"), 3*bufferSize)
+
+		_, err = wal.WriteKeyed([]byte("other"), big)
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("no key"))
+		require.NoError(t, err)
+
+		pos, err := wal.WriteKeyed([]byte("wanted"), []byte("first"))
+		require.NoError(t, err)
+
+		err = wal.WriteTag([]byte("commit"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("other"), []byte("data"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteKeyed([]byte("wanted"), []byte("second"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var got []string
+
+		for val, p := range r.FilterKey(func(key []byte) bool { return string(key) == "wanted" }) {
+			if got == nil {
+				assert.Equal(t, pos, p)
+			}
+
+			got = append(got, string(val))
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, []string{"first", "second"}, got)
+		assert.Nil(t, r.keyFilter)
+	})
+
+	n.It("evicts the oldest tags from the cache past MaxTags", func() {
+		opts := DefaultWriteOptions
+		opts.MaxTags = 2
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for _, tag := range []string{"a", "b", "c"} {
+			err = wal.Write([]byte("data " + tag))
+			require.NoError(t, err)
+
+			err = wal.WriteTag([]byte(tag))
+			require.NoError(t, err)
+		}
+
+		// Rewriting a tag moves it to the newest position.
+		err = wal.WriteTag([]byte("b"))
+		require.NoError(t, err)
+
+		tags, err := readTagsFile(path)
+		require.NoError(t, err)
+
+		assert.Len(t, tags, 2)
+		assert.Contains(t, tags, "b")
+		assert.Contains(t, tags, "c")
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		// The evicted tag is still found by scanning.
+		err = r.SeekTag([]byte("a"))
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "data b", string(r.Value()))
+	})
+
+	n.It("makes records visible to other readers without syncing", func() {
+		opts := DefaultWriteOptions
+		opts.SyncRate = time.Hour
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("not synced"))
+		require.NoError(t, err)
+
+		err = wal.PushVisible()
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "not synced", string(r.Value()))
+	})
+
+	n.It("steps through records saying when it jumped past pruned segments", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 2*entrySize(len("data0"))
+		opts.MaxSegments = 100
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 4; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		value, pos, status, err := r.NextDurable()
+		require.NoError(t, err)
+		assert.Equal(t, "data0", string(value))
+		assert.Equal(t, 0, pos.Segment)
+		assert.Equal(t, StatusNormal, status)
+
+		for i := 4; i < 8; i++ {
+			err = wal.Write([]byte(fmt.Sprintf("data%d", i)))
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 3; i++ {
+			err = os.Remove(wal.format.path(path, i))
+			require.NoError(t, err)
+		}
+
+		value, _, status, err = r.NextDurable()
+		require.NoError(t, err)
+		assert.Equal(t, "data1", string(value))
+		assert.Equal(t, StatusNormal, status)
+
+		value, pos, status, err = r.NextDurable()
+		require.NoError(t, err)
+		assert.Equal(t, "data6", string(value))
+		assert.Equal(t, 3, pos.Segment)
+		assert.Equal(t, StatusJumpedAfterPrune, status)
+
+		value, _, status, err = r.NextDurable()
+		require.NoError(t, err)
+		assert.Equal(t, "data7", string(value))
+		assert.Equal(t, StatusNormal, status)
+
+		_, _, status, err = r.NextDurable()
+		require.NoError(t, err)
+		assert.Equal(t, StatusAtEnd, status)
+
+		err = wal.Write([]byte("data8"))
+		require.NoError(t, err)
+
+		value, _, status, err = r.NextDurable()
+		require.NoError(t, err)
+		assert.Equal(t, "data8", string(value))
+		assert.Equal(t, StatusNormal, status)
+	})
+
+	n.It("collapses records identical to the one before them", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for _, data := range []string{"a", "a", "a", "b", "a", "b", "b"} {
+			err = wal.Write([]byte(data))
+			require.NoError(t, err)
+		}
+
+		// Same data, but different keys or sequences.
+		_, err = wal.WriteKeyed([]byte("k"), []byte("b"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteSeq(1, []byte("b"))
+		require.NoError(t, err)
+
+		_, err = wal.WriteSeq(1, []byte("b"))
+		require.NoError(t, err)
+
+		r, err := NewReaderWithOptions(path, ReadOptions{DedupConsecutive: true})
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var got []string
+
+		for r.Next() {
+			got = append(got, string(r.Key())+string(r.Value()))
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, []string{"a", "b", "a", "b", "kb", "b"}, got)
+		assert.Equal(t, int64(4), r.Collapsed())
+	})
+
+	n.It("lists the sizes of records without reading them", func() {
+		opts := DefaultWriteOptions
+		opts.SegmentSize = segmentHeaderSize + 3*entrySize(20)
+		opts.SplitLargeRecords = true
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		var want []int
+
+		for i := 1; i <= 8; i++ {
+			data := bytes.Repeat([]byte("x"), i*2)
+
+			err = wal.Write(data)
+			require.NoError(t, err)
+
+			want = append(want, len(data))
+
+			if i == 4 {
+				err = wal.WriteTag([]byte("tag"))
+				require.NoError(t, err)
+			}
+		}
+
+		_, err = wal.WriteKeyed([]byte("k"), []byte("keyed"))
+		require.NoError(t, err)
+
+		want = append(want, len("keyed"))
+
+		// Split over several segments, but a single record.
+		err = wal.Write(bytes.Repeat([]byte("y"), 100))
+		require.NoError(t, err)
+
+		want = append(want, 100)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var got []int
+
+		for size := range r.RecordSizes() {
+			got = append(got, size)
+		}
+
+		require.NoError(t, r.Error())
+		assert.Equal(t, want, got)
+
+		for size := range r.RecordSizes() {
+			assert.Equal(t, 2, size)
+			break
+		}
+
+		require.True(t, r.Next())
+		assert.Equal(t, "xx", string(r.Value()))
+	})
+
+	n.It("lists the sizes of records with fields longer than a buffer", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		_, err = wal.WriteKeyed(bytes.Repeat([]byte("k"), 10000), []byte("keyed"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("plain"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var got []int
+
+		for size := range r.RecordSizes() {
+			got = append(got, size)
+		}
+
+		require.NoError(t, r.Error())
+		assert.Equal(t, []int{len("keyed"), len("plain")}, got)
+	})
+
 	n.Meow()
 }
+
+func BenchmarkSeekTag(b *testing.B) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(b, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	wal, err := New(path)
+	require.NoError(b, err)
+
+	for i := 0; i < 3; i++ {
+		err = wal.Write([]byte("this is data"))
+		require.NoError(b, err)
+
+		err = wal.rotateSegment()
+		require.NoError(b, err)
+	}
+
+	err = wal.WriteTag([]byte("commit"))
+	require.NoError(b, err)
+
+	err = wal.Write([]byte("more data"))
+	require.NoError(b, err)
+
+	err = wal.Close()
+	require.NoError(b, err)
+
+	var opens int
+
+	defer func(orig func(string) (*os.File, error)) { openFile = orig }(openFile)
+
+	openFile = func(path string) (*os.File, error) {
+		opens++
+		return os.Open(path)
+	}
+
+	r, err := NewReader(path)
+	require.NoError(b, err)
+
+	defer r.Close()
+
+	b.ResetTimer()
+
+	opens = 0
+
+	for i := 0; i < b.N; i++ {
+		err = r.Seek(Position{0, 0, 0})
+		require.NoError(b, err)
+
+		err = r.SeekTag([]byte("commit"))
+		require.NoError(b, err)
+	}
+
+	b.ReportMetric(float64(opens)/float64(b.N), "opens/op")
+}
+
+// BenchmarkWriteRotation measures the latency of concurrent writes to a
+// WAL that rotates often, reporting the 99th percentile. It's the
+// baseline for any change to how segments are closed at rotation.
+func BenchmarkWriteRotation(b *testing.B) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(b, err)
+
+	defer os.RemoveAll(dir)
+
+	opts := DefaultWriteOptions
+	opts.SegmentSize = 64 * 1024
+	opts.MaxSegments = 1 << 20
+	opts.SyncRate = time.Second
+
+	wal, err := NewWithOptions(filepath.Join(dir, "wal"), opts)
+	require.NoError(b, err)
+
+	defer wal.Close()
+
+	data := bytes.Repeat([]byte("x"), 1024)
+
+	var (
+		lock      sync.Mutex
+		latencies []time.Duration
+	)
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var mine []time.Duration
+
+		for pb.Next() {
+			start := time.Now()
+
+			err := wal.Write(data)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+
+			mine = append(mine, time.Since(start))
+		}
+
+		lock.Lock()
+		latencies = append(latencies, mine...)
+		lock.Unlock()
+	})
+
+	b.StopTimer()
+
+	if len(latencies) == 0 {
+		return
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	b.ReportMetric(float64(latencies[len(latencies)*99/100]), "p99-ns")
+}
+
+type versionStamp struct{}
+
+func (versionStamp) OnWrite(record []byte) []byte {
+	return append([]byte("v1:"), record...)
+}
+
+func (versionStamp) OnRead(record []byte) []byte {
+	return bytes.TrimPrefix(record, []byte("v1:"))
+}
+
+// gateTransform holds up each write until release is closed, saying on
+// started that it has begun.
+type gateTransform struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g gateTransform) OnWrite(record []byte) []byte {
+	g.started <- struct{}{}
+	<-g.release
+
+	return record
+}
+
+func (gateTransform) OnRead(record []byte) []byte {
+	return record
+}
+
+// readCountingFile is a SegmentFile that counts the bytes read through
+// it.
+type readCountingFile struct {
+	SegmentFile
+	read *int64
+}
+
+func (f readCountingFile) Read(b []byte) (int, error) {
+	n, err := f.SegmentFile.Read(b)
+	*f.read += int64(n)
+	return n, err
+}
+
+func (f readCountingFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.SegmentFile.ReadAt(b, off)
+	*f.read += int64(n)
+	return n, err
+}
+
+// failingSyncFile is a SegmentFile whose syncs fail with EIO once fail
+// is set.
+type failingSyncFile struct {
+	SegmentFile
+	fail *bool
+}
+
+func (f failingSyncFile) Sync() error {
+	if *f.fail {
+		return syscall.EIO
+	}
+
+	return f.SegmentFile.Sync()
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	return data
+}
+
+// FuzzRoundTrip checks that records read back exactly as written,
+// whatever they contain, including bytes that look like the markers and
+// framing used in segments. The segment is abandoned without being
+// closed after the first two records, as in a crash, and reopened for
+// the third.
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte("data"), []byte{}, []byte{0, 0, 0})
+	f.Add(closingMagic, append([]byte("x"), closingMagic...), closingMagic[:10])
+	f.Add(sealMarker, encodeFooter(1, 0), append(encodeFooter(2, segmentHeaderSize), closingMagic...))
+	f.Add([]byte("x"), append(encodeFooter(1, -1), closingMagic...), []byte("y"))
+	f.Add(encodeEntry(dataType, []byte("nested")), []byte{0xff, 0xff, 0xff, 0xff}, []byte("z"))
+
+	f.Fuzz(func(t *testing.T, a, b, c []byte) {
+		path := filepath.Join(t.TempDir(), "wal")
+
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		require.NoError(t, wal.Write(a))
+		require.NoError(t, wal.Write(b))
+
+		// Abandon the writer without closing the segment properly.
+		wal.segment.f.Close()
+
+		wal, err = New(path)
+		require.NoError(t, err)
+
+		require.NoError(t, wal.Write(c))
+		require.NoError(t, wal.Close())
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for _, want := range [][]byte{a, b, c} {
+			require.True(t, r.Next())
+			require.Equal(t, string(want), string(r.Value()))
+		}
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+}
+
+func BenchmarkSeekLast(b *testing.B) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(b, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	opts := DefaultWriteOptions
+	opts.SegmentSize = 16 * 1024 * 1024
+
+	wal, err := NewWithOptions(path, opts)
+	require.NoError(b, err)
+
+	data := bytes.Repeat([]byte("x"), 1024)
+
+	for wal.segment.Size()+entrySize(len(data)) < opts.SegmentSize {
+		err = wal.Write(data)
+		require.NoError(b, err)
+	}
+
+	err = wal.Close()
+	require.NoError(b, err)
+
+	r, err := NewReader(path)
+	require.NoError(b, err)
+
+	defer r.Close()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err = r.SeekLast()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
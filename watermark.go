@@ -0,0 +1,122 @@
+package wal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The watermark file holds the JSON encoded Position that the entries
+// known to be synced to disk end at. It's kept by writers with the
+// DurableWatermark option, and read by readers with ReadDurableOnly.
+const watermarkFileName = "durable"
+
+// markDurable records in the watermark file that everything before pos
+// has been synced. A segment is synced for the last time before anything
+// is written to the next, so positions arrive in order, but the
+// watermark is still only ever moved forward.
+func (wal *WALWriter) markDurable(pos Position) {
+	wal.markLock.Lock()
+	defer wal.markLock.Unlock()
+
+	if pos.Segment < wal.durable.Segment ||
+		(pos.Segment == wal.durable.Segment && pos.Offset <= wal.durable.Offset) {
+		return
+	}
+
+	wal.durable = pos
+
+	// Renamed into place so a reader never sees it partly written. It
+	// isn't synced: if it's lost in a crash, readers see less as
+	// durable than is, never more.
+	data, err := json.Marshal(pos)
+	if err == nil {
+		tmp := filepath.Join(wal.root, watermarkFileName+".tmp")
+
+		err = ioutil.WriteFile(tmp, data, 0644)
+		if err == nil {
+			err = os.Rename(tmp, filepath.Join(wal.root, watermarkFileName))
+		}
+	}
+
+	if err != nil {
+		wal.fail(err)
+	}
+}
+
+// resetDurable forgets the watermark, for when the WAL starts over.
+func (wal *WALWriter) resetDurable() error {
+	wal.markLock.Lock()
+	defer wal.markLock.Unlock()
+
+	wal.durable = Position{-1, -1, 0}
+
+	err := os.Remove(filepath.Join(wal.root, watermarkFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// readWatermark returns the position durable entries end at according
+// to the watermark file in root, or false if there isn't a usable one.
+func readWatermark(root string) (Position, bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, watermarkFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Position{}, false, nil
+		}
+
+		return Position{}, false, err
+	}
+
+	var pos Position
+
+	// One emptied by a crash is as good as none.
+	if json.Unmarshal(data, &pos) != nil {
+		return Position{}, false, nil
+	}
+
+	return pos, true, nil
+}
+
+// durableEntry reports whether the entry the reader has just read ended
+// at or before the watermark, reading the watermark again if it's past
+// the one last read.
+func (r *WALReader) durableEntry() (bool, error) {
+	below := func() bool {
+		return r.index < r.durable.Segment ||
+			(r.index == r.durable.Segment && r.seg.Pos() <= r.durable.Offset)
+	}
+
+	if r.durableOK && below() {
+		return true, nil
+	}
+
+	pos, ok, err := readWatermark(r.root)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	r.durable = pos
+	r.durableOK = true
+
+	return below(), nil
+}
+
+// Durable reports whether the current record had been synced to disk,
+// according to the watermark file kept by a writer with DurableWatermark,
+// so that it would survive a crash. Without a watermark file nothing is
+// durable. The file is only read again for a record past the watermark
+// last read, so calling Durable for each record as it's read is cheap,
+// such as to show which of the records at the end of the log are still
+// waiting for a sync.
+func (r *WALReader) Durable() (bool, error) {
+	if r.seg == nil {
+		return false, nil
+	}
+
+	return r.durableEntry()
+}
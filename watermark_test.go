@@ -0,0 +1,206 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vektra/neko"
+)
+
+func TestWatermark(t *testing.T) {
+	n := neko.Start(t)
+
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wal")
+
+	n.Setup(func() {
+		os.RemoveAll(path)
+	})
+
+	ropts := DefaultReadOptions
+	ropts.ReadDurableOnly = true
+
+	n.It("reads only what has been synced", func() {
+		opts := DefaultWriteOptions
+		opts.DurableWatermark = true
+		opts.SyncRate = time.Hour
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first"))
+		require.NoError(t, err)
+
+		err = wal.Sync()
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("second"))
+		require.NoError(t, err)
+
+		r, err := NewReaderWithOptions(path, ropts)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		require.True(t, r.Next())
+		assert.Equal(t, "first", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		err = wal.Sync()
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "second", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("follows the watermark across segments", func() {
+		opts := DefaultWriteOptions
+		opts.DurableWatermark = true
+		opts.SegmentSize = segmentHeaderSize + entrySize(len("data"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for i := 0; i < 3; i++ {
+			err = wal.Write([]byte("data"))
+			require.NoError(t, err)
+		}
+
+		r, err := NewReaderWithOptions(path, ropts)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		for i := 0; i < 3; i++ {
+			require.True(t, r.Next())
+			assert.Equal(t, "data", string(r.Value()))
+		}
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("syncs the old segment before the next when rotating", func() {
+		opts := DefaultWriteOptions
+		opts.DurableWatermark = true
+		opts.SyncRate = time.Hour
+		opts.SegmentSize = segmentHeaderSize + entrySize(len("first"))
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("first"))
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("second"))
+		require.NoError(t, err)
+
+		r, err := NewReaderWithOptions(path, ropts)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		// Rotating synced the first segment, but not the second.
+		require.True(t, r.Next())
+		assert.Equal(t, "first", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+
+		err = wal.Sync()
+		require.NoError(t, err)
+
+		require.True(t, r.Next())
+		assert.Equal(t, "second", string(r.Value()))
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("reads nothing without a watermark", func() {
+		wal, err := New(path)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		err = wal.Write([]byte("data"))
+		require.NoError(t, err)
+
+		r, err := NewReaderWithOptions(path, ropts)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		assert.False(t, r.Next())
+		require.NoError(t, r.Error())
+	})
+
+	n.It("reports whether each record is durable", func() {
+		opts := DefaultWriteOptions
+		opts.DurableWatermark = true
+		opts.SyncRate = time.Hour
+
+		wal, err := NewWithOptions(path, opts)
+		require.NoError(t, err)
+
+		defer wal.Close()
+
+		for _, rec := range []string{"first", "second"} {
+			err = wal.Write([]byte(rec))
+			require.NoError(t, err)
+		}
+
+		err = wal.Sync()
+		require.NoError(t, err)
+
+		err = wal.Write([]byte("third"))
+		require.NoError(t, err)
+
+		r, err := NewReader(path)
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		var durable []bool
+
+		for r.Next() {
+			ok, err := r.Durable()
+			require.NoError(t, err)
+
+			durable = append(durable, ok)
+		}
+
+		require.NoError(t, r.Error())
+
+		assert.Equal(t, []bool{true, true, false}, durable)
+
+		err = wal.Sync()
+		require.NoError(t, err)
+
+		ok, err := r.Durable()
+		require.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	n.Meow()
+}